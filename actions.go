@@ -0,0 +1,221 @@
+package main
+
+import (
+  "fmt"
+  "strings"
+  "time"
+)
+
+// RuleAction is what happens to a message a rule matched
+type RuleAction struct {
+  Kind    string // "trash", "junk", "move", "flag", "tag" or "none"; empty means the default action
+  Folder  string // destination for "move"
+  Keyword string // keyword for "tag"; empty means TagPrefix followed by the trash code
+  Flagged bool   // "tag" also sets \Flagged
+  Seen    bool   // "tag" also sets \Seen
+}
+
+// ActionsConfig is the "actions" section of Config.json. Each value is trash, junk, flag, none,
+// move:<folder> or tag[:<keyword>][+flagged][+seen].
+type ActionsConfig struct {
+  Default        string `json:"default"`        // blacklist phrases without an action of their own
+  NotWhitelisted string `json:"notWhitelisted"` // senders missing from the whitelist (trash code 1)
+  Unacceptable   string `json:"unacceptable"`   // unacceptable characters in name or subject (trash codes 1 and 2)
+  TagOnly        bool   `json:"tagOnly"`        // same as --tag-only
+  TagPrefix      string `json:"tagPrefix"`      // keyword prefix for "tag" without a keyword; default SpamBeGone-Code
+}
+
+// BlacklistRule is one parsed Blacklist.txt line: "phrase" or "phrase | action=junk,maxAge=7d"
+type BlacklistRule struct {
+  Phrase string
+  Action RuleAction
+  MaxAge time.Duration // only messages younger than this are matched; 0 means any age
+}
+
+var (
+  // Actions from Config.json, set by ParseActions
+  DefaultAction        = RuleAction{Kind: "trash"}
+  NotWhitelistedAction = RuleAction{Kind: "trash"}
+  UnacceptableAction   = RuleAction{Kind: "trash"}
+  // Actions given on Blacklist.txt lines of the folder being filtered, by phrase
+  BlacklistActions map[string]RuleAction
+  // Blacklist.txt phrase of each phrase and variant of the folder being filtered
+  BlacklistOriginals map[string]string
+  // Rule that matched the message being evaluated: "NotWhiteList", "Unacceptable" or a phrase
+  MatchedRule string
+  // Keywords that tell clients and server-side filters a message is or is not spam
+  JunkKeyword    = "$Junk"
+  NotJunkKeyword = "$NotJunk"
+)
+
+// Parse an action such as "junk", "move:Archive/Spam" or "tag:Newsletter+seen"
+func ParseRuleAction(spec string) (RuleAction, error) {
+  spec = strings.TrimSpace(spec)
+  kind, argument, hasArgument := strings.Cut(spec, ":")
+  kind = strings.ToLower(strings.TrimSpace(kind))
+  argument = strings.TrimSpace(argument)
+  if strings.HasPrefix(kind, "tag") {
+    return ParseTagAction(spec)
+  }
+  switch kind {
+    case "trash", "junk", "flag", "none":
+      if hasArgument {
+        return RuleAction{}, fmt.Errorf("action %q does not take a folder", kind)
+      }
+      return RuleAction{Kind: kind}, nil
+    case "move":
+      if argument == "" {
+        return RuleAction{}, fmt.Errorf("action \"move\" needs a folder, e.g. move:Archive/Spam")
+      }
+      return RuleAction{Kind: kind, Folder: argument}, nil
+  }
+  return RuleAction{}, fmt.Errorf("unknown action %q (want trash, junk, flag, tag, none or move:<folder>)", spec)
+}
+
+// Format an action the way it is written in the config
+func (a RuleAction) String() string {
+  switch a.Kind {
+    case "move":
+      return "move:" + a.Folder
+    case "tag":
+      s := "tag"
+      if a.Keyword != "" {
+        s += ":" + a.Keyword
+      }
+      if a.Flagged {
+        s += "+flagged"
+      }
+      if a.Seen {
+        s += "+seen"
+      }
+      return s
+  }
+  return a.Kind
+}
+
+// Folder the action moves messages to, or "" when they stay where they are
+func (a RuleAction) Destination() string {
+  switch a.Kind {
+    case "trash":
+      return TrashFolder
+    case "junk":
+      return JunkFolder
+    case "move":
+      return a.Folder
+  }
+  return ""
+}
+
+// Parse the "actions" section of Config.json
+func ParseActions() error {
+  var err error
+  for _, setting := range []struct {
+    name   string
+    spec   string
+    action *RuleAction
+  }{
+    {"default", Config.Actions.Default, &DefaultAction},
+    {"notWhitelisted", Config.Actions.NotWhitelisted, &NotWhitelistedAction},
+    {"unacceptable", Config.Actions.Unacceptable, &UnacceptableAction},
+  } {
+    *setting.action = RuleAction{Kind: "trash"}
+    if setting.spec == "" {
+      continue
+    }
+    if *setting.action, err = ParseRuleAction(setting.spec); err != nil {
+      return fmt.Errorf("actions.%s: %w", setting.name, err)
+    }
+  }
+  if Config.Actions.TagOnly {
+    TagOnly = true
+  }
+  TagPrefix = "SpamBeGone-Code"
+  if Config.Actions.TagPrefix != "" {
+    if err := ValidateKeyword(Config.Actions.TagPrefix); err != nil {
+      return fmt.Errorf("actions.tagPrefix: %w", err)
+    }
+    TagPrefix = Config.Actions.TagPrefix
+  }
+  return nil
+}
+
+// Parse a Blacklist.txt line. Options follow a "|" and are comma-separated key=value pairs;
+// the phrase is lowercased but option values keep their case so folder names survive.
+func ParseBlacklistLine(line string) (BlacklistRule, error) {
+  phrase, options, _ := strings.Cut(line, "|")
+  rule := BlacklistRule{Phrase: strings.ToLower(strings.TrimSpace(phrase))}
+  for _, option := range strings.Split(options, ",") {
+    if strings.TrimSpace(option) == "" {
+      continue
+    }
+    key, value, found := strings.Cut(option, "=")
+    key = strings.ToLower(strings.TrimSpace(key))
+    if !found {
+      return rule, fmt.Errorf("option %q is not key=value", strings.TrimSpace(option))
+    }
+    switch key {
+      case "action":
+        action, err := ParseRuleAction(value)
+        if err != nil {
+          return rule, err
+        }
+        rule.Action = action
+      case "maxage":
+        age, err := ParseAge(value)
+        if err != nil {
+          return rule, err
+        }
+        rule.MaxAge = age
+      default:
+        return rule, fmt.Errorf("unknown option %q (available: action, maxAge)", key)
+    }
+  }
+  return rule, nil
+}
+
+// LoadedBlacklist is a loaded Blacklist.txt: its phrases in order, with a variant without spaces
+// after each phrase that has them, and the options of each
+type LoadedBlacklist struct {
+  Phrases   []string
+  Actions   map[string]RuleAction
+  MaxAges   map[string]time.Duration
+  Originals map[string]string // phrase as written in the file, by phrase or variant
+}
+
+// The Blacklist.txt phrase a matched rule came from; other rules are returned unchanged
+func OriginalPhrase(rule string) string {
+  if original, found := BlacklistOriginals[rule]; found {
+    return original
+  }
+  return rule
+}
+
+// Report whether a rule's age window includes every message the other rule's window does
+func (r BlacklistRule) CoversAge(other BlacklistRule) bool {
+  return r.MaxAge == 0 || (other.MaxAge != 0 && r.MaxAge >= other.MaxAge)
+}
+
+// Action for the rule that matched: the Blacklist.txt option, else the configured action
+func ActionForRule(rule string) RuleAction {
+  switch rule {
+    case "NotWhiteList":
+      return NotWhitelistedAction
+    case "Unacceptable":
+      return UnacceptableAction
+  }
+  if action, found := BlacklistActions[rule]; found {
+    return action
+  }
+  return DefaultAction
+}
+
+// Apply --tag-only, and give a "tag" action without a keyword the one for its trash code
+func ResolveAction(action RuleAction, trashCode byte) RuleAction {
+  if TagOnly && action.Kind != "none" && action.Kind != "flag" && action.Kind != "tag" {
+    action = RuleAction{Kind: "tag"}
+  }
+  if action.Kind == "tag" && action.Keyword == "" {
+    action.Keyword = fmt.Sprintf("%s%d", TagPrefix, trashCode)
+  }
+  return action
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+  "testing"
+  "time"
+)
+
+func TestParseRuleAction(t *testing.T) {
+  tests := []struct {
+    spec string
+    want RuleAction
+    ok   bool
+  }{
+    {"trash", RuleAction{Kind: "trash"}, true},
+    {" JUNK ", RuleAction{Kind: "junk"}, true},
+    {"none", RuleAction{Kind: "none"}, true},
+    {"move: Archive/Spam ", RuleAction{Kind: "move", Folder: "Archive/Spam"}, true},
+    {"move", RuleAction{}, false},
+    {"move:", RuleAction{}, false},
+    {"flag:Archive", RuleAction{}, false},
+    {"delete", RuleAction{}, false},
+  }
+  for _, test := range tests {
+    got, err := ParseRuleAction(test.spec)
+    if (err == nil) != test.ok {
+      t.Errorf("ParseRuleAction(%q): got error %v, want ok %t", test.spec, err, test.ok)
+      continue
+    }
+    if test.ok && got != test.want {
+      t.Errorf("ParseRuleAction(%q) = %+v, want %+v", test.spec, got, test.want)
+    }
+  }
+}
+
+func TestParseBlacklistLine(t *testing.T) {
+  tests := []struct {
+    line string
+    want BlacklistRule
+    ok   bool
+  }{
+    {"Black Friday", BlacklistRule{Phrase: "black friday"}, true},
+    {"  Free Money  |", BlacklistRule{Phrase: "free money"}, true},
+    {"Invoice | action=junk", BlacklistRule{Phrase: "invoice", Action: RuleAction{Kind: "junk"}}, true},
+    {"Offer | action=move:Archive/Spam", BlacklistRule{Phrase: "offer", Action: RuleAction{Kind: "move", Folder: "Archive/Spam"}}, true},
+    {"Sale | ACTION=none", BlacklistRule{Phrase: "sale", Action: RuleAction{Kind: "none"}}, true},
+    {"Sale | maxAge=7d", BlacklistRule{Phrase: "sale", MaxAge: 7 * 24 * time.Hour}, true},
+    {"Sale | action=none, MAXAGE=2w", BlacklistRule{Phrase: "sale", Action: RuleAction{Kind: "none"}, MaxAge: 14 * 24 * time.Hour}, true},
+    {"Sale | maxAge=0d", BlacklistRule{}, false},
+    {"Sale | action", BlacklistRule{}, false},
+    {"Sale | colour=red", BlacklistRule{}, false},
+    {"Sale | action=explode", BlacklistRule{}, false},
+  }
+  for _, test := range tests {
+    got, err := ParseBlacklistLine(test.line)
+    if (err == nil) != test.ok {
+      t.Errorf("ParseBlacklistLine(%q): got error %v, want ok %t", test.line, err, test.ok)
+      continue
+    }
+    if test.ok && got != test.want {
+      t.Errorf("ParseBlacklistLine(%q) = %+v, want %+v", test.line, got, test.want)
+    }
+  }
+}
+
+func TestActionForRule(t *testing.T) {
+  defer func(d, n, u RuleAction, b map[string]RuleAction) {
+    DefaultAction, NotWhitelistedAction, UnacceptableAction, BlacklistActions = d, n, u, b
+  }(DefaultAction, NotWhitelistedAction, UnacceptableAction, BlacklistActions)
+  DefaultAction        = RuleAction{Kind: "flag"}
+  NotWhitelistedAction = RuleAction{Kind: "junk"}
+  UnacceptableAction   = RuleAction{Kind: "none"}
+  BlacklistActions     = map[string]RuleAction{"invoice": {Kind: "move", Folder: "Bills"}}
+  tests := map[string]RuleAction{
+    "NotWhiteList": NotWhitelistedAction,
+    "Unacceptable": UnacceptableAction,
+    "invoice":      {Kind: "move", Folder: "Bills"},
+    "sale":         DefaultAction,
+  }
+  for rule, want := range tests {
+    if got := ActionForRule(rule); got != want {
+      t.Errorf("ActionForRule(%q) = %+v, want %+v", rule, got, want)
+    }
+  }
+}
+
+func TestRuleActionDestination(t *testing.T) {
+  defer func(trash, junk string) { TrashFolder, JunkFolder = trash, junk }(TrashFolder, JunkFolder)
+  TrashFolder, JunkFolder = "Deleted", "Spam"
+  tests := map[RuleAction]string{
+    {Kind: "trash"}:                  "Deleted",
+    {Kind: "junk"}:                   "Spam",
+    {Kind: "move", Folder: "Bills"}:  "Bills",
+    {Kind: "flag"}:                   "",
+    {Kind: "none"}:                   "",
+  }
+  for action, want := range tests {
+    if got := action.Destination(); got != want {
+      t.Errorf("%s.Destination() = %q, want %q", action, got, want)
+    }
+  }
+}
+
+func TestCoversAge(t *testing.T) {
+  day := 24 * time.Hour
+  tests := []struct {
+    rule, other time.Duration
+    covers      bool
+  }{
+    {0, 0, true},
+    {0, 7 * day, true},
+    {7 * day, 0, false},
+    {14 * day, 7 * day, true},
+    {7 * day, 14 * day, false},
+  }
+  for _, test := range tests {
+    if got := (BlacklistRule{MaxAge: test.rule}).CoversAge(BlacklistRule{MaxAge: test.other}); got != test.covers {
+      t.Errorf("maxAge %s covers %s = %t, want %t", test.rule, test.other, got, test.covers)
+    }
+  }
+}
+
+func TestDefaultActionNone(t *testing.T) {
+  account := newFakeAccount(`Trash|\Trash`)
+  account.Add("INBOX", "Shop <news@shop.com>", "Big sale today")
+  account.Add("INBOX", "Friend <friend@mail.com>", "Lunch?")
+  startFakeAccount(t, account, "friend@mail.com\n", "sale\n",
+    `, "actions": {"default": "none", "notWhitelisted": "none", "unacceptable": "none"}`)
+  if err := RunOnce(); err != nil {
+    t.Fatalf("RunOnce: %v", err)
+  }
+  if got := account.Subjects("INBOX"); len(got) != 2 {
+    t.Errorf("INBOX holds %q, want both messages kept", got)
+  }
+  if got := account.Commands("COPY"); len(got) != 0 {
+    t.Errorf("a none action copied messages: %q", got)
+  }
+  records, err := ReadRunMetrics()
+  if err != nil || len(records) != 1 {
+    t.Fatalf("ReadRunMetrics = %v, %v", records, err)
+  }
+  if record := records[0]; record.Kept != 2 || record.Tagged != 0 || record.Trashed != 0 {
+    t.Errorf("metrics: kept %d, tagged %d, trashed %d; want 2 kept", record.Kept, record.Tagged, record.Trashed)
+  }
+}
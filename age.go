@@ -0,0 +1,79 @@
+package main
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+  "time"
+
+  "github.com/emersion/go-imap"
+)
+
+var (
+  // Set by --backfill: ignore every maxAge window and evaluate mail of any age
+  Backfill = false
+  // maxAge options given on Blacklist.txt lines of the folder being filtered, by phrase
+  BlacklistMaxAges map[string]time.Duration
+)
+
+// Parse an age such as "7d", "2w" or "36h"; days and weeks are added to Go durations
+func ParseAge(s string) (time.Duration, error) {
+  s = strings.TrimSpace(s)
+  for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+    if number, found := strings.CutSuffix(s, suffix); found {
+      n, err := strconv.Atoi(number)
+      if err != nil || n <= 0 {
+        return 0, fmt.Errorf("invalid age %q (want e.g. 7d, 2w or 36h)", s)
+      }
+      return time.Duration(n) * unit, nil
+    }
+  }
+  age, err := time.ParseDuration(s)
+  if err != nil || age <= 0 {
+    return 0, fmt.Errorf("invalid age %q (want e.g. 7d, 2w or 36h)", s)
+  }
+  return age, nil
+}
+
+// Start of a window reaching maxAge back from the start of the run; zero when there is no
+// window or --backfill is set
+func AgeCutoff(maxAge time.Duration) time.Time {
+  if maxAge <= 0 || Backfill {
+    return time.Time{}
+  }
+  return RunStartTime.Add(-maxAge)
+}
+
+// Date a message's age is measured from: INTERNALDATE, or with "ageDate": "sent" the Date
+// header, falling back to INTERNALDATE when it is missing
+func MessageDate(msg *imap.Message) time.Time {
+  if Config.Fetch.AgeDate == "sent" && msg.Envelope != nil && !msg.Envelope.Date.IsZero() {
+    return msg.Envelope.Date
+  }
+  return msg.InternalDate
+}
+
+// Report whether a message falls before a window's cutoff
+func TooOld(msg *imap.Message, cutoff time.Time) bool {
+  return !cutoff.IsZero() && MessageDate(msg).Before(cutoff)
+}
+
+// Limit criteria to messages on or after the cutoff's day. SEARCH compares dates only, so the
+// exact cutoff is checked again on the fetched messages.
+func WithSince(criteria *imap.SearchCriteria, cutoff time.Time) {
+  if cutoff.IsZero() {
+    return
+  }
+  // SEARCH dates are in the server's time zone; a day earlier covers any offset
+  day := cutoff.AddDate(0, 0, -1)
+  if Config.Fetch.AgeDate == "sent" {
+    criteria.SentSince = day
+  } else {
+    criteria.Since = day
+  }
+}
+
+// Report whether the global window leaves out messages, so fewer are fetched than the folder holds
+func AgeWindowActive() bool {
+  return !AgeCutoff(Config.Fetch.maxAge).IsZero()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+  "testing"
+  "time"
+
+  "github.com/emersion/go-imap"
+)
+
+func TestParseAge(t *testing.T) {
+  tests := []struct {
+    in   string
+    want time.Duration
+    ok   bool
+  }{
+    {"7d", 7 * 24 * time.Hour, true},
+    {" 2w ", 14 * 24 * time.Hour, true},
+    {"36h", 36 * time.Hour, true},
+    {"90m", 90 * time.Minute, true},
+    {"", 0, false},
+    {"0d", 0, false},
+    {"-1d", 0, false},
+    {"0s", 0, false},
+    {"xd", 0, false},
+    {"7", 0, false},
+    {"1.5d", 0, false},
+  }
+  for _, test := range tests {
+    got, err := ParseAge(test.in)
+    if (err == nil) != test.ok || got != test.want {
+      t.Errorf("ParseAge(%q) = %s, %v; want %s, ok %t", test.in, got, err, test.want, test.ok)
+    }
+  }
+}
+
+func TestAgeWindow(t *testing.T) {
+  defer func(start time.Time, backfill bool, fetch FetchConfig) {
+    RunStartTime, Backfill, Config.Fetch = start, backfill, fetch
+  }(RunStartTime, Backfill, Config.Fetch)
+  RunStartTime = time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+  Backfill, Config.Fetch = false, FetchConfig{}
+  cutoff := AgeCutoff(7 * 24 * time.Hour)
+  if want := time.Date(2026, 3, 3, 12, 0, 0, 0, time.UTC); !cutoff.Equal(want) {
+    t.Errorf("AgeCutoff(7d) = %s, want %s", cutoff, want)
+  }
+  if !AgeCutoff(0).IsZero() {
+    t.Error("AgeCutoff(0) has a window")
+  }
+  received := time.Date(2026, 3, 3, 11, 0, 0, 0, time.UTC)
+  msg := &imap.Message{InternalDate: received, Envelope: &imap.Envelope{Date: received.Add(2 * time.Hour)}}
+  if !TooOld(msg, cutoff) || TooOld(msg, time.Time{}) {
+    t.Errorf("received %s: TooOld = %t with the window, %t without", received, TooOld(msg, cutoff), TooOld(msg, time.Time{}))
+  }
+  criteria := imap.NewSearchCriteria()
+  WithSince(criteria, cutoff)
+  if want := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC); !criteria.Since.Equal(want) || !criteria.SentSince.IsZero() {
+    t.Errorf("WithSince: SINCE %s, SENTSINCE %s; want SINCE %s", criteria.Since, criteria.SentSince, want)
+  }
+
+  // With ageDate "sent" the Date header decides, unless the message has none
+  Config.Fetch.AgeDate = "sent"
+  if TooOld(msg, cutoff) {
+    t.Error("sent after the cutoff but counted as too old")
+  }
+  if !TooOld(&imap.Message{InternalDate: received, Envelope: &imap.Envelope{}}, cutoff) {
+    t.Error("without a Date header INTERNALDATE should decide")
+  }
+  criteria = imap.NewSearchCriteria()
+  WithSince(criteria, cutoff)
+  if criteria.SentSince.IsZero() || !criteria.Since.IsZero() {
+    t.Errorf("WithSince with ageDate sent: SINCE %s, SENTSINCE %s", criteria.Since, criteria.SentSince)
+  }
+
+  Backfill = true
+  if !AgeCutoff(7 * 24 * time.Hour).IsZero() {
+    t.Error("--backfill kept the window")
+  }
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "log/slog"
+  "os"
+  "reflect"
+  "sort"
+  "strings"
+  "unicode"
+
+  "github.com/emersion/go-imap"
+)
+
+// CheckReport prints the findings of the "check" command and counts problems
+type CheckReport struct {
+  Errors   int
+  Warnings int
+}
+
+// Start a new group of findings
+func (r *CheckReport) Section(format string, args ...any) {
+  fmt.Printf("\n"+format+"\n", args...)
+}
+
+func (r *CheckReport) OK(format string, args ...any) {
+  fmt.Printf("  ok     "+format+"\n", args...)
+}
+
+func (r *CheckReport) Skip(format string, args ...any) {
+  fmt.Printf("  skip   "+format+"\n", args...)
+}
+
+func (r *CheckReport) Warn(format string, args ...any) {
+  r.Warnings++
+  fmt.Printf("  WARN   "+format+"\n", args...)
+}
+
+func (r *CheckReport) Error(format string, args ...any) {
+  r.Errors++
+  fmt.Printf("  ERROR  "+format+"\n", args...)
+}
+
+// The "check" command: validate the config and list files, then test the connection and folders
+func CheckCommand(args []string) error {
+  fs := flag.NewFlagSet("check", flag.ContinueOnError)
+  offline := fs.Bool("offline", false, "skip the connection and folder checks")
+  strict := fs.Bool("strict", false, "exit non-zero on warnings as well as errors")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  // Keep routine log lines from interleaving with the report unless debugging
+  if level, _ := ParseLogLevel(LogLevel); level > slog.LevelDebug {
+    LogQuiet = true
+    ConfigureLogger()
+  }
+  report := &CheckReport{}
+  configOK := CheckConfig(report)
+  for _, path := range FolderListFiles(false) {
+    CheckWhitelist(report, path)
+  }
+  for _, path := range FolderListFiles(true) {
+    CheckBlacklist(report, path)
+  }
+  if *offline {
+    report.Section("Connection")
+    report.Skip("--offline given")
+  } else if !configOK {
+    report.Section("Connection")
+    report.Skip("the config has errors")
+  } else {
+    CheckConnection(report)
+  }
+  fmt.Printf("\n%d error(s), %d warning(s)\n", report.Errors, report.Warnings)
+  if report.Errors > 0 || (*strict && report.Warnings > 0) {
+    return fmt.Errorf("check found %d error(s) and %d warning(s)", report.Errors, report.Warnings)
+  }
+  return nil
+}
+
+// Validate Config.json: syntax, unknown keys, required fields, connection settings and credentials
+func CheckConfig(report *CheckReport) bool {
+  path := LocateConfig()
+  report.Section("Config %s", path)
+  errorsBefore := report.Errors
+  data, err := os.ReadFile(path)
+  if err != nil {
+    if errors.Is(err, os.ErrNotExist) {
+      report.Error("not found; create it or pass --config (see README)")
+    } else {
+      report.Error("cannot read: %v", err)
+    }
+    Config = ConfigFile{}
+    ResolvePaths(path)
+    return false
+  }
+  Config = ConfigFile{}
+  if err := json.Unmarshal(data, &Config); err != nil {
+    report.Error("invalid JSON: %s", DescribeJSONError(data, err))
+    Config = ConfigFile{}
+    ResolvePaths(path)
+    return false
+  }
+  ResolvePaths(path)
+  report.OK("parsed")
+  var raw map[string]any
+  json.Unmarshal(data, &raw)
+  unknown := UnknownConfigKeys(raw, reflect.TypeOf(Config), "")
+  sort.Strings(unknown)
+  for _, key := range unknown {
+    report.Error("unknown key %q (misspelled? it is ignored)", key)
+  }
+  if Config.Server == "" {
+    report.Error("\"server\" is required, e.g. \"imap.example.com:993\"")
+  }
+  if Config.Email == "" {
+    report.Error("\"email\" is required")
+  }
+  if report.Errors > errorsBefore {
+    return false
+  }
+  if err := LoadConfig(); err != nil {
+    report.Error("%v", err)
+    return false
+  }
+  report.OK("server %s, account %s, connection mode %s", server, email, Config.Connection.Mode)
+  if Config.Auth == "oauth2" {
+    token, err := LoadOAuth2Token(Config.OAuth2.TokenCache)
+    switch {
+      case err != nil:
+        report.Error("%v", err)
+      case token.RefreshToken == "" && Config.OAuth2.RefreshToken == "":
+        report.Error("no OAuth2 refresh token in %s; run \"SpamBeGone authorize\"", Config.OAuth2.TokenCache)
+      default:
+        report.OK("OAuth2 (%s) refresh token available", Config.OAuth2.Mechanism)
+    }
+  } else {
+    report.OK("password available")
+  }
+  return report.Errors == errorsBefore
+}
+
+// Add the line and column to a JSON syntax error
+func DescribeJSONError(data []byte, err error) string {
+  var syntaxErr *json.SyntaxError
+  var typeErr *json.UnmarshalTypeError
+  offset := int64(-1)
+  if errors.As(err, &syntaxErr) {
+    offset = syntaxErr.Offset
+  } else if errors.As(err, &typeErr) {
+    offset = typeErr.Offset
+  }
+  if offset < 0 || offset > int64(len(data)) {
+    return err.Error()
+  }
+  line, column := 1, 1
+  for _, b := range data[:offset] {
+    if b == '\n' {
+      line++
+      column = 1
+    } else {
+      column++
+    }
+  }
+  return fmt.Sprintf("line %d, column %d: %v", line, column, err)
+}
+
+// List the keys in raw that do not correspond to a field of t, recursing into nested sections
+func UnknownConfigKeys(raw map[string]any, t reflect.Type, prefix string) []string {
+  var unknown []string
+  for key, value := range raw {
+    field, found := ConfigField(t, key)
+    if !found {
+      unknown = append(unknown, prefix+key)
+      continue
+    }
+    if nested, ok := value.(map[string]any); ok && field.Type.Kind() == reflect.Struct {
+      unknown = append(unknown, UnknownConfigKeys(nested, field.Type, prefix+key+".")...)
+    }
+  }
+  return unknown
+}
+
+// Find the exported field of t that encoding/json would decode key into
+func ConfigField(t reflect.Type, key string) (reflect.StructField, bool) {
+  for i := 0; i < t.NumField(); i++ {
+    field := t.Field(i)
+    if !field.IsExported() {
+      continue
+    }
+    name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+    if name == "" {
+      name = field.Name
+    }
+    if strings.EqualFold(name, key) {
+      return field, true
+    }
+  }
+  return reflect.StructField{}, false
+}
+
+// Check Whitelist.txt for duplicates, blank lines, entries that can never match and entries made redundant by wildcards
+func CheckWhitelist(report *CheckReport, path string) {
+  lines, err := ReadListFile(path, "whitelist")
+  report.Section("Whitelist %s", path)
+  if err != nil {
+    report.Error("%v", err)
+    return
+  }
+  entries, first := UniqueListEntries(lines)
+  var wildcards []int
+  for _, n := range entries {
+    if strings.HasPrefix(lines[n], "*") && len(lines[n]) > 1 {
+      wildcards = append(wildcards, n)
+    }
+  }
+  for n, entry := range lines {
+    if ReportListLine(report, lines, n, first) {
+      continue
+    }
+    switch {
+      case strings.ContainsFunc(entry, unicode.IsSpace):
+        report.Warn("line %d: %q contains spaces and can never match", n+1, entry)
+        continue
+      case entry == "*":
+        report.Warn("line %d: \"*\" on its own never matches; use *example.com", n+1)
+        continue
+      case strings.Contains(entry, "@") && strings.Contains(entry, "*"):
+        report.Warn("line %d: %q can never match; wildcards only work for domains, e.g. *%s", n+1, entry, entry[strings.LastIndex(entry, "@")+1:])
+        continue
+      case strings.HasPrefix(entry, "@"):
+        report.Warn("line %d: %q can never match; use %s for the domain", n+1, entry, entry[1:])
+        continue
+      case strings.Count(entry, "@") > 1 || strings.HasSuffix(entry, "@"):
+        report.Warn("line %d: %q is not a valid address and can never match", n+1, entry)
+        continue
+      case strings.Contains(entry[1:], "*"):
+        report.Warn("line %d: %q can never match; \"*\" is only allowed at the start", n+1, entry)
+        continue
+    }
+    domain := entry
+    if at := strings.LastIndex(entry, "@"); at >= 0 {
+      domain = entry[at+1:]
+    }
+    for _, w := range wildcards {
+      if w == n {
+        continue
+      }
+      base := strings.TrimPrefix(lines[w], "*")
+      if strings.HasSuffix(strings.TrimPrefix(domain, "*"), base) {
+        report.Warn("line %d: %q is already covered by %q on line %d", n+1, entry, lines[w], w+1)
+        break
+      }
+    }
+  }
+  report.OK("%d entries", len(entries))
+}
+
+// Check Blacklist.txt for duplicates, blank lines, phrases that can never match and phrases that contain other phrases
+func CheckBlacklist(report *CheckReport, path string) {
+  raw, err := ReadListLines(path, "blacklist")
+  report.Section("Blacklist %s", path)
+  if err != nil {
+    report.Error("%v", err)
+    return
+  }
+  lines := make([]string, len(raw))
+  rules := make([]BlacklistRule, len(raw))
+  for n, line := range raw {
+    if rules[n], err = ParseBlacklistLine(line); err != nil {
+      report.Error("line %d: %v", n+1, err)
+    }
+    lines[n] = rules[n].Phrase
+  }
+  entries, first := UniqueListEntries(lines)
+  for n, phrase := range lines {
+    if ReportListLine(report, lines, n, first) || rules[n].Action.Kind == "none" {
+      continue
+    }
+    // With the unacceptable rule switched off, these messages reach the phrases
+    if UnacceptableAction.Kind != "none" && ContainsUnacceptable(phrase) {
+      report.Warn("line %d: %q can never match; names and subjects with these characters are already caught by the unacceptable rule", n+1, phrase)
+      continue
+    }
+    if plain := strings.ToLower(ConvertStyledToASCII(phrase)); plain != phrase {
+      report.Warn("line %d: %q can never match because text is compared after styled letters are converted; use %q", n+1, phrase, plain)
+      continue
+    }
+    // Phrases are tried in file order and the first match decides the action
+    for _, m := range entries {
+      if m == n || rules[m].Action.Kind == "none" || !strings.Contains(phrase, lines[m]) || !rules[m].CoversAge(rules[n]) {
+        continue
+      }
+      if m < n {
+        report.Warn("line %d: %q is never used; %q on line %d matches first", n+1, phrase, lines[m], m+1)
+        break
+      }
+      if rules[m].Action == rules[n].Action {
+        report.Warn("line %d: %q is redundant; %q on line %d matches everything it does", n+1, phrase, lines[m], m+1)
+        break
+      }
+    }
+  }
+  report.OK("%d phrases", len(entries))
+}
+
+// Indexes of the first occurrence of each non-blank line, and where each line first occurs
+func UniqueListEntries(lines []string) ([]int, map[string]int) {
+  var entries []int
+  first := map[string]int{}
+  for n, line := range lines {
+    if _, found := first[line]; !found && line != "" {
+      first[line] = n
+      entries = append(entries, n)
+    }
+  }
+  return entries, first
+}
+
+// Warn about a blank or duplicate line; reports whether the line should be skipped
+func ReportListLine(report *CheckReport, lines []string, n int, first map[string]int) bool {
+  if lines[n] == "" {
+    report.Warn("line %d: blank line", n+1)
+    return true
+  }
+  if first[lines[n]] != n {
+    report.Warn("line %d: duplicate of line %d %q", n+1, first[lines[n]]+1, lines[n])
+    return true
+  }
+  return false
+}
+
+// Log in and confirm that the folders SpamBeGone reads and writes exist
+func CheckConnection(report *CheckReport) {
+  report.Section("Connection %s", server)
+  defer CloseConnection()
+  if err := ConnectLogin(); err != nil {
+    report.Error("%v", err)
+    return
+  }
+  report.OK("connected and logged in as %s", email)
+  if err := ListMailboxes(); err != nil {
+    report.Error("%v", err)
+    return
+  }
+  names := map[string]bool{}
+  for _, m := range Mailboxes {
+    names[m.Name] = true
+  }
+  DetectSpecialFolders()
+  for _, special := range []struct{ role, override, attr string; names []string }{
+    {"trash", Config.TrashFolder, imap.TrashAttr, TrashFolderNames},
+    {"junk", Config.JunkFolder, imap.JunkAttr, JunkFolderNames},
+  } {
+    switch folder, source := FindSpecialFolder(special.override, special.attr, special.names); source {
+      case "config":
+        report.OK("%s folder %q (set in Config.json)", special.role, folder)
+      case "special-use":
+        report.OK("%s folder %q (found by its %s attribute)", special.role, folder, special.attr)
+      case "name":
+        report.OK("%s folder %q (found by name; the server does not mark it %s)", special.role, folder, special.attr)
+      default:
+        report.OK("%s folder: none found", special.role)
+    }
+  }
+  for _, folder := range Config.Folders {
+    CheckFolderExists(report, names, folder.Name, "source")
+  }
+  FolderRuleSets = nil
+  if err := LoadFolderRules(); err != nil {
+    // Already reported with the list files
+    return
+  }
+  folders, err := DestinationFolders()
+  if err != nil {
+    report.Error("%v", err)
+  }
+  for _, folder := range folders {
+    CheckFolderExists(report, names, folder, "destination")
+  }
+}
+
+// Report whether a folder is in the server's folder list
+func CheckFolderExists(report *CheckReport, names map[string]bool, folder, role string) {
+  if names[folder] || strings.EqualFold(folder, "INBOX") {
+    report.OK("%s folder %q exists", role, folder)
+  } else {
+    report.Error("%s folder %q does not exist on the server", role, folder)
+  }
+}
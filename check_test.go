@@ -0,0 +1,94 @@
+package main
+
+import (
+  "encoding/json"
+  "os"
+  "path/filepath"
+  "reflect"
+  "slices"
+  "strings"
+  "testing"
+)
+
+func TestUniqueListEntries(t *testing.T) {
+  lines := []string{"spam", "", "eggs", "spam", ""}
+  entries, first := UniqueListEntries(lines)
+  if !slices.Equal(entries, []int{0, 2}) {
+    t.Errorf("entries = %v, want [0 2]", entries)
+  }
+  if first["spam"] != 0 || first["eggs"] != 2 {
+    t.Errorf("first = %v", first)
+  }
+  if _, found := first[""]; found {
+    t.Errorf("blank line recorded in first")
+  }
+}
+
+func TestDescribeJSONError(t *testing.T) {
+  data := []byte("{\n  \"server\": \"imap.example.com:993\",\n  \"email\" \"me@example.com\"\n}")
+  var config ConfigFile
+  err := json.Unmarshal(data, &config)
+  if err == nil {
+    t.Fatal("Unmarshal accepted invalid JSON")
+  }
+  if got := DescribeJSONError(data, err); !strings.HasPrefix(got, "line 3, column ") {
+    t.Errorf("DescribeJSONError = %q, want line 3", got)
+  }
+  data = []byte("{\"server\": 993}")
+  err = json.Unmarshal(data, &config)
+  if got := DescribeJSONError(data, err); !strings.HasPrefix(got, "line 1, column ") {
+    t.Errorf("DescribeJSONError = %q, want line 1", got)
+  }
+}
+
+func TestUnknownConfigKeys(t *testing.T) {
+  var raw map[string]any
+  data := `{"Server": "x", "emial": "y", "connection": {"mode": "tls", "timeot": 5}, "paths": {"StateDir": "s"}}`
+  if err := json.Unmarshal([]byte(data), &raw); err != nil {
+    t.Fatal(err)
+  }
+  got := UnknownConfigKeys(raw, reflect.TypeOf(ConfigFile{}), "")
+  slices.Sort(got)
+  if want := []string{"connection.timeot", "emial"}; !slices.Equal(got, want) {
+    t.Errorf("UnknownConfigKeys = %v, want %v", got, want)
+  }
+}
+
+func TestCheckLists(t *testing.T) {
+  keepPaths(t)
+  dir := t.TempDir()
+  WhitelistFile = filepath.Join(dir, "Whitelist.txt")
+  BlacklistFile = filepath.Join(dir, "Blacklist.txt")
+  whitelist := "friend@mail.com\n*shop.com\nnews@shop.com\n@bank.com\n*\na b@c.com\n"
+  blacklist := "black friday\n\nblack friday\nblack friday deals\n𝐁𝐥𝐚𝐜𝐤\n🔥 deals\n"
+  if err := os.WriteFile(WhitelistFile, []byte(whitelist), 0600); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.WriteFile(BlacklistFile, []byte(blacklist), 0600); err != nil {
+    t.Fatal(err)
+  }
+  report := &CheckReport{}
+  CheckWhitelist(report, WhitelistFile)
+  if report.Errors != 0 || report.Warnings != 4 {
+    t.Errorf("whitelist: %d errors, %d warnings, want 0 and 4", report.Errors, report.Warnings)
+  }
+  report = &CheckReport{}
+  CheckBlacklist(report, BlacklistFile)
+  if report.Errors != 0 || report.Warnings != 5 {
+    t.Errorf("blacklist: %d errors, %d warnings, want 0 and 5", report.Errors, report.Warnings)
+  }
+  // With the unacceptable rule off, the phrase with an emoji can match
+  defer func(action RuleAction) { UnacceptableAction = action }(UnacceptableAction)
+  UnacceptableAction = RuleAction{Kind: "none"}
+  report = &CheckReport{}
+  CheckBlacklist(report, BlacklistFile)
+  if report.Errors != 0 || report.Warnings != 4 {
+    t.Errorf("blacklist with unacceptable none: %d errors, %d warnings, want 0 and 4", report.Errors, report.Warnings)
+  }
+  os.Remove(BlacklistFile)
+  report = &CheckReport{}
+  CheckBlacklist(report, BlacklistFile)
+  if report.Errors != 1 {
+    t.Errorf("missing blacklist: %d errors, want 1", report.Errors)
+  }
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "log/slog"
+  "strings"
+
+  "github.com/emersion/go-imap"
+)
+
+// Version of the text normalization phrases are matched after: styled letters, look-alike
+// characters and lower-casing. Bump it when ConvertStyledToASCII or its tables change, so
+// messages checked under the old normalization are evaluated again.
+const NormalizationVersion = 1
+
+var (
+  // Keyword prefix marking messages already evaluated, followed by the rules version, e.g. SpamBeGone-Checked-1a2b3c4d
+  CheckedPrefix = "SpamBeGone-Checked-"
+  // Keyword for the folder being filtered; empty unless fetch.skipChecked is on
+  CheckedKeyword string
+  // UIDs of the folder's messages that were evaluated and kept, marked with CheckedKeyword after the moves
+  KeptUIDs []uint32
+)
+
+// Short hash of everything that decides what happens to a message in a folder: its lists, their
+// age windows, the configured actions and the normalization version. Editing any of them changes
+// the version, so messages checked under the old rules are evaluated again.
+func RulesVersion(rules FolderRules) string {
+  h := sha256.New()
+  fmt.Fprintf(h, "normalization %d\n", NormalizationVersion)
+  for _, line := range rules.Whitelist {
+    fmt.Fprintf(h, "w %s\n", line)
+  }
+  for _, phrase := range rules.Blacklist {
+    fmt.Fprintf(h, "b %s\n", phrase)
+    if action, found := rules.Actions[phrase]; found {
+      fmt.Fprintf(h, "a %s\n", action)
+    }
+    if age, found := rules.MaxAges[phrase]; found {
+      fmt.Fprintf(h, "age %s\n", age)
+    }
+  }
+  fmt.Fprintf(h, "default %s\nnotWhitelisted %s\nunacceptable %s\ntagOnly %t\ntagPrefix %s\nageDate %s\n",
+    DefaultAction, NotWhitelistedAction, UnacceptableAction, TagOnly, TagPrefix, Config.Fetch.AgeDate)
+  return hex.EncodeToString(h.Sum(nil))[:8]
+}
+
+// Keyword kept messages of a folder get under its current rules, or "" when skipChecked is off
+func CheckedKeywordFor(rules FolderRules) string {
+  if !Config.Fetch.SkipChecked {
+    return ""
+  }
+  return CheckedPrefix + RulesVersion(rules)
+}
+
+// Report whether a folder lets clients create keywords (PERMANENTFLAGS contains \*)
+func AllowsNewKeywords(mbox *imap.MailboxStatus) bool {
+  for _, flag := range mbox.PermanentFlags {
+    if flag == `\*` {
+      return true
+    }
+  }
+  return false
+}
+
+// Give the messages of the current folder that were evaluated this run and stay where they
+// are the current checked keyword, and take the keywords of older rule versions off them.
+// Matched messages are only marked when their actions were applied (applied is true).
+func MarkChecked(applied bool) error {
+  if CheckedKeyword == "" || !DoMoveToTrash {
+    return nil
+  }
+  set := new(imap.SeqSet)
+  set.AddNum(KeptUIDs...)
+  count := len(KeptUIDs)
+  if applied {
+    for _, email := range MatchingEmails {
+      if email.Action.Destination() == "" {
+        set.AddNum(email.UID)
+        count++
+      }
+    }
+  }
+  if set.Empty() {
+    return nil
+  }
+  var mbox *imap.MailboxStatus
+  err := WithReconnect("select", func() (err error) {
+    mbox, err = c.Select(SelectFolder, false)
+    return err
+  })
+  if err != nil {
+    CountIMAPError("select")
+    return fmt.Errorf("failed to reselect mailbox %s: %w", SelectFolder, err)
+  }
+  if mailbox != nil && mbox.UidValidity != mailbox.UidValidity {
+    slog.Warn("UIDVALIDITY changed; not marking checked messages", "folder", SelectFolder)
+    return nil
+  }
+  if !AllowsNewKeywords(mbox) && !HasFlag(mbox.Flags, CheckedKeyword) {
+    slog.Warn("Folder does not accept new keywords; every message will be evaluated on each run", "folder", SelectFolder)
+    return nil
+  }
+  item := imap.FormatFlagsOp(imap.AddFlags, true)
+  if err := WithReconnect("store", func() error { return c.UidStore(set, item, []interface{}{CheckedKeyword}, nil) }); err != nil {
+    CountIMAPError("store")
+    return fmt.Errorf("failed to mark checked messages: %w", err)
+  }
+  // FLAGS from SELECT lists the keywords in use, including those of older rule versions
+  var stale []interface{}
+  for _, flag := range mbox.Flags {
+    if strings.HasPrefix(strings.ToLower(flag), strings.ToLower(CheckedPrefix)) && !strings.EqualFold(flag, CheckedKeyword) {
+      stale = append(stale, flag)
+    }
+  }
+  if len(stale) > 0 {
+    item = imap.FormatFlagsOp(imap.RemoveFlags, true)
+    if err := WithReconnect("store", func() error { return c.UidStore(set, item, stale, nil) }); err != nil {
+      CountIMAPError("store")
+      slog.Warn("failed to clear old checked keywords", "keywords", stale, "err", err)
+    }
+  }
+  slog.Info("Marked checked messages", "folder", SelectFolder, "keyword", CheckedKeyword, "messages", count)
+  return nil
+}
+
+// Report whether a flag list contains a flag, ignoring case
+func HasFlag(flags []string, flag string) bool {
+  for _, f := range flags {
+    if strings.EqualFold(f, flag) {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+  "regexp"
+  "testing"
+
+  "github.com/emersion/go-imap"
+)
+
+func TestRulesVersion(t *testing.T) {
+  defer func(d RuleAction, only bool) { DefaultAction, TagOnly = d, only }(DefaultAction, TagOnly)
+  DefaultAction, TagOnly = RuleAction{Kind: "trash"}, false
+  base := FolderRules{Whitelist: []string{"friend@mail.com"}, Blacklist: []string{"sale", "offer"}}
+  version := RulesVersion(base)
+  if !regexp.MustCompile(`^[0-9a-f]{8}$`).MatchString(version) {
+    t.Fatalf("RulesVersion = %q, want 8 hex digits", version)
+  }
+  if again := RulesVersion(FolderRules{Whitelist: []string{"friend@mail.com"}, Blacklist: []string{"sale", "offer"}}); again != version {
+    t.Errorf("the same rules gave %s and %s", version, again)
+  }
+  changes := map[string]FolderRules{
+    "whitelist entry":  {Whitelist: []string{"friend@mail.com", "boss@work.com"}, Blacklist: base.Blacklist},
+    "blacklist phrase": {Whitelist: base.Whitelist, Blacklist: []string{"sale"}},
+    "phrase action":    {Whitelist: base.Whitelist, Blacklist: base.Blacklist, Actions: map[string]RuleAction{"sale": {Kind: "junk"}}},
+    // A phrase moved from one list to the other is a different rule set
+    "list swapped":     {Whitelist: []string{"sale"}, Blacklist: []string{"friend@mail.com", "offer"}},
+  }
+  for name, rules := range changes {
+    if RulesVersion(rules) == version {
+      t.Errorf("changing the %s kept version %s", name, version)
+    }
+  }
+  DefaultAction = RuleAction{Kind: "junk"}
+  if RulesVersion(base) == version {
+    t.Error("changing the default action kept the version")
+  }
+  DefaultAction, TagOnly = RuleAction{Kind: "trash"}, true
+  if RulesVersion(base) == version {
+    t.Error("turning on tag-only kept the version")
+  }
+}
+
+func TestCheckedKeywordFor(t *testing.T) {
+  defer func(fetch FetchConfig) { Config.Fetch = fetch }(Config.Fetch)
+  rules := FolderRules{Blacklist: []string{"sale"}}
+  Config.Fetch.SkipChecked = false
+  if got := CheckedKeywordFor(rules); got != "" {
+    t.Errorf("CheckedKeywordFor with skipChecked off = %q", got)
+  }
+  Config.Fetch.SkipChecked = true
+  if got, want := CheckedKeywordFor(rules), CheckedPrefix+RulesVersion(rules); got != want {
+    t.Errorf("CheckedKeywordFor = %q, want %q", got, want)
+  }
+  if err := ValidateKeyword(CheckedKeywordFor(rules)); err != nil {
+    t.Errorf("checked keyword is not a valid keyword: %v", err)
+  }
+}
+
+func TestAllowsNewKeywords(t *testing.T) {
+  if !AllowsNewKeywords(&imap.MailboxStatus{PermanentFlags: []string{imap.SeenFlag, `\*`}}) {
+    t.Error(`PERMANENTFLAGS with \* refused new keywords`)
+  }
+  if AllowsNewKeywords(&imap.MailboxStatus{PermanentFlags: []string{imap.SeenFlag, imap.DeletedFlag}}) {
+    t.Error(`PERMANENTFLAGS without \* allowed new keywords`)
+  }
+}
+
+func TestHasFlag(t *testing.T) {
+  flags := []string{imap.SeenFlag, "SpamBeGone-Checked-1a2b3c4d"}
+  if !HasFlag(flags, `\seen`) || !HasFlag(flags, "spambegone-checked-1a2b3c4d") || HasFlag(flags, imap.FlaggedFlag) {
+    t.Errorf("HasFlag(%v) gave the wrong answers", flags)
+  }
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+  "crypto/tls"
+  "crypto/x509"
+  "errors"
+  "fmt"
+  "log/slog"
+  "net"
+  "os"
+  "strings"
+  "time"
+
+  "github.com/emersion/go-imap/client"
+)
+
+// ConnectionConfig is the "connection" section of Config.json
+type ConnectionConfig struct {
+  Mode           string `json:"mode"`           // "tls" (default, implicit TLS), "starttls" or "plain" (localhost only)
+  CAFile         string `json:"caFile"`         // PEM bundle used instead of the system roots
+  ClientCert     string `json:"clientCert"`     // PEM client certificate
+  ClientKey      string `json:"clientKey"`      // PEM client key
+  MinTLSVersion  string `json:"minTLSVersion"`  // "1.0" to "1.3", default "1.2"
+  ServerName     string `json:"serverName"`     // overrides the name checked against the certificate
+  ConnectTimeout string `json:"connectTimeout"` // e.g. "30s"; covers dialing and the greeting
+  ReadTimeout    string `json:"readTimeout"`    // e.g. "5m"; the longest any one IMAP command may take
+  // Reconnecting after a dropped connection, see Reconnect
+  ReconnectAttempts int    `json:"reconnectAttempts"` // default 5; -1 turns reconnecting off
+  ReconnectBackoff  string `json:"reconnectBackoff"`  // wait before the second attempt, doubled after each; default "2s"
+  // Connections used to fetch and evaluate several folders at once, default 1
+  MaxConnections int `json:"maxConnections"`
+  // Parsed from the strings above by Validate
+  connectTimeout   time.Duration
+  readTimeout      time.Duration
+  reconnectBackoff time.Duration
+  minTLSVersion    uint16
+}
+
+// TLS versions accepted by minTLSVersion
+var TLSVersions = map[string]uint16{
+  "1.0": tls.VersionTLS10,
+  "1.1": tls.VersionTLS11,
+  "1.2": tls.VersionTLS12,
+  "1.3": tls.VersionTLS13,
+}
+
+// Check the connection section against the server address and fill in defaults
+func (cc *ConnectionConfig) Validate(server string) error {
+  cc.Mode = strings.ToLower(cc.Mode)
+  if cc.Mode == "" {
+    cc.Mode = "tls"
+  }
+  host, _, err := net.SplitHostPort(server)
+  if err != nil {
+    return fmt.Errorf("server %q must be host:port: %w", server, err)
+  }
+  switch cc.Mode {
+    case "tls", "starttls":
+    case "plain":
+      if !IsLoopbackHost(host) {
+        return fmt.Errorf("connection mode \"plain\" is only allowed for localhost, not %s", host)
+      }
+    default:
+      return fmt.Errorf("unknown connection mode %q (want tls, starttls or plain)", cc.Mode)
+  }
+  if cc.MinTLSVersion == "" {
+    cc.MinTLSVersion = "1.2"
+  }
+  version, found := TLSVersions[cc.MinTLSVersion]
+  if !found {
+    return fmt.Errorf("unknown minTLSVersion %q (want 1.0, 1.1, 1.2 or 1.3)", cc.MinTLSVersion)
+  }
+  cc.minTLSVersion = version
+  if (cc.ClientCert == "") != (cc.ClientKey == "") {
+    return errors.New("clientCert and clientKey must be set together")
+  }
+  cc.connectTimeout = 30 * time.Second
+  if cc.ConnectTimeout != "" {
+    if cc.connectTimeout, err = time.ParseDuration(cc.ConnectTimeout); err != nil {
+      return fmt.Errorf("invalid connectTimeout %q: %w", cc.ConnectTimeout, err)
+    }
+  }
+  cc.readTimeout = 0
+  if cc.ReadTimeout != "" {
+    if cc.readTimeout, err = time.ParseDuration(cc.ReadTimeout); err != nil {
+      return fmt.Errorf("invalid readTimeout %q: %w", cc.ReadTimeout, err)
+    }
+  }
+  switch {
+    case cc.ReconnectAttempts == 0:
+      cc.ReconnectAttempts = 5
+    case cc.ReconnectAttempts < 0:
+      cc.ReconnectAttempts = -1
+  }
+  if cc.MaxConnections == 0 {
+    cc.MaxConnections = 1
+  }
+  if cc.MaxConnections < 0 {
+    return fmt.Errorf("maxConnections must be positive, not %d", cc.MaxConnections)
+  }
+  cc.reconnectBackoff = 2 * time.Second
+  if cc.ReconnectBackoff != "" {
+    if cc.reconnectBackoff, err = time.ParseDuration(cc.ReconnectBackoff); err != nil {
+      return fmt.Errorf("invalid reconnectBackoff %q: %w", cc.ReconnectBackoff, err)
+    }
+  }
+  return nil
+}
+
+// Report whether host is localhost or a loopback address
+func IsLoopbackHost(host string) bool {
+  if strings.EqualFold(host, "localhost") {
+    return true
+  }
+  ip := net.ParseIP(host)
+  return ip != nil && ip.IsLoopback()
+}
+
+// Build the TLS settings from the connection section
+func (cc *ConnectionConfig) TLSConfig() (*tls.Config, error) {
+  config := &tls.Config{
+    MinVersion: cc.minTLSVersion,
+    ServerName: cc.ServerName,
+  }
+  if cc.CAFile != "" {
+    pem, err := os.ReadFile(cc.CAFile)
+    if err != nil {
+      return nil, fmt.Errorf("failed to read caFile: %w", err)
+    }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(pem) {
+      return nil, fmt.Errorf("caFile %s contains no PEM certificates", cc.CAFile)
+    }
+    config.RootCAs = pool
+  }
+  if cc.ClientCert != "" {
+    cert, err := tls.LoadX509KeyPair(cc.ClientCert, cc.ClientKey)
+    if err != nil {
+      return nil, fmt.Errorf("failed to load client certificate: %w", err)
+    }
+    config.Certificates = []tls.Certificate{cert}
+  }
+  return config, nil
+}
+
+// Open an IMAP connection to server using the configured mode, TLS settings and timeouts
+func DialIMAP(server string, cc *ConnectionConfig) (*client.Client, error) {
+  tlsConfig, err := cc.TLSConfig()
+  if err != nil {
+    return nil, err
+  }
+  dialer := &net.Dialer{Timeout: cc.connectTimeout}
+  var conn *client.Client
+  switch cc.Mode {
+    case "starttls":
+      conn, err = client.DialWithDialer(dialer, server)
+      if err != nil {
+        return nil, err
+      }
+      ok, err := conn.SupportStartTLS()
+      if err != nil || !ok {
+        conn.Terminate()
+        return nil, fmt.Errorf("server %s does not offer STARTTLS", server)
+      }
+      if tlsConfig.ServerName == "" {
+        tlsConfig.ServerName, _, _ = net.SplitHostPort(server)
+      }
+      if err := conn.StartTLS(tlsConfig); err != nil {
+        conn.Terminate()
+        return nil, fmt.Errorf("STARTTLS failed: %w", err)
+      }
+    case "plain":
+      slog.Warn("Connecting without TLS", "server", server)
+      conn, err = client.DialWithDialer(dialer, server)
+    default:
+      conn, err = client.DialWithDialerTLS(dialer, server, tlsConfig)
+  }
+  if err != nil {
+    return nil, err
+  }
+  conn.Timeout = cc.readTimeout
+  return conn, nil
+}
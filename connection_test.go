@@ -0,0 +1,90 @@
+package main
+
+import (
+  "errors"
+  "net"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/emersion/go-imap"
+  "github.com/emersion/go-imap/backend"
+  imapserver "github.com/emersion/go-imap/server"
+)
+
+func TestConnectionConfigValidate(t *testing.T) {
+  tests := []struct {
+    server string
+    cc     ConnectionConfig
+    ok     bool
+  }{
+    {"imap.example.com:993", ConnectionConfig{}, true},
+    {"imap.example.com:143", ConnectionConfig{Mode: "STARTTLS", MinTLSVersion: "1.3"}, true},
+    {"localhost:143", ConnectionConfig{Mode: "plain"}, true},
+    {"127.0.0.1:143", ConnectionConfig{Mode: "plain"}, true},
+    {"[::1]:143", ConnectionConfig{Mode: "plain"}, true},
+    {"imap.example.com:143", ConnectionConfig{Mode: "plain"}, false},
+    {"imap.example.com", ConnectionConfig{}, false},
+    {"imap.example.com:993", ConnectionConfig{Mode: "ssl"}, false},
+    {"imap.example.com:993", ConnectionConfig{MinTLSVersion: "1.4"}, false},
+    {"imap.example.com:993", ConnectionConfig{ClientCert: "cert.pem"}, false},
+    {"imap.example.com:993", ConnectionConfig{ConnectTimeout: "soon"}, false},
+    {"imap.example.com:993", ConnectionConfig{ReconnectBackoff: "later"}, false},
+  }
+  for _, test := range tests {
+    cc := test.cc
+    if err := cc.Validate(test.server); (err == nil) != test.ok {
+      t.Errorf("Validate(%s, %+v) = %v, want ok %t", test.server, test.cc, err, test.ok)
+    }
+  }
+  cc := ConnectionConfig{ReadTimeout: "5m"}
+  cc.Validate("imap.example.com:993")
+  if cc.Mode != "tls" || cc.connectTimeout != 30*time.Second || cc.readTimeout != 5*time.Minute || cc.MinTLSVersion != "1.2" ||
+    cc.ReconnectAttempts != 5 || cc.reconnectBackoff != 2*time.Second {
+    t.Errorf("defaults: %+v", cc)
+  }
+  cc = ConnectionConfig{ReconnectAttempts: -3}
+  cc.Validate("imap.example.com:993")
+  if cc.ReconnectAttempts != -1 {
+    t.Errorf("negative reconnectAttempts became %d, want -1", cc.ReconnectAttempts)
+  }
+}
+
+// noUsers is an IMAP backend that refuses every login
+type noUsers struct{}
+
+func (noUsers) Login(*imap.ConnInfo, string, string) (backend.User, error) {
+  return nil, errors.New("no such user")
+}
+
+func TestDialIMAP(t *testing.T) {
+  imapServer := imapserver.New(noUsers{})
+  imapServer.AllowInsecureAuth = true
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  go imapServer.Serve(listener)
+  defer imapServer.Close()
+  address := listener.Addr().String()
+
+  cc := ConnectionConfig{Mode: "plain"}
+  if err := cc.Validate(address); err != nil {
+    t.Fatal(err)
+  }
+  conn, err := DialIMAP(address, &cc)
+  if err != nil {
+    t.Fatalf("plain: %v", err)
+  }
+  if ok, err := conn.Support("IMAP4rev1"); err != nil || !ok {
+    t.Errorf("plain capabilities: %t, %v", ok, err)
+  }
+  conn.Logout()
+
+  // A server without STARTTLS is refused rather than used in the clear
+  cc = ConnectionConfig{Mode: "starttls"}
+  cc.Validate(address)
+  if _, err := DialIMAP(address, &cc); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+    t.Errorf("starttls: got %v, want a missing STARTTLS error", err)
+  }
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/binary"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "hash"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+const (
+  // Environment variable checked for the password when passwordEnv is not set
+  DefaultPasswordEnv = "SPAMBEGONE_PASSWORD"
+  // Environment variable holding the passphrase for credentialsFile
+  PassphraseEnv = "SPAMBEGONE_PASSPHRASE"
+  // PBKDF2 work factor for new credentials files
+  CredentialsIterations = 600000
+)
+
+// EncryptedCredentials is the on-disk layout of credentialsFile
+type EncryptedCredentials struct {
+  Version    int    `json:"version"`
+  KDF        string `json:"kdf"`
+  Iterations int    `json:"iterations"`
+  Salt       []byte `json:"salt"`
+  Nonce      []byte `json:"nonce"`
+  Ciphertext []byte `json:"ciphertext"`
+}
+
+// Credentials is the plaintext sealed inside credentialsFile
+type Credentials struct {
+  Password string `json:"password"`
+}
+
+// Find the IMAP password. Sources are tried in this order: the environment variable,
+// passwordCommand, passwordFile, credentialsFile and finally the plaintext password field.
+// A configured source that fails is an error rather than a fall through to the next one.
+func ResolvePassword() (string, error) {
+  envName := Config.PasswordEnv
+  if envName == "" {
+    envName = DefaultPasswordEnv
+  }
+  if value := os.Getenv(envName); value != "" {
+    slog.Debug("Using password from environment", "var", envName)
+    return value, nil
+  }
+  if Config.PasswordCommand != "" {
+    value, err := RunSecretCommand(Config.PasswordCommand)
+    if err != nil {
+      return "", fmt.Errorf("passwordCommand failed: %w", err)
+    }
+    slog.Debug("Using password from passwordCommand")
+    return value, nil
+  }
+  if Config.PasswordFile != "" {
+    value, err := ReadPasswordFile(Config.PasswordFile)
+    if err != nil {
+      return "", err
+    }
+    slog.Debug("Using password from passwordFile", "file", Config.PasswordFile)
+    return value, nil
+  }
+  if Config.CredentialsFile != "" {
+    creds, err := DecryptCredentialsFile(Config.CredentialsFile)
+    if err != nil {
+      return "", err
+    }
+    slog.Debug("Using password from credentialsFile", "file", Config.CredentialsFile)
+    return creds.Password, nil
+  }
+  if Config.Password != "" {
+    slog.Warn("Config.json holds the password in plaintext; consider passwordCommand, passwordFile or credentialsFile")
+    return Config.Password, nil
+  }
+  return "", fmt.Errorf("no IMAP password available: set %s, or one of passwordCommand, passwordFile, credentialsFile or password in Config.json", envName)
+}
+
+// Run a command and return its stdout, without the trailing newline, as a secret
+func RunSecretCommand(command string) (string, error) {
+  cmd := ShellCommand(command)
+  var stderr bytes.Buffer
+  cmd.Stderr = &stderr
+  out, err := cmd.Output()
+  if err != nil {
+    if msg := strings.TrimSpace(stderr.String()); msg != "" {
+      return "", fmt.Errorf("%w: %s", err, msg)
+    }
+    return "", err
+  }
+  value := strings.TrimRight(string(out), "\r\n")
+  if value == "" {
+    return "", errors.New("command printed nothing")
+  }
+  return value, nil
+}
+
+// Read a password file after checking that only its owner can read it
+func ReadPasswordFile(path string) (string, error) {
+  if err := CheckPrivateFile(path); err != nil {
+    return "", fmt.Errorf("passwordFile %s: %w", path, err)
+  }
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return "", fmt.Errorf("failed to read passwordFile: %w", err)
+  }
+  value := strings.TrimRight(string(data), "\r\n")
+  if value == "" {
+    return "", fmt.Errorf("passwordFile %s is empty", path)
+  }
+  return value, nil
+}
+
+// Get the passphrase for credentialsFile from the environment or passphraseCommand
+func CredentialsPassphrase() (string, error) {
+  if value := os.Getenv(PassphraseEnv); value != "" {
+    return value, nil
+  }
+  if Config.PassphraseCommand != "" {
+    value, err := RunSecretCommand(Config.PassphraseCommand)
+    if err != nil {
+      return "", fmt.Errorf("passphraseCommand failed: %w", err)
+    }
+    return value, nil
+  }
+  return "", fmt.Errorf("credentialsFile needs a passphrase: set %s or passphraseCommand in Config.json", PassphraseEnv)
+}
+
+// Decrypt credentialsFile with the configured passphrase
+func DecryptCredentialsFile(path string) (Credentials, error) {
+  var creds Credentials
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return creds, fmt.Errorf("failed to read credentialsFile: %w", err)
+  }
+  var sealed EncryptedCredentials
+  if err := json.Unmarshal(data, &sealed); err != nil {
+    return creds, fmt.Errorf("failed to parse credentialsFile %s: %w", path, err)
+  }
+  if sealed.Version != 1 || sealed.KDF != "pbkdf2-sha256" {
+    return creds, fmt.Errorf("credentialsFile %s has unsupported version %d / kdf %q", path, sealed.Version, sealed.KDF)
+  }
+  passphrase, err := CredentialsPassphrase()
+  if err != nil {
+    return creds, err
+  }
+  gcm, err := CredentialsCipher(passphrase, sealed.Salt, sealed.Iterations)
+  if err != nil {
+    return creds, err
+  }
+  plaintext, err := gcm.Open(nil, sealed.Nonce, sealed.Ciphertext, nil)
+  if err != nil {
+    return creds, fmt.Errorf("failed to decrypt credentialsFile %s: wrong passphrase or corrupted file", path)
+  }
+  if err := json.Unmarshal(plaintext, &creds); err != nil {
+    return creds, fmt.Errorf("credentialsFile %s has unreadable contents: %w", path, err)
+  }
+  if creds.Password == "" {
+    return creds, fmt.Errorf("credentialsFile %s holds no password", path)
+  }
+  return creds, nil
+}
+
+// Seal creds into a new credentialsFile at path
+func EncryptCredentialsFile(path string, creds Credentials, passphrase string) error {
+  sealed := EncryptedCredentials{Version: 1, KDF: "pbkdf2-sha256", Iterations: CredentialsIterations}
+  sealed.Salt = make([]byte, 16)
+  if _, err := rand.Read(sealed.Salt); err != nil {
+    return err
+  }
+  gcm, err := CredentialsCipher(passphrase, sealed.Salt, sealed.Iterations)
+  if err != nil {
+    return err
+  }
+  sealed.Nonce = make([]byte, gcm.NonceSize())
+  if _, err := rand.Read(sealed.Nonce); err != nil {
+    return err
+  }
+  plaintext, err := json.Marshal(creds)
+  if err != nil {
+    return err
+  }
+  sealed.Ciphertext = gcm.Seal(nil, sealed.Nonce, plaintext, nil)
+  data, err := json.MarshalIndent(sealed, "", "  ")
+  if err != nil {
+    return err
+  }
+  if err := os.WriteFile(path, data, 0600); err != nil {
+    return fmt.Errorf("failed to write credentialsFile %s: %w", path, err)
+  }
+  return nil
+}
+
+// Derive an AES-256-GCM cipher from the passphrase
+func CredentialsCipher(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+  if iterations <= 0 {
+    return nil, errors.New("credentialsFile has an invalid iteration count")
+  }
+  key := PBKDF2(sha256.New, []byte(passphrase), salt, iterations, 32)
+  block, err := aes.NewCipher(key)
+  if err != nil {
+    return nil, err
+  }
+  return cipher.NewGCM(block)
+}
+
+// PBKDF2 key derivation (RFC 8018)
+func PBKDF2(h func() hash.Hash, password, salt []byte, iterations, keyLen int) []byte {
+  prf := hmac.New(h, password)
+  hashLen := prf.Size()
+  blocks := (keyLen + hashLen - 1) / hashLen
+  key := make([]byte, 0, blocks*hashLen)
+  u := make([]byte, hashLen)
+  var counter [4]byte
+  for block := 1; block <= blocks; block++ {
+    prf.Reset()
+    prf.Write(salt)
+    binary.BigEndian.PutUint32(counter[:], uint32(block))
+    prf.Write(counter[:])
+    key = prf.Sum(key)
+    t := key[len(key)-hashLen:]
+    copy(u, t)
+    for n := 2; n <= iterations; n++ {
+      prf.Reset()
+      prf.Write(u)
+      u = prf.Sum(u[:0])
+      for i := range u {
+        t[i] ^= u[i]
+      }
+    }
+  }
+  return key[:keyLen]
+}
+
+// The "credentials" command and its subcommands
+func CredentialsCommand(args []string) error {
+  if len(args) == 0 || args[0] != "encrypt" {
+    return errors.New("usage: SpamBeGone credentials encrypt [--out file]")
+  }
+  fs := flag.NewFlagSet("credentials encrypt", flag.ContinueOnError)
+  out := fs.String("out", "", "credentials file to write (default: credentialsFile from Config.json, else Credentials.enc)")
+  if err := fs.Parse(args[1:]); err != nil {
+    return err
+  }
+  // Config.json is optional here; it only supplies defaults
+  if err := LoadPaths(); err != nil {
+    return err
+  }
+  path := *out
+  if path == "" {
+    path = Config.CredentialsFile
+  }
+  if path == "" {
+    path = filepath.Join(ConfigDir, "Credentials.enc")
+  }
+  secret := os.Getenv(DefaultPasswordEnv)
+  if secret == "" {
+    fmt.Fprintln(os.Stderr, "Enter the IMAP password (input is visible; pipe it in to avoid that):")
+    line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+    if err != nil && line == "" {
+      return fmt.Errorf("failed to read password: %w", err)
+    }
+    secret = strings.TrimRight(line, "\r\n")
+  }
+  if secret == "" {
+    return errors.New("empty password")
+  }
+  passphrase, err := CredentialsPassphrase()
+  if err != nil {
+    return err
+  }
+  if err := EncryptCredentialsFile(path, Credentials{Password: secret}, passphrase); err != nil {
+    return err
+  }
+  fmt.Printf("Encrypted credentials written to %s; set \"credentialsFile\": %q in Config.json and remove \"password\".\n", path, path)
+  return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "os"
+  "path/filepath"
+  "runtime"
+  "strings"
+  "testing"
+)
+
+// PBKDF2-HMAC-SHA256 vectors from RFC 7914 section 11
+func TestPBKDF2(t *testing.T) {
+  tests := []struct {
+    password, salt string
+    iterations     int
+    keyLen         int
+    want           string
+  }{
+    {"passwd", "salt", 1, 64, "55 ac 04 6e 56 e3 08 9f ec 16 91 c2 25 44 b6 05 f9 41 85 21 6d de 04 65 e6 8b 9d 57 c2 0d ac bc " +
+      "49 ca 9c cc f1 79 b6 45 99 16 64 b3 9d 77 ef 31 7c 71 b8 45 b1 e3 0b d5 09 11 20 41 d3 a1 97 83"},
+    {"Password", "NaCl", 80000, 64, "4d dc d8 f6 0b 98 be 21 83 0c ee 5e f2 27 01 f9 64 1a 44 18 d0 4c 04 14 ae ff 08 87 6b 34 ab 56 " +
+      "a1 d4 25 a1 22 58 33 54 9a db 84 1b 51 c9 b3 17 6a 27 2b de bb a1 d0 78 47 8f 62 b3 97 f3 3c 8d"},
+    // A key shorter than one block is a prefix of the longer one
+    {"passwd", "salt", 1, 20, "55 ac 04 6e 56 e3 08 9f ec 16 91 c2 25 44 b6 05 f9 41 85 21"},
+  }
+  for _, test := range tests {
+    got := hex.EncodeToString(PBKDF2(sha256.New, []byte(test.password), []byte(test.salt), test.iterations, test.keyLen))
+    if want := strings.ReplaceAll(test.want, " ", ""); got != want {
+      t.Errorf("PBKDF2(%q, %q, %d, %d) = %s, want %s", test.password, test.salt, test.iterations, test.keyLen, got, want)
+    }
+  }
+}
+
+func TestCredentialsFile(t *testing.T) {
+  defer func(cfg ConfigFile) { Config = cfg }(Config)
+  Config = ConfigFile{}
+  path := filepath.Join(t.TempDir(), "Credentials.enc")
+  if err := EncryptCredentialsFile(path, Credentials{Password: "s3cret"}, "correct horse"); err != nil {
+    t.Fatal(err)
+  }
+  t.Setenv(PassphraseEnv, "correct horse")
+  if creds, err := DecryptCredentialsFile(path); err != nil || creds.Password != "s3cret" {
+    t.Errorf("DecryptCredentialsFile = %+v, %v", creds, err)
+  }
+  t.Setenv(PassphraseEnv, "wrong")
+  if _, err := DecryptCredentialsFile(path); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+    t.Errorf("wrong passphrase: got %v", err)
+  }
+}
+
+func TestResolvePassword(t *testing.T) {
+  defer func(cfg ConfigFile) { Config = cfg }(Config)
+  dir := t.TempDir()
+  file := filepath.Join(dir, "password")
+  os.WriteFile(file, []byte("from-file\n"), 0600)
+  t.Setenv(DefaultPasswordEnv, "")
+  Config = ConfigFile{PasswordFile: file, Password: "plain"}
+  // A configured source wins over the plaintext password
+  if got, err := ResolvePassword(); err != nil || got != "from-file" {
+    t.Errorf("passwordFile: %q, %v", got, err)
+  }
+  t.Setenv(DefaultPasswordEnv, "from-env")
+  if got, err := ResolvePassword(); err != nil || got != "from-env" {
+    t.Errorf("environment: %q, %v", got, err)
+  }
+  t.Setenv(DefaultPasswordEnv, "")
+  // A failing source is an error, not a fall through to the plaintext password
+  Config = ConfigFile{PasswordFile: filepath.Join(dir, "missing"), Password: "plain"}
+  if got, err := ResolvePassword(); err == nil {
+    t.Errorf("missing passwordFile: got %q, want an error", got)
+  }
+  if runtime.GOOS != "windows" {
+    os.Chmod(file, 0644)
+    Config = ConfigFile{PasswordFile: file}
+    if _, err := ResolvePassword(); err == nil || !strings.Contains(err.Error(), "too open") {
+      t.Errorf("group-readable passwordFile: got %v, want a permissions error", err)
+    }
+  }
+  Config = ConfigFile{}
+  if _, err := ResolvePassword(); err == nil {
+    t.Error("no source: want an error")
+  }
+}
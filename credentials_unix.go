@@ -0,0 +1,29 @@
+//go:build !windows
+
+package main
+
+import (
+  "fmt"
+  "os"
+  "os/exec"
+)
+
+// Require that a secret file is a regular file not accessible by group or others
+func CheckPrivateFile(path string) error {
+  info, err := os.Stat(path)
+  if err != nil {
+    return err
+  }
+  if !info.Mode().IsRegular() {
+    return fmt.Errorf("not a regular file")
+  }
+  if perm := info.Mode().Perm(); perm&0077 != 0 {
+    return fmt.Errorf("permissions %04o are too open; run chmod 600 %s", perm, path)
+  }
+  return nil
+}
+
+// Build a command that runs a command line through the shell
+func ShellCommand(command string) *exec.Cmd {
+  return exec.Command("sh", "-c", command)
+}
@@ -0,0 +1,112 @@
+//go:build windows
+
+package main
+
+import (
+  "fmt"
+  "os"
+  "os/exec"
+  "strings"
+  "syscall"
+  "unsafe"
+)
+
+var (
+  advapi32                  = syscall.NewLazyDLL("advapi32.dll")
+  procGetNamedSecurityInfoW = advapi32.NewProc("GetNamedSecurityInfoW")
+  procGetAce                = advapi32.NewProc("GetAce")
+
+  // Well-known groups that take in other accounts on the machine, by SID
+  BroadGroups = map[string]string{"S-1-1-0": "Everyone", "S-1-5-11": "Authenticated Users", "S-1-5-32-545": "Users"}
+)
+
+const (
+  seFileObject            = 1
+  daclSecurityInformation = 0x4
+  accessAllowedAceType    = 0
+  inheritOnlyAce          = 0x8
+  // FILE_READ_DATA, GENERIC_ALL or GENERIC_READ
+  readAccess = 0x1 | 0x10000000 | 0x80000000
+)
+
+// acl is the ACL header; its ACEs follow it
+type acl struct {
+  revision byte
+  sbz1     byte
+  size     uint16
+  aceCount uint16
+  sbz2     uint16
+}
+
+// accessAllowedAce is an ACCESS_ALLOWED_ACE up to the start of its SID
+type accessAllowedAce struct {
+  aceType  byte
+  aceFlags byte
+  aceSize  uint16
+  mask     uint32
+  sidStart uint32
+}
+
+// Require that a secret file is a regular file whose DACL does not let Everyone, Authenticated
+// Users or Users read it
+func CheckPrivateFile(path string) error {
+  info, err := os.Stat(path)
+  if err != nil {
+    return err
+  }
+  if !info.Mode().IsRegular() {
+    return fmt.Errorf("not a regular file")
+  }
+  groups, err := ReadableByGroups(path)
+  if err != nil {
+    return fmt.Errorf("failed to read the file's ACL: %w", err)
+  }
+  if len(groups) > 0 {
+    return fmt.Errorf("readable by %s; run icacls \"%s\" /inheritance:r /grant:r \"%%USERNAME%%\":F",
+      strings.Join(groups, ", "), path)
+  }
+  return nil
+}
+
+// Names of the BroadGroups the file's DACL allows to read it. A file without a DACL grants
+// everyone full access.
+func ReadableByGroups(path string) ([]string, error) {
+  name, err := syscall.UTF16PtrFromString(path)
+  if err != nil {
+    return nil, err
+  }
+  var dacl *acl
+  var descriptor uintptr
+  r, _, _ := procGetNamedSecurityInfoW.Call(uintptr(unsafe.Pointer(name)), seFileObject, daclSecurityInformation,
+    0, 0, uintptr(unsafe.Pointer(&dacl)), 0, uintptr(unsafe.Pointer(&descriptor)))
+  if r != 0 {
+    return nil, syscall.Errno(r)
+  }
+  defer syscall.LocalFree(syscall.Handle(descriptor))
+  if dacl == nil {
+    return []string{"Everyone"}, nil
+  }
+  var groups []string
+  for i := 0; i < int(dacl.aceCount); i++ {
+    var ace *accessAllowedAce
+    if r, _, err := procGetAce.Call(uintptr(unsafe.Pointer(dacl)), uintptr(i), uintptr(unsafe.Pointer(&ace))); r == 0 {
+      return nil, err
+    }
+    if ace.aceType != accessAllowedAceType || ace.aceFlags&inheritOnlyAce != 0 || ace.mask&readAccess == 0 {
+      continue
+    }
+    sid, err := (*syscall.SID)(unsafe.Pointer(&ace.sidStart)).String()
+    if err != nil {
+      return nil, err
+    }
+    if group, found := BroadGroups[sid]; found {
+      groups = append(groups, group)
+    }
+  }
+  return groups, nil
+}
+
+// Build a command that runs a command line through cmd.exe
+func ShellCommand(command string) *exec.Cmd {
+  return exec.Command("cmd", "/C", command)
+}
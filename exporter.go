@@ -0,0 +1,254 @@
+package main
+
+import (
+  "fmt"
+  "io"
+  "log/slog"
+  "math"
+  "net"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+var (
+  // Address for the Prometheus/OpenMetrics listener in scheduler mode, e.g. ":9090"
+  MetricsListen = ""
+  // Registry of everything exposed on /metrics
+  Exporter = NewMetricsRegistry()
+  // Latency buckets in seconds for IMAP fetch and move commands
+  LatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+)
+
+// MetricsRegistry holds counters, gauges and histograms for the /metrics endpoint
+type MetricsRegistry struct {
+  mu       sync.Mutex
+  families []*MetricFamily
+  byName   map[string]*MetricFamily
+}
+
+// MetricFamily is one named metric and all of its labelled series
+type MetricFamily struct {
+  Name    string
+  Help    string
+  Type    string // "counter", "gauge" or "histogram"
+  Buckets []float64
+  series  map[string]*MetricSeries
+}
+
+// MetricSeries is the value of one metric for one set of labels
+type MetricSeries struct {
+  Labels string
+  Value  float64
+  Counts []uint64
+  Sum    float64
+  Count  uint64
+}
+
+// Create the registry with every SpamBeGone metric registered
+func NewMetricsRegistry() *MetricsRegistry {
+  r := &MetricsRegistry{byName: map[string]*MetricFamily{}}
+  r.Register("spambegone_runs_total", "counter", "Filter runs by result.", nil)
+  r.Register("spambegone_last_run_timestamp_seconds", "gauge", "Unix time the last run finished.", nil)
+  r.Register("spambegone_last_run_success", "gauge", "1 if the last run succeeded, 0 if it failed.", nil)
+  r.Register("spambegone_messages_scanned_total", "counter", "Messages evaluated against the rules.", nil)
+  r.Register("spambegone_messages_kept_total", "counter", "Messages left untouched.", nil)
+  r.Register("spambegone_messages_tagged_total", "counter", "Matched messages flagged or tagged and left in place.", nil)
+  r.Register("spambegone_messages_trashed_total", "counter", "Messages moved out of the folder, by trash code and rule.", nil)
+  r.Register("spambegone_imap_errors_total", "counter", "Failed IMAP operations, by operation.", nil)
+  r.Register("spambegone_reconnects_total", "counter", "IMAP reconnect attempts.", nil)
+  r.Register("spambegone_fetch_duration_seconds", "histogram", "Latency of IMAP FETCH commands.", LatencyBuckets)
+  r.Register("spambegone_move_duration_seconds", "histogram", "Latency of copying one chunk of messages to the destination folder.", LatencyBuckets)
+  return r
+}
+
+// Add a metric family; registering an existing name is a no-op
+func (r *MetricsRegistry) Register(name, kind, help string, buckets []float64) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  if r.byName[name] != nil {
+    return
+  }
+  family := &MetricFamily{Name: name, Help: help, Type: kind, Buckets: buckets, series: map[string]*MetricSeries{}}
+  r.families = append(r.families, family)
+  r.byName[name] = family
+}
+
+// Look up (or create) the series for name with the given label name/value pairs
+func (r *MetricsRegistry) series(name string, labels []string) *MetricSeries {
+  family := r.byName[name]
+  if family == nil {
+    panic("unregistered metric " + name)
+  }
+  key := FormatLabels(labels)
+  s := family.series[key]
+  if s == nil {
+    s = &MetricSeries{Labels: key, Counts: make([]uint64, len(family.Buckets))}
+    family.series[key] = s
+  }
+  return s
+}
+
+// Add v to a counter
+func (r *MetricsRegistry) Add(name string, v float64, labels ...string) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  r.series(name, labels).Value += v
+}
+
+// Set a gauge
+func (r *MetricsRegistry) Set(name string, v float64, labels ...string) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  r.series(name, labels).Value = v
+}
+
+// Record one observation in a histogram
+func (r *MetricsRegistry) Observe(name string, v float64, labels ...string) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  s := r.series(name, labels)
+  for i, bound := range r.byName[name].Buckets {
+    if v <= bound {
+      s.Counts[i]++
+    }
+  }
+  s.Sum += v
+  s.Count++
+}
+
+// Write every metric in the Prometheus text format, or OpenMetrics when openMetrics is set
+func (r *MetricsRegistry) Write(w io.Writer, openMetrics bool) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  for _, family := range r.families {
+    name := family.Name
+    if openMetrics && family.Type == "counter" {
+      // OpenMetrics names the counter family without its _total suffix
+      name = strings.TrimSuffix(name, "_total")
+    }
+    fmt.Fprintf(w, "# HELP %s %s\n", name, family.Help)
+    fmt.Fprintf(w, "# TYPE %s %s\n", name, family.Type)
+    keys := make([]string, 0, len(family.series))
+    for key := range family.series {
+      keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+      s := family.series[key]
+      if family.Type != "histogram" {
+        fmt.Fprintf(w, "%s%s %s\n", family.Name, WrapLabels(s.Labels), FormatFloat(s.Value))
+        continue
+      }
+      for i, bound := range family.Buckets {
+        fmt.Fprintf(w, "%s_bucket%s %d\n", family.Name, WrapLabels(JoinLabels(s.Labels, `le="`+FormatFloat(bound)+`"`)), s.Counts[i])
+      }
+      fmt.Fprintf(w, "%s_bucket%s %d\n", family.Name, WrapLabels(JoinLabels(s.Labels, `le="+Inf"`)), s.Count)
+      fmt.Fprintf(w, "%s_sum%s %s\n", family.Name, WrapLabels(s.Labels), FormatFloat(s.Sum))
+      fmt.Fprintf(w, "%s_count%s %d\n", family.Name, WrapLabels(s.Labels), s.Count)
+    }
+  }
+  if openMetrics {
+    fmt.Fprintln(w, "# EOF")
+  }
+}
+
+// Format name/value pairs as name="value",... with Prometheus escaping
+func FormatLabels(labels []string) string {
+  var parts []string
+  for i := 0; i+1 < len(labels); i += 2 {
+    value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+    parts = append(parts, labels[i]+`="`+value+`"`)
+  }
+  return strings.Join(parts, ",")
+}
+
+// Append one more formatted label to a label string
+func JoinLabels(a, b string) string {
+  if a == "" {
+    return b
+  }
+  return a + "," + b
+}
+
+// Put braces around a non-empty label string
+func WrapLabels(labels string) string {
+  if labels == "" {
+    return ""
+  }
+  return "{" + labels + "}"
+}
+
+// Format a sample value the way Prometheus expects
+func FormatFloat(v float64) string {
+  if math.IsInf(v, 1) {
+    return "+Inf"
+  }
+  return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Start the /metrics listener in the background
+func StartMetricsListener() error {
+  mux := http.NewServeMux()
+  mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+    openMetrics := strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text")
+    if openMetrics {
+      w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+    } else {
+      w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    }
+    Exporter.Write(w, openMetrics)
+  })
+  server := &http.Server{Addr: MetricsListen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+  listener, err := net.Listen("tcp", MetricsListen)
+  if err != nil {
+    return fmt.Errorf("failed to start metrics listener on %s: %w", MetricsListen, err)
+  }
+  slog.Info("Metrics listener started", "address", listener.Addr().String(), "path", "/metrics")
+  go func() {
+    if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+      slog.Error("metrics listener stopped", "err", err)
+    }
+  }()
+  return nil
+}
+
+// Count a failed IMAP operation such as "login", "select" or "copy"
+func CountIMAPError(op string) {
+  Exporter.Add("spambegone_imap_errors_total", 1, "account", email, "op", op)
+}
+
+// Time an IMAP FETCH command on a folder
+func ObserveFetch(folder string, start time.Time) {
+  Exporter.Observe("spambegone_fetch_duration_seconds", time.Since(start).Seconds(), "account", email, "folder", folder)
+}
+
+// Time copying one chunk to the destination folder
+func ObserveMove(start time.Time) {
+  Exporter.Observe("spambegone_move_duration_seconds", time.Since(start).Seconds(), "account", email, "folder", SelectFolder)
+}
+
+// Add a finished run's message counts to the exported counters; moved holds what each rule trashed
+func ExportRunMetrics(record RunMetrics, moved []RuleCount) {
+  Exporter.Add("spambegone_messages_scanned_total", float64(record.Scanned), "account", record.Account, "folder", record.Folder)
+  Exporter.Add("spambegone_messages_kept_total", float64(record.Kept), "account", record.Account, "folder", record.Folder)
+  Exporter.Add("spambegone_messages_tagged_total", float64(record.Tagged), "account", record.Account, "folder", record.Folder)
+  for _, rule := range moved {
+    Exporter.Add("spambegone_messages_trashed_total", float64(rule.Count),
+      "account", record.Account, "folder", record.Folder, "trash_code", strconv.Itoa(int(rule.TrashCode)), "rule", rule.Phrase)
+  }
+}
+
+// Record the outcome of a run
+func ExportRunResult(err error) {
+  result, success := "ok", 1.0
+  if err != nil {
+    result, success = "error", 0.0
+  }
+  Exporter.Add("spambegone_runs_total", 1, "account", email, "result", result)
+  Exporter.Set("spambegone_last_run_timestamp_seconds", float64(time.Now().Unix()), "account", email)
+  Exporter.Set("spambegone_last_run_success", success, "account", email)
+}
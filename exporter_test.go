@@ -0,0 +1,119 @@
+package main
+
+import (
+  "errors"
+  "strings"
+  "testing"
+
+  "github.com/emersion/go-imap"
+)
+
+func TestFormatLabels(t *testing.T) {
+  tests := []struct {
+    labels []string
+    want   string
+  }{
+    {nil, ""},
+    {[]string{"account", "me@example.com"}, `account="me@example.com"`},
+    {[]string{"rule", `say "hi"\now`, "code", "4"}, `rule="say \"hi\"\\now",code="4"`},
+    {[]string{"subject", "two\nlines"}, `subject="two\nlines"`},
+    // A trailing name without a value is dropped
+    {[]string{"op", "copy", "stray"}, `op="copy"`},
+  }
+  for _, test := range tests {
+    if got := FormatLabels(test.labels); got != test.want {
+      t.Errorf("FormatLabels(%q) = %s, want %s", test.labels, got, test.want)
+    }
+  }
+}
+
+func TestMetricsRegistryWrite(t *testing.T) {
+  r := &MetricsRegistry{byName: map[string]*MetricFamily{}}
+  r.Register("test_runs_total", "counter", "Runs.", nil)
+  r.Register("test_last_run_success", "gauge", "Last result.", nil)
+  r.Register("test_duration_seconds", "histogram", "Latency.", []float64{0.5, 1})
+  r.Add("test_runs_total", 1, "result", "ok")
+  r.Add("test_runs_total", 2, "result", "ok")
+  r.Add("test_runs_total", 1, "result", "error")
+  r.Set("test_last_run_success", 0)
+  r.Set("test_last_run_success", 1)
+  r.Observe("test_duration_seconds", 0.25, "folder", "INBOX")
+  r.Observe("test_duration_seconds", 0.75, "folder", "INBOX")
+  r.Observe("test_duration_seconds", 4, "folder", "INBOX")
+  want := `# HELP test_runs_total Runs.
+# TYPE test_runs_total counter
+test_runs_total{result="error"} 1
+test_runs_total{result="ok"} 3
+# HELP test_last_run_success Last result.
+# TYPE test_last_run_success gauge
+test_last_run_success 1
+# HELP test_duration_seconds Latency.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{folder="INBOX",le="0.5"} 1
+test_duration_seconds_bucket{folder="INBOX",le="1"} 2
+test_duration_seconds_bucket{folder="INBOX",le="+Inf"} 3
+test_duration_seconds_sum{folder="INBOX"} 5
+test_duration_seconds_count{folder="INBOX"} 3
+`
+  var prometheus strings.Builder
+  r.Write(&prometheus, false)
+  if prometheus.String() != want {
+    t.Errorf("Prometheus output:\n%s\nwant:\n%s", prometheus.String(), want)
+  }
+  // OpenMetrics names counter families without _total and ends with # EOF
+  var openMetrics strings.Builder
+  r.Write(&openMetrics, true)
+  want = strings.Replace(want, "# HELP test_runs_total", "# HELP test_runs", 1)
+  want = strings.Replace(want, "# TYPE test_runs_total", "# TYPE test_runs", 1) + "# EOF\n"
+  if openMetrics.String() != want {
+    t.Errorf("OpenMetrics output:\n%s\nwant:\n%s", openMetrics.String(), want)
+  }
+}
+
+func TestNewMetricsRegistry(t *testing.T) {
+  defer func() {
+    if err := recover(); err == nil {
+      t.Error("adding to an unregistered metric did not panic")
+    }
+  }()
+  r := NewMetricsRegistry()
+  r.Add("spambegone_runs_total", 1, "result", "ok")
+  r.Add("spambegone_no_such_metric", 1)
+}
+
+func TestExportTrashedOnlyMoved(t *testing.T) {
+  registry := Exporter
+  Exporter = NewMetricsRegistry()
+  defer func() { Exporter = registry }()
+  account := newFakeAccount(`Trash|\Trash`, "Archive")
+  account.Add("INBOX", "Shop <news@shop.com>", "Big promo")
+  account.Add("INBOX", "Shop <news@shop.com>", "Landmark deals")
+  account.Add("INBOX", "Shop <news@shop.com>", "Newsletter")
+  account.Add("INBOX", "Shop <news@shop.com>", "Webinar today")
+  startFakeAccount(t, account, "friend@mail.com\n",
+    "promo\nlandmark | action=move:Archive\nnewsletter | action=tag\nwebinar | action=flag\n", `, "actions": {"notWhitelisted": "none"}`)
+  // The copy to Archive fails
+  copyChunk := CopyChunk
+  defer func() { CopyChunk = copyChunk }()
+  CopyChunk = func(uids *imap.SeqSet, folder string) error {
+    if folder == "Archive" {
+      return errors.New("NO [OVERQUOTA] Archive is full")
+    }
+    return copyChunk(uids, folder)
+  }
+  if err := RunOnce(); err == nil {
+    t.Fatal("RunOnce succeeded, want the move to Archive to fail")
+  }
+  var out strings.Builder
+  Exporter.Write(&out, false)
+  var trashed []string
+  for _, line := range strings.Split(out.String(), "\n") {
+    if strings.HasPrefix(line, "spambegone_messages_trashed_total{") {
+      trashed = append(trashed, line)
+    }
+  }
+  want := `spambegone_messages_trashed_total{account="me@example.com",folder="INBOX",trash_code="4",rule="promo"} 1`
+  if len(trashed) != 1 || trashed[0] != want {
+    t.Errorf("trashed series:\n%s\nwant only:\n%s", strings.Join(trashed, "\n"), want)
+  }
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "net"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+
+  "github.com/emersion/go-imap"
+  "github.com/emersion/go-imap/backend"
+  imapserver "github.com/emersion/go-imap/server"
+)
+
+// fakeMessage is a message held by fakeAccount
+type fakeMessage struct {
+  UID      uint32
+  Envelope *imap.Envelope
+  Date     time.Time
+  Flags    []string
+}
+
+// fakeMailbox is one folder of a fakeAccount
+type fakeMailbox struct {
+  name     string
+  attrs    []string
+  nextUID  uint32
+  messages []*fakeMessage
+  account  *fakeAccount
+}
+
+// fakeAccount is an in-memory IMAP account for tests: just enough of go-imap's backend for
+// SpamBeGone to select, search, fetch, store, copy, move and expunge. It logs every command
+// that changes a folder.
+type fakeAccount struct {
+  mu      sync.Mutex
+  folders map[string]*fakeMailbox
+  order   []string
+  Log     []string
+  conns   map[string]net.Conn // by client address, see fakeListener
+  drops   map[string]bool     // folders whose next fetch drops the connection
+}
+
+// fakeUser is the account as one connection sees it, so a fetch can drop that connection
+type fakeUser struct {
+  *fakeAccount
+  addr string
+}
+
+// fakeConnMailbox is a folder selected on one connection
+type fakeConnMailbox struct {
+  *fakeMailbox
+  user *fakeUser
+}
+
+// fakeListener records the server side of every connection, by client address
+type fakeListener struct {
+  net.Listener
+  account *fakeAccount
+}
+
+// A new account with INBOX and the given folders; "Trash|\Trash" adds a special-use attribute
+func newFakeAccount(folders ...string) *fakeAccount {
+  a := &fakeAccount{folders: map[string]*fakeMailbox{}, conns: map[string]net.Conn{}, drops: map[string]bool{}}
+  for _, folder := range append([]string{"INBOX"}, folders...) {
+    name, attr, _ := strings.Cut(folder, "|")
+    mbox := &fakeMailbox{name: name, nextUID: 1, account: a}
+    if attr != "" {
+      mbox.attrs = []string{attr}
+    }
+    a.folders[name] = mbox
+    a.order = append(a.order, name)
+  }
+  return a
+}
+
+// Deliver a message from "Name <user@host>" to a folder and return its UID
+func (a *fakeAccount) Add(folder, from, subject string, flags ...string) uint32 {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  mbox := a.folders[folder]
+  name, address, _ := strings.Cut(from, "<")
+  user, host, _ := strings.Cut(strings.TrimSuffix(address, ">"), "@")
+  date := time.Now().Add(-time.Hour)
+  mbox.messages = append(mbox.messages, &fakeMessage{
+    UID:   mbox.nextUID,
+    Date:  date,
+    Flags: flags,
+    Envelope: &imap.Envelope{
+      Date:      date,
+      Subject:   subject,
+      MessageId: fmt.Sprintf("<%d.%s@fake>", mbox.nextUID, folder),
+      From:      []*imap.Address{{PersonalName: strings.TrimSpace(name), MailboxName: user, HostName: host}},
+    },
+  })
+  mbox.nextUID++
+  return mbox.nextUID - 1
+}
+
+// Subjects of the messages in a folder, in UID order
+func (a *fakeAccount) Subjects(folder string) []string {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  var subjects []string
+  for _, m := range a.folders[folder].messages {
+    subjects = append(subjects, m.Envelope.Subject)
+  }
+  return subjects
+}
+
+// Logged commands that start with prefix, e.g. "COPY"
+func (a *fakeAccount) Commands(prefix string) []string {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  var commands []string
+  for _, line := range a.Log {
+    if strings.HasPrefix(line, prefix) {
+      commands = append(commands, line)
+    }
+  }
+  return commands
+}
+
+// Close the connection that next fetches from folder, as if the network dropped it
+func (a *fakeAccount) DropNextFetch(folder string) {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  a.drops[folder] = true
+}
+
+// Number of connections the server has accepted
+func (a *fakeAccount) Connections() int {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  return len(a.conns)
+}
+
+func (a *fakeAccount) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+  if password != "pw" {
+    return nil, backend.ErrInvalidCredentials
+  }
+  return &fakeUser{fakeAccount: a, addr: info.RemoteAddr.String()}, nil
+}
+
+func (u *fakeUser) GetMailbox(name string) (backend.Mailbox, error) {
+  mbox, err := u.fakeAccount.GetMailbox(name)
+  if err != nil {
+    return nil, err
+  }
+  return &fakeConnMailbox{fakeMailbox: mbox.(*fakeMailbox), user: u}, nil
+}
+
+func (m *fakeConnMailbox) ListMessages(uid bool, set *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+  a := m.account
+  a.mu.Lock()
+  drop, conn := a.drops[m.name], a.conns[m.user.addr]
+  delete(a.drops, m.name)
+  a.mu.Unlock()
+  if drop && conn != nil {
+    close(ch)
+    conn.Close()
+    return errors.New("connection dropped")
+  }
+  return m.fakeMailbox.ListMessages(uid, set, items, ch)
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+  conn, err := l.Listener.Accept()
+  if err == nil {
+    l.account.mu.Lock()
+    l.account.conns[conn.RemoteAddr().String()] = conn
+    l.account.mu.Unlock()
+  }
+  return conn, err
+}
+
+func (a *fakeAccount) Username() string { return "me@example.com" }
+
+func (a *fakeAccount) ListMailboxes(bool) ([]backend.Mailbox, error) {
+  var folders []backend.Mailbox
+  for _, name := range a.order {
+    folders = append(folders, a.folders[name])
+  }
+  return folders, nil
+}
+
+func (a *fakeAccount) GetMailbox(name string) (backend.Mailbox, error) {
+  if strings.EqualFold(name, "INBOX") {
+    name = "INBOX"
+  }
+  if mbox := a.folders[name]; mbox != nil {
+    return mbox, nil
+  }
+  return nil, backend.ErrNoSuchMailbox
+}
+
+func (a *fakeAccount) CreateMailbox(string) error         { return errors.New("not supported") }
+func (a *fakeAccount) DeleteMailbox(string) error         { return errors.New("not supported") }
+func (a *fakeAccount) RenameMailbox(string, string) error { return errors.New("not supported") }
+func (a *fakeAccount) Logout() error                      { return nil }
+
+func (m *fakeMailbox) Name() string             { return m.name }
+func (m *fakeMailbox) SetSubscribed(bool) error { return nil }
+func (m *fakeMailbox) Check() error             { return nil }
+
+func (m *fakeMailbox) Info() (*imap.MailboxInfo, error) {
+  return &imap.MailboxInfo{Attributes: m.attrs, Delimiter: "/", Name: m.name}, nil
+}
+
+func (m *fakeMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+  m.account.mu.Lock()
+  defer m.account.mu.Unlock()
+  status := imap.NewMailboxStatus(m.name, items)
+  status.Flags = []string{imap.SeenFlag, imap.FlaggedFlag, imap.DeletedFlag}
+  status.PermanentFlags = []string{imap.SeenFlag, imap.FlaggedFlag, imap.DeletedFlag, `\*`}
+  for _, item := range items {
+    switch item {
+      case imap.StatusMessages:
+        status.Messages = uint32(len(m.messages))
+      case imap.StatusUidNext:
+        status.UidNext = m.nextUID
+      case imap.StatusUidValidity:
+        status.UidValidity = 7
+    }
+  }
+  return status, nil
+}
+
+// Report whether the message at index i is in set, by UID or by sequence number
+func (m *fakeMailbox) contains(uid bool, set *imap.SeqSet, i int) bool {
+  id, last := uint32(i+1), uint32(len(m.messages))
+  if uid {
+    id = m.messages[i].UID
+    last = m.messages[len(m.messages)-1].UID
+  }
+  for _, seq := range set.Set {
+    start, stop := seq.Start, seq.Stop
+    if start == 0 {
+      start = last
+    }
+    if stop == 0 {
+      stop = last
+    }
+    if start > stop {
+      start, stop = stop, start
+    }
+    if id >= start && id <= stop {
+      return true
+    }
+  }
+  return false
+}
+
+func (m *fakeMailbox) ListMessages(uid bool, set *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+  defer close(ch)
+  m.account.mu.Lock()
+  var out []*imap.Message
+  for i, message := range m.messages {
+    if !m.contains(uid, set, i) {
+      continue
+    }
+    msg := imap.NewMessage(uint32(i+1), items)
+    for _, item := range items {
+      switch item {
+        case imap.FetchUid:
+          msg.Uid = message.UID
+        case imap.FetchEnvelope:
+          msg.Envelope = message.Envelope
+        case imap.FetchFlags:
+          msg.Flags = append([]string(nil), message.Flags...)
+        case imap.FetchInternalDate:
+          msg.InternalDate = message.Date
+        default:
+          if section, err := imap.ParseBodySectionName(item); err == nil {
+            from := message.Envelope.From[0]
+            header := fmt.Sprintf("From: %s <%s@%s>\r\nSubject: %s\r\n\r\n", from.PersonalName, from.MailboxName, from.HostName, message.Envelope.Subject)
+            msg.Body[section] = bytes.NewBufferString(header)
+          }
+      }
+    }
+    out = append(out, msg)
+  }
+  m.account.mu.Unlock()
+  for _, msg := range out {
+    ch <- msg
+  }
+  return nil
+}
+
+// Report whether the message at index i meets the criteria SpamBeGone sends
+func (m *fakeMailbox) matches(i int, criteria *imap.SearchCriteria) bool {
+  message := m.messages[i]
+  if criteria.Uid != nil && !m.contains(true, criteria.Uid, i) {
+    return false
+  }
+  if !criteria.Since.IsZero() && message.Date.Before(criteria.Since) {
+    return false
+  }
+  for field, values := range criteria.Header {
+    for _, value := range values {
+      text := ""
+      switch strings.ToLower(field) {
+        case "from":
+          from := message.Envelope.From[0]
+          text = fmt.Sprintf("%s <%s@%s>", from.PersonalName, from.MailboxName, from.HostName)
+        case "subject":
+          text = message.Envelope.Subject
+        case "message-id":
+          text = message.Envelope.MessageId
+      }
+      if !strings.Contains(strings.ToLower(text), strings.ToLower(value)) {
+        return false
+      }
+    }
+  }
+  for _, flag := range criteria.WithFlags {
+    if !HasFlag(message.Flags, flag) {
+      return false
+    }
+  }
+  for _, flag := range criteria.WithoutFlags {
+    if HasFlag(message.Flags, flag) {
+      return false
+    }
+  }
+  for _, not := range criteria.Not {
+    if m.matches(i, not) {
+      return false
+    }
+  }
+  for _, or := range criteria.Or {
+    if !m.matches(i, or[0]) && !m.matches(i, or[1]) {
+      return false
+    }
+  }
+  return true
+}
+
+func (m *fakeMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+  m.account.mu.Lock()
+  defer m.account.mu.Unlock()
+  var ids []uint32
+  for i, message := range m.messages {
+    if !m.matches(i, criteria) {
+      continue
+    }
+    if uid {
+      ids = append(ids, message.UID)
+    } else {
+      ids = append(ids, uint32(i+1))
+    }
+  }
+  return ids, nil
+}
+
+func (m *fakeMailbox) CreateMessage([]string, time.Time, imap.Literal) error {
+  return errors.New("APPEND not supported")
+}
+
+func (m *fakeMailbox) UpdateMessagesFlags(uid bool, set *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+  m.account.mu.Lock()
+  defer m.account.mu.Unlock()
+  m.account.Log = append(m.account.Log, fmt.Sprintf("STORE %s %s %s %v", m.name, set, op, flags))
+  for i, message := range m.messages {
+    if !m.contains(uid, set, i) {
+      continue
+    }
+    switch op {
+      case imap.SetFlags:
+        message.Flags = append([]string(nil), flags...)
+      case imap.AddFlags:
+        for _, flag := range flags {
+          if !HasFlag(message.Flags, flag) {
+            message.Flags = append(message.Flags, flag)
+          }
+        }
+      case imap.RemoveFlags:
+        var kept []string
+        for _, flag := range message.Flags {
+          if !HasFlag(flags, flag) {
+            kept = append(kept, flag)
+          }
+        }
+        message.Flags = kept
+    }
+  }
+  return nil
+}
+
+func (m *fakeMailbox) CopyMessages(uid bool, set *imap.SeqSet, destination string) error {
+  m.account.mu.Lock()
+  defer m.account.mu.Unlock()
+  m.account.Log = append(m.account.Log, fmt.Sprintf("COPY %s %s %s", m.name, set, destination))
+  target := m.account.folders[destination]
+  if target == nil {
+    return backend.ErrNoSuchMailbox
+  }
+  for i, message := range m.messages {
+    if !m.contains(uid, set, i) {
+      continue
+    }
+    copied := *message
+    copied.UID = target.nextUID
+    copied.Flags = nil
+    for _, flag := range message.Flags {
+      if flag != imap.DeletedFlag {
+        copied.Flags = append(copied.Flags, flag)
+      }
+    }
+    target.nextUID++
+    target.messages = append(target.messages, &copied)
+  }
+  return nil
+}
+
+func (m *fakeMailbox) Expunge() error {
+  m.account.mu.Lock()
+  defer m.account.mu.Unlock()
+  m.account.Log = append(m.account.Log, "EXPUNGE "+m.name)
+  var kept []*fakeMessage
+  for _, message := range m.messages {
+    if !HasFlag(message.Flags, imap.DeletedFlag) {
+      kept = append(kept, message)
+    }
+  }
+  m.messages = kept
+  return nil
+}
+
+// Start a server for the account, write a Config.json for it with the lists and the extra
+// settings given, and load that config. Globals the run changes are put back afterwards.
+func startFakeAccount(t *testing.T, account *fakeAccount, whitelist, blacklist, settings string) {
+  keepPaths(t)
+  folder, trash, defaultTrash, junk := SelectFolder, TrashFolder, DefaultTrashFolder, JunkFolder
+  defaultAction, notWhitelisted, unacceptable, tagOnly := DefaultAction, NotWhitelistedAction, UnacceptableAction, TagOnly
+  t.Cleanup(func() {
+    CloseConnection()
+    SelectFolder, TrashFolder, DefaultTrashFolder, JunkFolder = folder, trash, defaultTrash, junk
+    DefaultAction, NotWhitelistedAction, UnacceptableAction, TagOnly = defaultAction, notWhitelisted, unacceptable, tagOnly
+  })
+  imapServer := imapserver.New(account)
+  imapServer.AllowInsecureAuth = true
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  go imapServer.Serve(&fakeListener{Listener: listener, account: account})
+  t.Cleanup(func() { imapServer.Close() })
+  dir := t.TempDir()
+  os.WriteFile(filepath.Join(dir, "Whitelist.txt"), []byte(whitelist), 0600)
+  os.WriteFile(filepath.Join(dir, "Blacklist.txt"), []byte(blacklist), 0600)
+  config := fmt.Sprintf(`{"server": %q, "email": "me@example.com", "password": "pw",
+    "connection": {"mode": "plain", "reconnectAttempts": -1}, "move": {"delay": "1ms"}%s}`, listener.Addr(), settings)
+  os.WriteFile(filepath.Join(dir, "Config.json"), []byte(config), 0600)
+  ConfigPath = filepath.Join(dir, "Config.json")
+  if err := ReadConfigFile(); err != nil {
+    t.Fatal(err)
+  }
+  if err := LoadConfig(); err != nil {
+    t.Fatal(err)
+  }
+}
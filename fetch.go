@@ -0,0 +1,167 @@
+package main
+
+import (
+  "fmt"
+  "log/slog"
+  "sort"
+  "time"
+
+  "github.com/emersion/go-imap"
+)
+
+var (
+  // Messages buffered between a FETCH and the code consuming it
+  FetchBuffer = 64
+)
+
+// FetchConfig is the "fetch" section of Config.json
+type FetchConfig struct {
+  PageSize    int    `json:"pageSize"`    // UIDs per FETCH command, default 500
+  SkipChecked bool   `json:"skipChecked"` // mark kept messages and fetch only those not checked under the current rules
+  Prefilter   bool   `json:"prefilter"`   // let the server SEARCH for blacklist phrases and fetch only the candidates
+  MaxAge      string `json:"maxAge"`      // evaluate only messages younger than this, e.g. "7d"; empty means any age
+  AgeDate     string `json:"ageDate"`     // "received" (INTERNALDATE, default) or "sent" (Date header)
+  // Parsed from MaxAge by Validate
+  maxAge      time.Duration
+}
+
+// Check the fetch section and fill in defaults
+func (fc *FetchConfig) Validate() error {
+  if fc.PageSize == 0 {
+    fc.PageSize = 500
+  }
+  if fc.PageSize < 0 {
+    return fmt.Errorf("fetch.pageSize must be positive, not %d", fc.PageSize)
+  }
+  fc.maxAge = 0
+  if fc.MaxAge != "" {
+    age, err := ParseAge(fc.MaxAge)
+    if err != nil {
+      return fmt.Errorf("fetch.maxAge: %w", err)
+    }
+    fc.maxAge = age
+  }
+  switch fc.AgeDate {
+    case "":
+      fc.AgeDate = "received"
+    case "received", "sent":
+    default:
+      return fmt.Errorf("fetch.ageDate must be \"received\" or \"sent\", not %q", fc.AgeDate)
+  }
+  return nil
+}
+
+// Searches selecting the messages of a folder to fetch: all of them within fetch.maxAge, or with
+// a checked keyword only those not yet evaluated under the current rules (--backfill fetches
+// them all again). With fetch.prefilter the server is also asked for the messages one of the
+// blacklist phrases could match.
+func FetchCriteria(folder, keyword string, phrases []string, ages map[string]time.Duration) []*imap.SearchCriteria {
+  criteria := imap.NewSearchCriteria()
+  // Messages marked \Deleted are on their way out, or already moved and waiting for an expunge
+  criteria.WithoutFlags = []string{imap.DeletedFlag}
+  if keyword != "" && !Backfill {
+    criteria.WithoutFlags = append(criteria.WithoutFlags, keyword)
+  }
+  WithSince(criteria, AgeCutoff(Config.Fetch.maxAge))
+  if !Config.Fetch.Prefilter {
+    return []*imap.SearchCriteria{criteria}
+  }
+  if reason := PrefilterBlocker(phrases); reason != "" {
+    slog.Warn("Not prefiltering; fetching every message", "folder", folder, "reason", reason)
+    return []*imap.SearchCriteria{criteria}
+  }
+  return PrefilterCriteria(criteria, phrases, ages)
+}
+
+// Hand every message in the session's folder that meets any of the criteria to handle, fetching
+// pageSize UIDs at a time so memory stays flat however large the folder is
+func FetchMailbox(s *Session, criteria []*imap.SearchCriteria, items []imap.FetchItem, handle func(*imap.Message)) error {
+  uids, err := SearchUIDs(s, criteria)
+  if err != nil {
+    return err
+  }
+  slog.Debug("Messages to fetch", "folder", s.Folder, "messages", len(uids), "searches", len(criteria))
+  pageSize := Config.Fetch.PageSize
+  pages := (len(uids) + pageSize - 1) / pageSize
+  for page := 0; page < pages; page++ {
+    start := page * pageSize
+    pageUIDs := uids[start:min(start+pageSize, len(uids))]
+    slog.Debug("Fetching page", "folder", s.Folder, "page", page+1, "pages", pages, "uids", len(pageUIDs))
+    if err := FetchPage(s, pageUIDs, items, handle); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// UIDs of the messages meeting any of the criteria, in ascending order
+func SearchUIDs(s *Session, criteria []*imap.SearchCriteria) ([]uint32, error) {
+  seen := map[uint32]bool{}
+  var uids []uint32
+  for _, query := range criteria {
+    var found []uint32
+    err := s.Retry("search", func() (err error) {
+      found, err = s.Client.UidSearch(query)
+      return err
+    })
+    if err != nil {
+      CountIMAPError("search")
+      return nil, fmt.Errorf("failed to list messages: %w", err)
+    }
+    for _, uid := range found {
+      if !seen[uid] {
+        seen[uid] = true
+        uids = append(uids, uid)
+      }
+    }
+  }
+  sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+  return uids, nil
+}
+
+// UID FETCH one page, handing each message to handle as it arrives. If the connection drops,
+// reconnect and fetch only the UIDs of the page that were not handled yet.
+func FetchPage(s *Session, uids []uint32, items []imap.FetchItem, handle func(*imap.Message)) error {
+  handled := make(map[uint32]bool, len(uids))
+  remaining := uids
+  for attempt := 0; ; attempt++ {
+    set := new(imap.SeqSet)
+    set.AddNum(remaining...)
+    messages := make(chan *imap.Message, FetchBuffer)
+    done := make(chan error, 1)
+    fetchStart := time.Now()
+    go func() {
+      done <- s.Client.UidFetch(set, items, messages)
+    }()
+    for msg := range messages {
+      if handled[msg.Uid] {
+        continue
+      }
+      handled[msg.Uid] = true
+      handle(msg)
+    }
+    ObserveFetch(s.Folder, fetchStart)
+    err := <-done
+    if err == nil {
+      return nil
+    }
+    CountIMAPError("fetch")
+    if !IsConnectionLost(err) || attempt >= max(Config.Connection.ReconnectAttempts, 0) {
+      return fmt.Errorf("failed to fetch messages: %w", err)
+    }
+    var next []uint32
+    for _, uid := range remaining {
+      if !handled[uid] {
+        next = append(next, uid)
+      }
+    }
+    remaining = next
+    slog.Warn("Connection lost during fetch; reconnecting", "folder", s.Folder, "remaining", len(remaining), "err", err)
+    if err := s.Reconnect(); err != nil {
+      return fmt.Errorf("failed to fetch messages: %w", err)
+    }
+    if len(remaining) == 0 {
+      return nil
+    }
+  }
+}
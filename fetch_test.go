@@ -0,0 +1,45 @@
+package main
+
+import (
+  "fmt"
+  "testing"
+)
+
+func TestFetchConfigValidate(t *testing.T) {
+  fc := FetchConfig{}
+  if err := fc.Validate(); err != nil || fc.PageSize != 500 {
+    t.Errorf("defaults: %+v, %v", fc, err)
+  }
+  fc = FetchConfig{PageSize: 50}
+  if err := fc.Validate(); err != nil || fc.PageSize != 50 {
+    t.Errorf("pageSize 50: %+v, %v", fc, err)
+  }
+  fc = FetchConfig{PageSize: -1}
+  if err := fc.Validate(); err == nil {
+    t.Error("Validate accepted a negative pageSize")
+  }
+}
+
+func TestFetchCriteria(t *testing.T) {
+  defer func(fetch FetchConfig, n, u RuleAction) {
+    Config.Fetch, NotWhitelistedAction, UnacceptableAction = fetch, n, u
+  }(Config.Fetch, NotWhitelistedAction, UnacceptableAction)
+  NotWhitelistedAction, UnacceptableAction = RuleAction{Kind: "none"}, RuleAction{Kind: "none"}
+  Config.Fetch = FetchConfig{}
+  criteria := FetchCriteria("INBOX", "", []string{"sale"}, nil)
+  if len(criteria) != 1 || fmt.Sprint(criteria[0].WithoutFlags) != `[\Deleted]` || len(criteria[0].Or) != 0 {
+    t.Errorf("without a keyword or prefilter: %+v", criteria)
+  }
+  criteria = FetchCriteria("INBOX", "SpamBeGone-Checked-1a2b3c4d", []string{"sale"}, nil)
+  if len(criteria) != 1 || fmt.Sprint(criteria[0].WithoutFlags) != `[\Deleted SpamBeGone-Checked-1a2b3c4d]` {
+    t.Errorf("with a checked keyword: %+v", criteria)
+  }
+  Config.Fetch.Prefilter = true
+  if criteria = FetchCriteria("INBOX", "", []string{"sale"}, nil); len(criteria) == 0 || len(criteria[0].Or) != 1 {
+    t.Errorf("prefiltering one phrase: %+v", criteria)
+  }
+  NotWhitelistedAction = RuleAction{Kind: "trash"}
+  if criteria = FetchCriteria("INBOX", "", []string{"sale"}, nil); len(criteria) != 1 || len(criteria[0].Or) != 0 {
+    t.Errorf("prefilter blocked by notWhitelisted: %+v", criteria)
+  }
+}
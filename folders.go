@@ -0,0 +1,272 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "log/slog"
+  "sort"
+  "strings"
+  "time"
+
+  "github.com/emersion/go-imap"
+)
+
+// FolderConfig is one entry of the "folders" list in Config.json
+type FolderConfig struct {
+  Name        string `json:"name"`
+  Whitelist   string `json:"whitelist"`   // defaults to paths.whitelist
+  Blacklist   string `json:"blacklist"`   // defaults to paths.blacklist
+  Destination string `json:"destination"` // defaults to the trash folder
+}
+
+// FolderRules is a source folder together with the lists loaded for it
+type FolderRules struct {
+  Folder    FolderConfig
+  Whitelist []string
+  Blacklist []string
+  Actions   map[string]RuleAction
+  MaxAges   map[string]time.Duration
+  Originals map[string]string
+}
+
+var (
+  // Rules for every configured folder, loaded by LoadFolderRules before connecting
+  FolderRuleSets []FolderRules
+  // When processing of the current folder started
+  FolderStartTime time.Time
+  // Names tried when the server does not mark its trash or junk folder with a special-use attribute
+  TrashFolderNames = []string{"Trash", "Deleted Items", "Deleted Messages", "[Gmail]/Trash", "INBOX.Trash", "INBOX/Trash"}
+  JunkFolderNames  = []string{"Junk", "Spam", "Junk E-mail", "Junk Email", "Bulk Mail", "[Gmail]/Spam", "INBOX.Junk", "INBOX.Spam"}
+  // Returned by DestinationFolders when an action needs the trash or junk folder and none was found
+  ErrNoTrashFolder = errors.New("no trash folder found: the server marks no folder \\Trash and none has a usual trash name; set \"trashFolder\" in Config.json")
+  ErrNoJunkFolder  = errors.New("a rule moves mail to junk but no junk folder was found: the server marks no folder \\Junk and none has a usual junk name; set \"junkFolder\" in Config.json")
+)
+
+// Check the folders list for missing and repeated names
+func ValidateFolders() error {
+  seen := map[string]bool{}
+  for i, folder := range Config.Folders {
+    if strings.TrimSpace(folder.Name) == "" {
+      return fmt.Errorf("folders[%d] has no name", i)
+    }
+    key := strings.ToLower(folder.Name)
+    if seen[key] {
+      return fmt.Errorf("folder %q is listed more than once", folder.Name)
+    }
+    seen[key] = true
+  }
+  return nil
+}
+
+// Load the whitelist and blacklist of every folder, reading each file only once
+func LoadFolderRules() error {
+  slog.Debug("LoadFolderRules")
+  whitelists := map[string][]string{}
+  blacklists := map[string]LoadedBlacklist{}
+  for _, folder := range Config.Folders {
+    rules := FolderRules{Folder: folder}
+    if lines, found := whitelists[folder.Whitelist]; found {
+      rules.Whitelist = lines
+    } else {
+      lines, err := LoadWhitelist(folder.Whitelist)
+      if err != nil {
+        return err
+      }
+      whitelists[folder.Whitelist] = lines
+      rules.Whitelist = lines
+    }
+    list, found := blacklists[folder.Blacklist]
+    if !found {
+      var err error
+      if list, err = LoadBlacklist(folder.Blacklist); err != nil {
+        return err
+      }
+      blacklists[folder.Blacklist] = list
+    }
+    rules.Blacklist = list.Phrases
+    rules.Actions   = list.Actions
+    rules.MaxAges   = list.MaxAges
+    rules.Originals = list.Originals
+    FolderRuleSets = append(FolderRuleSets, rules)
+  }
+  return nil
+}
+
+// Destination of a folder, falling back to the account's trash folder
+func (folder FolderConfig) DestinationFolder() string {
+  if folder.Destination != "" {
+    return folder.Destination
+  }
+  return DefaultTrashFolder
+}
+
+// Filter every configured folder, in turn or on several connections at once; a failing
+// folder does not stop the others
+func RunFolders() error {
+  var errs []error
+  if workers := min(Config.Connection.MaxConnections, len(FolderRuleSets)); workers > 1 {
+    errs = RunFoldersParallel(workers)
+  } else {
+    for _, rules := range FolderRuleSets {
+      if err := RunFolder(rules); err != nil {
+        slog.Error("folder failed", "folder", rules.Folder.Name, "err", err)
+        errs = append(errs, fmt.Errorf("folder %s: %w", rules.Folder.Name, err))
+      }
+    }
+  }
+  slog.Info("Run summary", "folders", RunTotals.Folders, "failed", len(errs),
+    "scanned", RunTotals.Scanned, "kept", RunTotals.Kept, "trashed", RunTotals.Trashed, "tagged", RunTotals.Tagged)
+  return errors.Join(errs...)
+}
+
+// Run a single filter pass against one folder and record its metrics
+func RunFolder(rules FolderRules) error {
+  ResetFolderState(rules)
+  slog.Info("Filtering folder", "folder", SelectFolder, "destination", TrashFolder,
+    "whitelist", rules.Folder.Whitelist, "blacklist", rules.Folder.Blacklist)
+  if err := SelectMailbox(); err != nil {
+    if errors.Is(err, ErrNoMessages) {
+      slog.Info("No messages in the mailbox", "folder", SelectFolder)
+      return WriteRunMetrics(nil)
+    }
+    return err
+  }
+  if err := FetchAndStoreEmails(); err != nil {
+    return err
+  }
+  return FinishFolder()
+}
+
+// Report the current folder's matches, apply their actions and record its metrics
+func FinishFolder() error {
+  ListMatchingEmails()
+  // Metrics are recorded even when the move fails, along with the error
+  moveErr := MoveToTrash()
+  if err := MarkChecked(moveErr == nil); err != nil {
+    slog.Warn("failed to mark checked messages; they will be evaluated again", "folder", SelectFolder, "err", err)
+  }
+  if err := WriteRunMetrics(moveErr); err != nil {
+    return errors.Join(moveErr, err)
+  }
+  return moveErr
+}
+
+// Point the per-folder globals at the next folder and clear what the previous one left behind
+func ResetFolderState(rules FolderRules) {
+  SelectFolder       = rules.Folder.Name
+  TrashFolder        = rules.Folder.DestinationFolder()
+  Whitelist          = rules.Whitelist
+  Blacklist          = rules.Blacklist
+  BlacklistActions   = rules.Actions
+  BlacklistMaxAges   = rules.MaxAges
+  BlacklistOriginals = rules.Originals
+  mailbox            = nil
+  MatchingEmails     = nil
+  MovedUIDs          = nil
+  TrashMetrics       = nil
+  MessagesScanned    = 0
+  CheckedKeyword     = CheckedKeywordFor(rules)
+  KeptUIDs           = nil
+  FolderStartTime    = time.Now()
+  InitTrashMetrics()
+}
+
+// Distinct list files used by the configured folders, in config order
+func FolderListFiles(blacklist bool) []string {
+  var paths []string
+  seen := map[string]bool{}
+  for _, folder := range Config.Folders {
+    path := folder.Whitelist
+    if blacklist {
+      path = folder.Blacklist
+    }
+    if !seen[path] {
+      seen[path] = true
+      paths = append(paths, path)
+    }
+  }
+  return paths
+}
+
+// Distinct folders the actions of every configured folder move messages to
+func DestinationFolders() ([]string, error) {
+  var names []string
+  seen := map[string]bool{}
+  for _, rules := range FolderRuleSets {
+    actions := []RuleAction{DefaultAction, NotWhitelistedAction, UnacceptableAction}
+    for _, action := range rules.Actions {
+      actions = append(actions, action)
+    }
+    for _, action := range actions {
+      name := ""
+      switch ResolveAction(action, 0).Kind {
+        case "trash":
+          if name = rules.Folder.DestinationFolder(); name == "" {
+            return nil, ErrNoTrashFolder
+          }
+        case "junk":
+          if name = JunkFolder; name == "" {
+            return nil, ErrNoJunkFolder
+          }
+        case "move":
+          name = action.Folder
+        default:
+          continue
+      }
+      if !seen[name] {
+        seen[name] = true
+        names = append(names, name)
+      }
+    }
+  }
+  sort.Strings(names)
+  return names, nil
+}
+
+// Choose the trash and junk folders: the config override, then the RFC 6154 special-use
+// attribute from LIST, then a well-known name
+func DetectSpecialFolders() {
+  trash, source := FindSpecialFolder(Config.TrashFolder, imap.TrashAttr, TrashFolderNames)
+  DefaultTrashFolder = trash
+  if trash != "" {
+    slog.Info("Using trash folder", "folder", trash, "source", source)
+  } else {
+    slog.Warn("No trash folder found; set \"trashFolder\" in Config.json")
+  }
+  JunkFolder, source = FindSpecialFolder(Config.JunkFolder, imap.JunkAttr, JunkFolderNames)
+  if JunkFolder != "" {
+    slog.Info("Using junk folder", "folder", JunkFolder, "source", source)
+  } else {
+    slog.Debug("No junk folder found")
+  }
+}
+
+// Find a folder by override, special-use attribute or name; also returns which of the three was used
+func FindSpecialFolder(override, attr string, names []string) (string, string) {
+  if override != "" {
+    return override, "config"
+  }
+  for _, m := range Mailboxes {
+    if HasMailboxAttr(m, attr) && !HasMailboxAttr(m, imap.NoSelectAttr) {
+      return m.Name, "special-use"
+    }
+  }
+  for _, name := range names {
+    for _, m := range Mailboxes {
+      if strings.EqualFold(m.Name, name) && !HasMailboxAttr(m, imap.NoSelectAttr) {
+        return m.Name, "name"
+      }
+    }
+  }
+  return "", ""
+}
+
+// Report whether a LIST response carries an attribute such as \Trash
+func HasMailboxAttr(m *imap.MailboxInfo, attr string) bool {
+  for _, a := range m.Attributes {
+    if strings.EqualFold(a, attr) {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+  "path/filepath"
+  "slices"
+  "strings"
+  "testing"
+
+  "github.com/emersion/go-imap"
+)
+
+func TestValidateFolders(t *testing.T) {
+  keepPaths(t)
+  tests := []struct {
+    folders []FolderConfig
+    err     string
+  }{
+    {[]FolderConfig{{Name: "INBOX"}, {Name: "Newsletters"}}, ""},
+    {[]FolderConfig{{Name: "INBOX"}, {Name: " "}}, "folders[1] has no name"},
+    {[]FolderConfig{{Name: "Promotions"}, {Name: "promotions"}}, "listed more than once"},
+  }
+  for _, test := range tests {
+    Config = ConfigFile{Folders: test.folders}
+    err := ValidateFolders()
+    if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+      t.Errorf("ValidateFolders(%v) = %v, want %q", test.folders, err, test.err)
+    }
+  }
+}
+
+func TestFolderDefaults(t *testing.T) {
+  keepPaths(t)
+  dir := t.TempDir()
+  Config = ConfigFile{Folders: []FolderConfig{
+    {Name: "INBOX"},
+    {Name: "Newsletters", Blacklist: "News.txt", Destination: "Archive"},
+    {Name: "Offers", Blacklist: "News.txt"},
+  }}
+  ResolvePaths(filepath.Join(dir, "Config.json"))
+  if got, want := FolderListFiles(false), []string{WhitelistFile}; !slices.Equal(got, want) {
+    t.Errorf("whitelists = %v, want %v", got, want)
+  }
+  if got, want := FolderListFiles(true), []string{BlacklistFile, filepath.Join(dir, "News.txt")}; !slices.Equal(got, want) {
+    t.Errorf("blacklists = %v, want %v", got, want)
+  }
+}
+
+func TestDestinationFolders(t *testing.T) {
+  defer func(sets []FolderRules, trash, junk string, d, n, u RuleAction) {
+    FolderRuleSets, DefaultTrashFolder, JunkFolder = sets, trash, junk
+    DefaultAction, NotWhitelistedAction, UnacceptableAction = d, n, u
+  }(FolderRuleSets, DefaultTrashFolder, JunkFolder, DefaultAction, NotWhitelistedAction, UnacceptableAction)
+  DefaultTrashFolder, JunkFolder = "Trash", ""
+  DefaultAction        = RuleAction{Kind: "trash"}
+  NotWhitelistedAction = RuleAction{Kind: "flag"}
+  UnacceptableAction   = RuleAction{Kind: "none"}
+  FolderRuleSets = []FolderRules{
+    {Folder: FolderConfig{Name: "INBOX"}},
+    {Folder: FolderConfig{Name: "Newsletters", Destination: "Archive"}, Actions: map[string]RuleAction{"sale": {Kind: "move", Folder: "Offers"}}},
+  }
+  got, err := DestinationFolders()
+  if want := []string{"Archive", "Offers", "Trash"}; err != nil || !slices.Equal(got, want) {
+    t.Errorf("DestinationFolders() = %v, %v, want %v", got, err, want)
+  }
+  FolderRuleSets[0].Actions = map[string]RuleAction{"invoice": {Kind: "junk"}}
+  if _, err := DestinationFolders(); err != ErrNoJunkFolder {
+    t.Errorf("junk action without a junk folder: got %v, want ErrNoJunkFolder", err)
+  }
+  DefaultTrashFolder = ""
+  FolderRuleSets = FolderRuleSets[:1]
+  FolderRuleSets[0].Actions = nil
+  if _, err := DestinationFolders(); err != ErrNoTrashFolder {
+    t.Errorf("trash action without a trash folder: got %v, want ErrNoTrashFolder", err)
+  }
+}
+
+func TestResolvePathsDefaultFolder(t *testing.T) {
+  keepPaths(t)
+  Config = ConfigFile{}
+  ResolvePaths(filepath.Join(t.TempDir(), "Config.json"))
+  if len(Config.Folders) != 1 || Config.Folders[0].Name != "INBOX" || Config.Folders[0].Whitelist != WhitelistFile {
+    t.Errorf("default folders = %+v", Config.Folders)
+  }
+}
+
+func TestFindSpecialFolder(t *testing.T) {
+  defer func(m []*imap.MailboxInfo) { Mailboxes = m }(Mailboxes)
+  Mailboxes = []*imap.MailboxInfo{
+    {Name: "INBOX"},
+    {Name: "[Gmail]", Attributes: []string{imap.NoSelectAttr}},
+    {Name: "[Gmail]/Bin", Attributes: []string{`\HasNoChildren`, `\trash`}},
+    {Name: "trash"},
+    {Name: "Spam", Attributes: []string{imap.NoSelectAttr}},
+    {Name: "Bulk Mail"},
+  }
+  tests := []struct {
+    override, attr     string
+    names              []string
+    wantName, wantFrom string
+  }{
+    {"Deleted", imap.TrashAttr, TrashFolderNames, "Deleted", "config"},
+    {"", imap.TrashAttr, TrashFolderNames, "[Gmail]/Bin", "special-use"},
+    {"", imap.JunkAttr, JunkFolderNames, "Bulk Mail", "name"},
+    {"", imap.ArchiveAttr, []string{"Archive"}, "", ""},
+  }
+  for _, test := range tests {
+    name, from := FindSpecialFolder(test.override, test.attr, test.names)
+    if name != test.wantName || from != test.wantFrom {
+      t.Errorf("FindSpecialFolder(%q, %s) = %q, %q, want %q, %q", test.override, test.attr, name, from, test.wantName, test.wantFrom)
+    }
+  }
+}
@@ -2,9 +2,9 @@ module SpamBeGone
 
 go 1.23.4
 
-require github.com/emersion/go-imap v1.2.1
-
 require (
-	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21 // indirect
-	golang.org/x/text v0.3.7 // indirect
+	github.com/emersion/go-imap v1.2.1
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21
 )
+
+require golang.org/x/text v0.3.7 // indirect
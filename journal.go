@@ -0,0 +1,307 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+
+  "github.com/emersion/go-imap"
+)
+
+// MoveJournal records a move before it starts, so a run that dies between copying and
+// expunging can be finished by the next one instead of copying the messages again
+type MoveJournal struct {
+  Account     string        `json:"account"`
+  Folder      string        `json:"folder"`
+  UIDValidity uint32        `json:"uidValidity"`
+  Started     time.Time     `json:"started"`
+  RunID       string        `json:"runId"`
+  Step        string        `json:"step"`               // "copying", then "copied" once the copies are done
+  Recorded    bool          `json:"recorded,omitempty"` // the moves are in MovesFile
+  Moves       []JournalMove `json:"moves"`
+}
+
+// JournalMove is one destination folder and the messages planned for it
+type JournalMove struct {
+  Destination string           `json:"destination"`
+  Action      string           `json:"action,omitempty"`
+  Messages    []JournalMessage `json:"messages"`
+}
+
+// JournalMessage identifies a message in the source folder and, by Message-ID, in the
+// destination. The rest is what its MoveRecord needs if the move has to be resumed.
+type JournalMessage struct {
+  UID       uint32 `json:"uid"`
+  MessageID string `json:"messageId,omitempty"`
+  Rule      string `json:"rule,omitempty"`
+  Phrase    string `json:"phrase,omitempty"`
+  TrashCode byte   `json:"trashCode,omitempty"`
+  From      string `json:"from,omitempty"`
+  Subject   string `json:"subject,omitempty"`
+}
+
+// Journal file for an account, e.g. SpamBeGone.me_example.com.journal.json in the state directory
+func JournalPath(account string) string {
+  return filepath.Join(StateDir, strings.TrimSuffix(LockFileName(account), ".lock")+".journal.json")
+}
+
+// Write the journal, replacing the previous one only once the new one is safely on disk
+func (j *MoveJournal) Save() error {
+  path := JournalPath(j.Account)
+  if err := MakeParentDir(path); err != nil {
+    return fmt.Errorf("failed to create state directory %s: %w", StateDir, err)
+  }
+  data, err := json.MarshalIndent(j, "", "  ")
+  if err != nil {
+    return err
+  }
+  tmp := path + ".tmp"
+  file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+  if err != nil {
+    return fmt.Errorf("failed to write move journal %s: %w", tmp, err)
+  }
+  _, err = file.Write(data)
+  if err == nil {
+    err = file.Sync()
+  }
+  if closeErr := file.Close(); err == nil {
+    err = closeErr
+  }
+  if err == nil {
+    err = os.Rename(tmp, path)
+  }
+  if err != nil {
+    os.Remove(tmp)
+    return fmt.Errorf("failed to write move journal %s: %w", path, err)
+  }
+  return nil
+}
+
+// Mark a step as done
+func (j *MoveJournal) Advance(step string) error {
+  j.Step = step
+  return j.Save()
+}
+
+// Drop the messages that were not copied after a failed move; they stay where they are
+func (j *MoveJournal) Keep(copied *imap.SeqSet) {
+  for i := range j.Moves {
+    var kept []JournalMessage
+    for _, message := range j.Moves[i].Messages {
+      if copied.Contains(message.UID) {
+        kept = append(kept, message)
+      }
+    }
+    j.Moves[i].Messages = kept
+  }
+}
+
+// Delete the journal once the move is finished
+func RemoveJournal(account string) {
+  if err := os.Remove(JournalPath(account)); err != nil && !errors.Is(err, os.ErrNotExist) {
+    slog.Warn("failed to remove move journal", "file", JournalPath(account), "err", err)
+  }
+}
+
+// Read the journal an interrupted run left behind; nil if there is none
+func LoadJournal(account string) (*MoveJournal, error) {
+  data, err := os.ReadFile(JournalPath(account))
+  if errors.Is(err, os.ErrNotExist) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, fmt.Errorf("failed to read move journal: %w", err)
+  }
+  var journal MoveJournal
+  if err := json.Unmarshal(data, &journal); err != nil {
+    return nil, fmt.Errorf("failed to parse move journal %s: %w", JournalPath(account), err)
+  }
+  return &journal, nil
+}
+
+// Record the moves MoveToTrash is about to make
+func StartJournal(uidValidity uint32, groups []*ActionGroup) (*MoveJournal, error) {
+  journal := &MoveJournal{Account: email, Folder: SelectFolder, UIDValidity: uidValidity, Started: time.Now(), RunID: RunID, Step: "copying"}
+  for _, group := range groups {
+    if group.Action.Kind == "flag" || group.Action.Kind == "tag" {
+      continue
+    }
+    move := JournalMove{Destination: group.Action.Destination(), Action: group.Action.String()}
+    for _, matched := range MatchingEmails {
+      if group.UIDs.Contains(matched.UID) {
+        move.Messages = append(move.Messages, JournalMessage{UID: matched.UID, MessageID: matched.MessageID, Rule: matched.Rule,
+          Phrase: matched.Phrase, TrashCode: matched.TrashCode, From: matched.From, Subject: matched.Subject})
+      }
+    }
+    journal.Moves = append(journal.Moves, move)
+  }
+  if len(journal.Moves) == 0 {
+    return nil, nil
+  }
+  return journal, journal.Save()
+}
+
+// Finish a move an earlier run started but did not complete: copy what never reached its
+// destination, record the moves under the earlier run's ID, then delete and expunge the originals
+func ResumeMoveJournal() error {
+  journal, err := LoadJournal(email)
+  if err != nil || journal == nil {
+    return err
+  }
+  slog.Warn("Resuming interrupted move", "folder", journal.Folder, "runId", journal.RunID, "started", journal.Started, "step", journal.Step)
+  previousFolder := SelectFolder
+  SelectFolder = journal.Folder
+  defer func() { SelectFolder = previousFolder }()
+  mbox, err := c.Select(journal.Folder, false)
+  if err != nil {
+    CountIMAPError("select")
+    return fmt.Errorf("failed to select %s to resume interrupted move: %w", journal.Folder, err)
+  }
+  if mbox.UidValidity != journal.UIDValidity {
+    // The UIDs no longer name the same messages; they will simply be matched again
+    slog.Warn("Folder was rebuilt since the interrupted move; discarding the journal", "folder", journal.Folder)
+    RemoveJournal(email)
+    return nil
+  }
+  deleteSet := new(imap.SeqSet)
+  var records []MoveRecord
+  removed := 0
+  for _, move := range journal.Moves {
+    remaining, err := SourceUIDs(move.Messages)
+    if err != nil {
+      return err
+    }
+    if len(remaining) == 0 {
+      continue
+    }
+    var toCopy []uint32
+    if journal.Step != "copied" {
+      if toCopy, err = MissingFromDestination(move, remaining); err != nil {
+        return err
+      }
+      if _, err := c.Select(journal.Folder, false); err != nil {
+        CountIMAPError("select")
+        return fmt.Errorf("failed to reselect mailbox %s: %w", journal.Folder, err)
+      }
+    }
+    slog.Info("Interrupted move", "destination", move.Destination, "remaining", len(remaining), "toCopy", len(toCopy))
+    if len(toCopy) > 0 {
+      uids := new(imap.SeqSet)
+      uids.AddNum(toCopy...)
+      if _, err := CopyChunks(uids, move.Destination); err != nil {
+        return fmt.Errorf("failed to resume interrupted move: %w", err)
+      }
+    }
+    deleteSet.AddNum(remaining...)
+    records = append(records, move.Records(journal, remaining)...)
+    removed += len(remaining)
+  }
+  if !journal.Recorded {
+    if err := AppendMoveRecords(records); err != nil {
+      slog.Warn("failed to record resumed moves; undo will not find them", "err", err)
+    }
+    journal.Recorded = true
+  }
+  if err := journal.Advance("copied"); err != nil {
+    return err
+  }
+  if !deleteSet.Empty() {
+    if err := c.UidStore(deleteSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); err != nil {
+      CountIMAPError("store")
+      return fmt.Errorf("failed to mark resumed messages as deleted: %w", err)
+    }
+    uidplus, _ := c.Support("UIDPLUS")
+    if err := ExpungeUIDs(deleteSet, uidplus); err != nil {
+      CountIMAPError("expunge")
+      return fmt.Errorf("failed to expunge resumed messages: %w", err)
+    }
+  }
+  RemoveJournal(email)
+  slog.Info("Interrupted move finished", "folder", journal.Folder, "removed", removed)
+  return nil
+}
+
+// Move records for the messages among uids, as the interrupted run would have written them
+func (m JournalMove) Records(journal *MoveJournal, uids []uint32) []MoveRecord {
+  pending := map[uint32]bool{}
+  for _, uid := range uids {
+    pending[uid] = true
+  }
+  var records []MoveRecord
+  for _, message := range m.Messages {
+    if !pending[message.UID] {
+      continue
+    }
+    records = append(records, MoveRecord{
+      RunID:       journal.RunID,
+      Time:        time.Now(),
+      Account:     journal.Account,
+      Folder:      journal.Folder,
+      Destination: m.Destination,
+      MessageID:   message.MessageID,
+      Rule:        message.Rule,
+      Phrase:      message.Phrase,
+      TrashCode:   message.TrashCode,
+      Action:      m.Action,
+      From:        message.From,
+      Subject:     message.Subject,
+    })
+  }
+  return records
+}
+
+// UIDs from the journal that are still in the selected folder, including those already marked
+// \Deleted by a run that died before it could expunge them
+func SourceUIDs(messages []JournalMessage) ([]uint32, error) {
+  uids := new(imap.SeqSet)
+  for _, message := range messages {
+    uids.AddNum(message.UID)
+  }
+  criteria := imap.NewSearchCriteria()
+  criteria.Uid = uids
+  found, err := c.UidSearch(criteria)
+  if err != nil {
+    CountIMAPError("search")
+    return nil, fmt.Errorf("failed to search for interrupted move messages: %w", err)
+  }
+  return found, nil
+}
+
+// UIDs among remaining whose Message-ID is not in the destination yet. Messages without a
+// Message-ID cannot be checked and are copied again, since a duplicate beats a lost message.
+func MissingFromDestination(move JournalMove, remaining []uint32) ([]uint32, error) {
+  if _, err := c.Select(move.Destination, true); err != nil {
+    CountIMAPError("select")
+    return nil, fmt.Errorf("failed to select %s to resume interrupted move: %w", move.Destination, err)
+  }
+  pending := map[uint32]bool{}
+  for _, uid := range remaining {
+    pending[uid] = true
+  }
+  var missing []uint32
+  for _, message := range move.Messages {
+    if !pending[message.UID] {
+      continue
+    }
+    if message.MessageID == "" {
+      missing = append(missing, message.UID)
+      continue
+    }
+    criteria := imap.NewSearchCriteria()
+    criteria.Header.Add("Message-Id", message.MessageID)
+    found, err := c.UidSearch(criteria)
+    if err != nil {
+      CountIMAPError("search")
+      return nil, fmt.Errorf("failed to search %s: %w", move.Destination, err)
+    }
+    if len(found) == 0 {
+      missing = append(missing, message.UID)
+    }
+  }
+  return missing, nil
+}
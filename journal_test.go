@@ -0,0 +1,146 @@
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "reflect"
+  "testing"
+  "time"
+
+  "github.com/emersion/go-imap"
+)
+
+func TestJournalPath(t *testing.T) {
+  keepPaths(t)
+  StateDir = filepath.Join("state", "dir")
+  if got, want := JournalPath("me@example.com"), filepath.Join("state", "dir", "SpamBeGone.me_example.com.journal.json"); got != want {
+    t.Errorf("JournalPath = %q, want %q", got, want)
+  }
+}
+
+func TestMoveJournalSaveLoad(t *testing.T) {
+  keepPaths(t)
+  StateDir = filepath.Join(t.TempDir(), "state")
+  if journal, err := LoadJournal("me@example.com"); journal != nil || err != nil {
+    t.Fatalf("LoadJournal without a journal = %v, %v", journal, err)
+  }
+  journal := &MoveJournal{
+    Account:     "me@example.com",
+    Folder:      "INBOX",
+    UIDValidity: 7,
+    Started:     time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC),
+    RunID:       "20260102-150405-abcdef",
+    Step:        "copying",
+    Moves:       []JournalMove{{Destination: "Trash", Messages: []JournalMessage{{UID: 3, MessageID: "<a@example.com>"}, {UID: 9}}}},
+  }
+  if err := journal.Advance("copied"); err != nil {
+    t.Fatal(err)
+  }
+  loaded, err := LoadJournal("me@example.com")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !reflect.DeepEqual(loaded, journal) {
+    t.Errorf("LoadJournal = %+v, want %+v", loaded, journal)
+  }
+  if _, err := os.Stat(JournalPath("me@example.com") + ".tmp"); !os.IsNotExist(err) {
+    t.Errorf("temporary journal left behind: %v", err)
+  }
+  RemoveJournal("me@example.com")
+  if journal, err := LoadJournal("me@example.com"); journal != nil || err != nil {
+    t.Errorf("LoadJournal after RemoveJournal = %v, %v", journal, err)
+  }
+  os.WriteFile(JournalPath("me@example.com"), []byte("{"), 0600)
+  if _, err := LoadJournal("me@example.com"); err == nil {
+    t.Error("LoadJournal accepted a corrupt journal")
+  }
+}
+
+func TestMoveJournalKeep(t *testing.T) {
+  journal := &MoveJournal{Moves: []JournalMove{
+    {Destination: "Trash", Messages: []JournalMessage{{UID: 1}, {UID: 2}, {UID: 5}}},
+    {Destination: "Junk", Messages: []JournalMessage{{UID: 7}}},
+  }}
+  copied, _ := imap.ParseSeqSet("1:3")
+  journal.Keep(copied)
+  if got := journal.Moves[0].Messages; !reflect.DeepEqual(got, []JournalMessage{{UID: 1}, {UID: 2}}) {
+    t.Errorf("Trash keeps %v, want UIDs 1 and 2", got)
+  }
+  if got := journal.Moves[1].Messages; len(got) != 0 {
+    t.Errorf("Junk keeps %v, want nothing", got)
+  }
+}
+
+func TestJournalMoveRecords(t *testing.T) {
+  journal := &MoveJournal{Account: "me@example.com", Folder: "INBOX", RunID: "run-1"}
+  move := JournalMove{Destination: "Trash", Action: "trash", Messages: []JournalMessage{
+    {UID: 3, MessageID: "<3@shop.com>", Rule: "blackfriday", Phrase: "black friday", TrashCode: 4, From: "news@shop.com", Subject: "Deals"},
+    {UID: 5, MessageID: "<5@shop.com>", Rule: "NotWhiteList", TrashCode: 1},
+  }}
+  records := move.Records(journal, []uint32{3, 9})
+  if len(records) != 1 {
+    t.Fatalf("Records = %+v, want only UID 3", records)
+  }
+  r := records[0]
+  if r.RunID != "run-1" || r.Account != "me@example.com" || r.Folder != "INBOX" || r.Destination != "Trash" || r.Action != "trash" ||
+    r.MessageID != "<3@shop.com>" || r.Rule != "blackfriday" || r.Phrase != "black friday" || r.TrashCode != 4 ||
+    r.From != "news@shop.com" || r.Subject != "Deals" || r.Time.IsZero() {
+    t.Errorf("record = %+v", r)
+  }
+}
+
+func TestResumeMoveJournalDeleted(t *testing.T) {
+  account := newFakeAccount(`Trash|\Trash`)
+  account.Add("INBOX", "Shop <news@shop.com>", "Big sale", imap.DeletedFlag)
+  account.Add("INBOX", "Friend <friend@mail.com>", "Lunch?")
+  account.Add("Trash", "Shop <news@shop.com>", "Big sale")
+  startFakeAccount(t, account, "friend@mail.com\n", "sale\n", "")
+  // The interrupted run copied the message and marked it \Deleted, then died before expunging
+  journal := &MoveJournal{Account: email, Folder: "INBOX", UIDValidity: 7, RunID: "run-1", Step: "copied", Recorded: true,
+    Moves: []JournalMove{{Destination: "Trash", Action: "trash", Messages: []JournalMessage{{UID: 1, MessageID: "<1.INBOX@fake>"}}}}}
+  if err := journal.Save(); err != nil {
+    t.Fatal(err)
+  }
+  if err := ConnectLogin(); err != nil {
+    t.Fatal(err)
+  }
+  if err := ResumeMoveJournal(); err != nil {
+    t.Fatalf("ResumeMoveJournal: %v", err)
+  }
+  if got := account.Subjects("INBOX"); !reflect.DeepEqual(got, []string{"Lunch?"}) {
+    t.Errorf("INBOX holds %q, want the moved message expunged", got)
+  }
+  if got := account.Subjects("Trash"); len(got) != 1 {
+    t.Errorf("Trash holds %q, want the one copy", got)
+  }
+  if journal, _ := LoadJournal(email); journal != nil {
+    t.Error("journal left behind")
+  }
+}
+
+func TestMoveKeepsOtherDeletedMessages(t *testing.T) {
+  account := newFakeAccount(`Trash|\Trash`)
+  account.Add("INBOX", "Shop <news@shop.com>", "Big sale")
+  account.Add("INBOX", "Me <me@example.com>", "Old draft", imap.DeletedFlag)
+  account.Add("INBOX", "Friend <friend@mail.com>", "Lunch?")
+  startFakeAccount(t, account, "friend@mail.com\n", "sale\ndraft\n", `, "actions": {"notWhitelisted": "none"}`)
+  for run := 1; run <= 2; run++ {
+    if err := RunOnce(); err != nil {
+      t.Fatalf("run %d: %v", run, err)
+    }
+  }
+  // The server lacks UIDPLUS, so with the user's draft marked \Deleted nothing is expunged
+  if got := account.Subjects("INBOX"); !reflect.DeepEqual(got, []string{"Big sale", "Old draft", "Lunch?"}) {
+    t.Errorf("INBOX holds %q, want the draft the user deleted left for their client", got)
+  }
+  if got := account.Commands("EXPUNGE"); len(got) != 0 {
+    t.Errorf("expunged the user's deleted message: %q", got)
+  }
+  // The moved message waits, marked \Deleted, and is not matched or copied again
+  if got := account.Commands("COPY"); !reflect.DeepEqual(got, []string{"COPY INBOX 1 Trash"}) {
+    t.Errorf("COPY commands %q, want one for the sale", got)
+  }
+  if got := account.Subjects("Trash"); !reflect.DeepEqual(got, []string{"Big sale"}) {
+    t.Errorf("Trash holds %q", got)
+  }
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// RunLock is an exclusive lock on a file, held by the operating system for the duration of a
+// run against one account. The lock goes away with the process, so a crashed run never leaves
+// a stale lock behind.
+type RunLock struct {
+  Path string
+  file *os.File
+}
+
+// Take the lock for account, or fail if another run holds it
+func AcquireLock(account string) (*RunLock, error) {
+  path := filepath.Join(StateDir, LockFileName(account))
+  if err := MakeParentDir(path); err != nil {
+    return nil, fmt.Errorf("failed to create state directory %s: %w", StateDir, err)
+  }
+  // The file is never removed: a run that opened it just before removal would lock a file
+  // nobody else can see
+  file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+  if err != nil {
+    return nil, fmt.Errorf("failed to open lock file %s: %w", path, err)
+  }
+  if err := LockFile(file); err != nil {
+    file.Close()
+    if errors.Is(err, ErrLocked) {
+      pid, started := ReadLock(path)
+      return nil, fmt.Errorf("another run (pid %d, started %s) holds %s", pid, started, path)
+    }
+    return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+  }
+  // The pid is only informational, for the message above
+  file.Truncate(0)
+  fmt.Fprintf(file, "%d\n%s\n%s\n", os.Getpid(), time.Now().Format("2006-01-02 15:04:05"), account)
+  file.Sync()
+  return &RunLock{Path: path, file: file}, nil
+}
+
+// Release the lock so the next run can proceed
+func (lock *RunLock) Release() {
+  lock.file.Truncate(0)
+  if err := UnlockFile(lock.file); err != nil {
+    slog.Warn("failed to unlock lock file", "file", lock.Path, "err", err)
+  }
+  lock.file.Close()
+}
+
+// Lock file name for an account, e.g. SpamBeGone.me_example.com.lock
+func LockFileName(account string) string {
+  name := strings.Map(func(r rune) rune {
+    switch {
+      case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+        return r
+    }
+    return '_'
+  }, strings.ToLower(account))
+  return "SpamBeGone." + name + ".lock"
+}
+
+// Read the pid and start time a lock's holder recorded in its file
+func ReadLock(path string) (pid int, started string) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return 0, ""
+  }
+  lines := strings.Split(string(data), "\n")
+  pid, _ = strconv.Atoi(strings.TrimSpace(lines[0]))
+  if len(lines) > 1 {
+    started = strings.TrimSpace(lines[1])
+  }
+  return pid, started
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+  "fmt"
+  "os"
+  "strings"
+  "testing"
+)
+
+func TestLockFileName(t *testing.T) {
+  tests := []struct {
+    account string
+    want    string
+  }{
+    {"me@example.com", "SpamBeGone.me_example.com.lock"},
+    {"Me.Name@Example.COM", "SpamBeGone.me.name_example.com.lock"},
+    {"a/b\\c d", "SpamBeGone.a_b_c_d.lock"},
+  }
+  for _, test := range tests {
+    if got := LockFileName(test.account); got != test.want {
+      t.Errorf("LockFileName(%q) = %q, want %q", test.account, got, test.want)
+    }
+  }
+}
+
+func TestAcquireLock(t *testing.T) {
+  keepPaths(t)
+  StateDir = t.TempDir()
+  first, err := AcquireLock("me@example.com")
+  if err != nil {
+    t.Fatalf("first lock: %v", err)
+  }
+  if _, err := AcquireLock("me@example.com"); err == nil || !strings.Contains(err.Error(), "holds") {
+    t.Fatalf("second lock while held: got %v, want an error naming the holder", err)
+  }
+  other, err := AcquireLock("other@example.com")
+  if err != nil {
+    t.Fatalf("lock for another account: %v", err)
+  }
+  other.Release()
+  first.Release()
+  // A lock file left by a process that no longer exists holds no lock
+  os.WriteFile(first.Path, []byte(fmt.Sprintf("%d\n2026-01-02 15:04:05\nme@example.com\n", 1<<30)), 0644)
+  again, err := AcquireLock("me@example.com")
+  if err != nil {
+    t.Fatalf("lock over a stale file: %v", err)
+  }
+  if pid, _ := ReadLock(again.Path); pid != os.Getpid() {
+    t.Errorf("lock file records pid %d, want %d", pid, os.Getpid())
+  }
+  again.Release()
+}
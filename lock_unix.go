@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+import (
+  "errors"
+  "os"
+  "syscall"
+)
+
+// Returned by LockFile when another process holds the lock
+var ErrLocked = errors.New("file is locked")
+
+// Take an exclusive flock on the file without waiting
+func LockFile(file *os.File) error {
+  err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+  if errors.Is(err, syscall.EWOULDBLOCK) {
+    return ErrLocked
+  }
+  return err
+}
+
+// Drop the flock taken by LockFile
+func UnlockFile(file *os.File) error {
+  return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
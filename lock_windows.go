@@ -0,0 +1,53 @@
+//go:build windows
+
+package main
+
+import (
+  "errors"
+  "os"
+  "syscall"
+  "unsafe"
+)
+
+var (
+  // Returned by LockFile when another process holds the lock
+  ErrLocked = errors.New("file is locked")
+
+  kernel32         = syscall.NewLazyDLL("kernel32.dll")
+  procLockFileEx   = kernel32.NewProc("LockFileEx")
+  procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const (
+  lockfileFailImmediately = 0x1
+  lockfileExclusiveLock   = 0x2
+  errorLockViolation      = syscall.Errno(33)
+)
+
+// Windows locks are mandatory, so the lock covers one byte far past the end of the file and
+// other runs can still read the pid written at the start
+func lockRange() *syscall.Overlapped {
+  return &syscall.Overlapped{Offset: 0, OffsetHigh: 0x7fffffff}
+}
+
+// Take an exclusive LockFileEx lock on the file without waiting
+func LockFile(file *os.File) error {
+  r, _, err := procLockFileEx.Call(file.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0,
+    uintptr(unsafe.Pointer(lockRange())))
+  if r != 0 {
+    return nil
+  }
+  if errors.Is(err, errorLockViolation) {
+    return ErrLocked
+  }
+  return err
+}
+
+// Drop the lock taken by LockFile
+func UnlockFile(file *os.File) error {
+  r, _, err := procUnlockFileEx.Call(file.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(lockRange())))
+  if r != 0 {
+    return nil
+  }
+  return err
+}
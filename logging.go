@@ -0,0 +1,198 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "time"
+)
+
+var (
+  // Logging options set from the command line
+  LogFormat  = "text"
+  LogLevel   = "info"
+  LogDir     = ""
+  LogKeep    = 48
+  LogQuiet   = false
+  // Per-run log file, nil when logging to the console only
+  RunLogFile *os.File
+)
+
+// Level of --trace output, logged as TRACE. Tracing is asked for message by message, so these
+// records pass --quiet and --log-level.
+const LevelTrace = slog.LevelInfo + 1
+
+// FanoutHandler passes every record to each handler that is enabled for its level
+type FanoutHandler struct {
+  Handlers []slog.Handler
+}
+
+// Report whether any handler takes records at this level
+func (h *FanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+  for _, handler := range h.Handlers {
+    if handler.Enabled(ctx, level) {
+      return true
+    }
+  }
+  return false
+}
+
+// Pass a copy of the record to every handler enabled for its level
+func (h *FanoutHandler) Handle(ctx context.Context, record slog.Record) error {
+  var errs []error
+  for _, handler := range h.Handlers {
+    if handler.Enabled(ctx, record.Level) {
+      errs = append(errs, handler.Handle(ctx, record.Clone()))
+    }
+  }
+  return errors.Join(errs...)
+}
+
+// A fanout of the handlers with the attributes added to each
+func (h *FanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+  out := &FanoutHandler{}
+  for _, handler := range h.Handlers {
+    out.Handlers = append(out.Handlers, handler.WithAttrs(attrs))
+  }
+  return out
+}
+
+// A fanout of the handlers with the group opened on each
+func (h *FanoutHandler) WithGroup(name string) slog.Handler {
+  out := &FanoutHandler{}
+  for _, handler := range h.Handlers {
+    out.Handlers = append(out.Handlers, handler.WithGroup(name))
+  }
+  return out
+}
+
+// Check the logging flags and install the console logger
+func InitLogging() error {
+  if _, err := ParseLogLevel(LogLevel); err != nil {
+    return err
+  }
+  if LogFormat != "text" && LogFormat != "json" {
+    return fmt.Errorf("unknown log format %q (want text or json)", LogFormat)
+  }
+  ConfigureLogger()
+  return nil
+}
+
+// Convert a level name such as "debug" to a slog.Level
+func ParseLogLevel(name string) (slog.Level, error) {
+  var level slog.Level
+  if err := level.UnmarshalText([]byte(name)); err != nil {
+    return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", name)
+  }
+  return level, nil
+}
+
+// Rebuild the default logger from the console and the current run log file
+func ConfigureLogger() {
+  level, _ := ParseLogLevel(LogLevel)
+  consoleLevel := level
+  if LogQuiet && consoleLevel < slog.LevelWarn {
+    consoleLevel = slog.LevelWarn
+  }
+  fanout := &FanoutHandler{}
+  fanout.Handlers = append(fanout.Handlers, NewLogHandler(os.Stdout, consoleLevel))
+  if RunLogFile != nil {
+    fanout.Handlers = append(fanout.Handlers, NewLogHandler(RunLogFile, level))
+  }
+  slog.SetDefault(slog.New(fanout))
+}
+
+// Create a text or JSON handler depending on --log-format
+func NewLogHandler(w io.Writer, level slog.Level) slog.Handler {
+  opts := &slog.HandlerOptions{Level: level, ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+    if attr.Key == slog.LevelKey && len(groups) == 0 && attr.Value.Any() == LevelTrace {
+      attr.Value = slog.StringValue("TRACE")
+    }
+    return attr
+  }}
+  if LogFormat == "json" {
+    return TraceHandler{slog.NewJSONHandler(w, opts)}
+  }
+  return TraceHandler{slog.NewTextHandler(w, opts)}
+}
+
+// TraceHandler takes TRACE records whatever the level of the handler it wraps
+type TraceHandler struct {
+  slog.Handler
+}
+
+// Report whether the wrapped handler takes records at this level, or it is LevelTrace
+func (h TraceHandler) Enabled(ctx context.Context, level slog.Level) bool {
+  return level == LevelTrace || h.Handler.Enabled(ctx, level)
+}
+
+// The wrapped handler with the attributes added, still taking TRACE records
+func (h TraceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+  return TraceHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// The wrapped handler with the group opened, still taking TRACE records
+func (h TraceHandler) WithGroup(name string) slog.Handler {
+  return TraceHandler{h.Handler.WithGroup(name)}
+}
+
+// Open a new log file for this run in LogDir and prune old ones; the returned func closes it.
+// The name carries the process ID, so accounts run side by side never share a file.
+func StartRunLog() (func(), error) {
+  if LogDir == "" {
+    return func() {}, nil
+  }
+  if err := os.MkdirAll(LogDir, 0755); err != nil {
+    return nil, fmt.Errorf("failed to create log directory %s: %w", LogDir, err)
+  }
+  ext := ".txt"
+  if LogFormat == "json" {
+    ext = ".json"
+  }
+  path := filepath.Join(LogDir, fmt.Sprintf("Log.%s.%d%s", time.Now().Format("2006.01.02.15.04.05"), os.Getpid(), ext))
+  file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+  if err != nil {
+    return nil, fmt.Errorf("failed to open log file %s: %w", path, err)
+  }
+  RunLogFile = file
+  ConfigureLogger()
+  PruneRunLogs()
+  return func() {
+    RunLogFile = nil
+    ConfigureLogger()
+    file.Close()
+  }, nil
+}
+
+// Delete the oldest run logs so that at most LogKeep remain
+func PruneRunLogs() {
+  if LogKeep <= 0 {
+    return
+  }
+  entries, err := os.ReadDir(LogDir)
+  if err != nil {
+    slog.Warn("failed to read log directory", "dir", LogDir, "err", err)
+    return
+  }
+  var logs []string
+  for _, entry := range entries {
+    if !entry.IsDir() && strings.HasPrefix(entry.Name(), "Log.") {
+      logs = append(logs, entry.Name())
+    }
+  }
+  // Names start with the timestamp, so lexical order is chronological order
+  sort.Strings(logs)
+  for len(logs) > LogKeep {
+    path := filepath.Join(LogDir, logs[0])
+    if err := os.Remove(path); err != nil {
+      slog.Warn("failed to remove old log file", "file", path, "err", err)
+    }
+    logs = logs[1:]
+  }
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+  tests := []struct {
+    name string
+    want slog.Level
+    ok   bool
+  }{
+    {"debug", slog.LevelDebug, true},
+    {"INFO", slog.LevelInfo, true},
+    {"warn", slog.LevelWarn, true},
+    {"error", slog.LevelError, true},
+    {"verbose", 0, false},
+  }
+  for _, test := range tests {
+    got, err := ParseLogLevel(test.name)
+    if (err == nil) != test.ok || got != test.want {
+      t.Errorf("ParseLogLevel(%q) = %v, %v; want %v, ok %t", test.name, got, err, test.want, test.ok)
+    }
+  }
+}
+
+func TestFanoutHandler(t *testing.T) {
+  var console, file bytes.Buffer
+  logger := slog.New(&FanoutHandler{Handlers: []slog.Handler{
+    slog.NewTextHandler(&console, &slog.HandlerOptions{Level: slog.LevelWarn}),
+    slog.NewTextHandler(&file, &slog.HandlerOptions{Level: slog.LevelDebug}),
+  }}).With("account", "me@example.com")
+  logger.Debug("detail")
+  logger.Warn("problem")
+  if strings.Contains(console.String(), "detail") || !strings.Contains(console.String(), "problem") {
+    t.Errorf("console got %q, want only the warning", console.String())
+  }
+  if !strings.Contains(file.String(), "detail") || !strings.Contains(file.String(), "problem") {
+    t.Errorf("file got %q, want both records", file.String())
+  }
+  if !strings.Contains(file.String(), "account=me@example.com") {
+    t.Errorf("file got %q, want the attributes added with With", file.String())
+  }
+}
+
+func TestPruneRunLogs(t *testing.T) {
+  defer func(dir string, keep int) { LogDir, LogKeep = dir, keep }(LogDir, LogKeep)
+  LogDir, LogKeep = t.TempDir(), 2
+  for day := 1; day <= 4; day++ {
+    os.WriteFile(filepath.Join(LogDir, fmt.Sprintf("Log.2026.01.0%d.00.00.00.txt", day)), nil, 0644)
+  }
+  os.WriteFile(filepath.Join(LogDir, "notes.txt"), nil, 0644)
+  PruneRunLogs()
+  entries, _ := os.ReadDir(LogDir)
+  var names []string
+  for _, entry := range entries {
+    names = append(names, entry.Name())
+  }
+  if want := "[Log.2026.01.03.00.00.00.txt Log.2026.01.04.00.00.00.txt notes.txt]"; fmt.Sprint(names) != want {
+    t.Errorf("after pruning: %v, want %s", names, want)
+  }
+}
+
+func TestStartRunLog(t *testing.T) {
+  defer func(dir string, format string) { LogDir, LogFormat = dir, format }(LogDir, LogFormat)
+  LogDir, LogFormat = t.TempDir(), "text"
+  closeLog, err := StartRunLog()
+  if err != nil {
+    t.Fatal(err)
+  }
+  slog.Info("hello")
+  closeLog()
+  entries, _ := os.ReadDir(LogDir)
+  if len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), fmt.Sprintf(".%d.txt", os.Getpid())) {
+    t.Fatalf("log files %v, want one named after the process ID", entries)
+  }
+  data, _ := os.ReadFile(filepath.Join(LogDir, entries[0].Name()))
+  if !strings.Contains(string(data), "hello") {
+    t.Errorf("run log holds %q", data)
+  }
+}
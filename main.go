@@ -10,9 +10,12 @@ package main
 
 import (
   "bufio"
+  "context"
   "encoding/json"
+  "errors"
+  "flag"
   "fmt"
-  "log"
+  "log/slog"
   "os"
   "sort"
   "strings"
@@ -30,20 +33,37 @@ var (
   password         = ""
   // Global variables
   c                *client.Client
-  DebugEmail       = "debug@example.com"
-  DebugUid         = uint32(0)
   mailbox          *imap.MailboxStatus
   MatchingEmails   []Email
+  // Matching emails MoveToTrash copied to their destination folder
+  MovedUIDs        *imap.SeqSet
   TrashMetrics     []TrashMetric
-  ProgramStartTime = time.Now().Format("2006-01-02 15:04:05")
-  // Constants
+  MessagesScanned  int
+  RunID            string
+  RunStartTime     time.Time
+  // Folder being filtered and where its matches go, set per folder by ResetFolderState
   SelectFolder     = "INBOX"
   TrashFolder      = "Trash"
+  // Destination for folders that do not name their own, set by DetectSpecialFolders
+  DefaultTrashFolder = "Trash"
+  // Junk folder set by DetectSpecialFolders, empty if the server has none
+  JunkFolder         = ""
+  // Every folder on the server, filled by ListMailboxes
+  Mailboxes          []*imap.MailboxInfo
   // Codes
   TrashCode        byte
   // Switches
   DoMoveToTrash    = true
   ShowMailboxes    = true
+  // Command line flags
+  RunEvery         time.Duration
+  RunCron          string
+  TraceTargets     []TraceTarget
+  // Set while the message being evaluated matches a --trace target
+  Tracing          bool
+
+  // Returned by SelectMailbox when there is nothing to do
+  ErrNoMessages    = errors.New("no messages in the mailbox")
 
   // Global blacklist (phrases) and whitelist (email addresses)
   Blacklist []string
@@ -51,10 +71,30 @@ var (
 )
 
 // Config struct for JSON configuration
-var Config struct {
-  Server   string `json:"server"`
-  Email    string `json:"email"`
-  Password string `json:"password"`
+var Config ConfigFile
+
+// ConfigFile is the layout of Config.json
+type ConfigFile struct {
+  Server         string           `json:"server"`
+  Email          string           `json:"email"`
+  Password       string           `json:"password"`
+  Auth           string           `json:"auth"`           // "password" (default) or "oauth2"
+  OAuth2         OAuth2Config     `json:"oauth2"`
+  Connection     ConnectionConfig `json:"connection"`     // mode, TLS settings and timeouts
+  Paths          PathsConfig      `json:"paths"`          // list, state and log locations
+  Folders        []FolderConfig   `json:"folders"`        // source folders to filter; default INBOX only
+  TrashFolder    string           `json:"trashFolder"`    // overrides special-use detection
+  JunkFolder     string           `json:"junkFolder"`     // overrides special-use detection
+  Actions        ActionsConfig    `json:"actions"`        // what happens to matched messages
+  Move           MoveConfig       `json:"move"`           // chunk size, pacing and retries when moving
+  Fetch          FetchConfig      `json:"fetch"`          // page size when reading messages
+  ReportNonASCII bool             `json:"reportNonASCII"` // same as --report-non-ascii
+  // Alternatives to a plaintext password, see ResolvePassword
+  PasswordEnv       string `json:"passwordEnv"`
+  PasswordCommand   string `json:"passwordCommand"`
+  PasswordFile      string `json:"passwordFile"`
+  CredentialsFile   string `json:"credentialsFile"`
+  PassphraseCommand string `json:"passphraseCommand"`
 }
 
 // Define the Email struct
@@ -64,6 +104,10 @@ type Email struct {
   Subject      string
   InternalDate string
   TrashCode    byte
+  Rule         string // the phrase that matched, possibly without its spaces, or NotWhiteList/Unacceptable
+  Phrase       string // the Blacklist.txt phrase Rule came from
+  Action       RuleAction
+  MessageID    string
 }
 
 // Metrics struct
@@ -74,182 +118,450 @@ type TrashMetric struct {
 }
 
 func main() {
-  defer CloseConnection()
-  fmt.Println("SpamBeGone v0.3")
-  LoadWhitelist()
-  LoadBlacklist()
-  InitTrashMetrics()
-  LoadConfig()
-  ConnectLogin()
-  VerifyFolderAccess()
-  ListMailboxes()
-  SelectMailbox()
-  CheckConvertStyledToASCII()
-  FetchAndStoreEmails()
-  ListMatchingEmails()
-  WriteTrashMetrics()
-  MoveToTrash()
+  ParseFlags()
+  if err := InitLogging(); err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    os.Exit(2)
+  }
+  if flag.NArg() > 0 {
+    if err := RunCommand(flag.Arg(0), flag.Args()[1:]); err != nil {
+      slog.Error(flag.Arg(0)+" failed", "err", err)
+      os.Exit(1)
+    }
+    return
+  }
+  slog.Info("SpamBeGone v0.3")
+  if RunEvery > 0 || RunCron != "" {
+    if MetricsListen != "" {
+      if err := StartMetricsListener(); err != nil {
+        slog.Error("scheduler stopped", "err", err)
+        os.Exit(1)
+      }
+    }
+    if err := RunScheduler(); err != nil {
+      slog.Error("scheduler stopped", "err", err)
+      os.Exit(1)
+    }
+    return
+  }
+  if MetricsListen != "" {
+    slog.Warn("--metrics-listen is only used with --every or --cron; ignoring it for a single run")
+  }
+  if err := RunLocked(); err != nil {
+    os.Exit(1)
+  }
   // fmt.Println("Press 'Enter' to continue...")
   // bufio.NewReader(os.Stdin).ReadBytes('\n')
 }
 
-// Read the whitelist from Whitelist.txt
-func LoadWhitelist() {
-  file, err := os.Open("Whitelist.txt")
+// Parse command line flags
+func ParseFlags() {
+  flag.DurationVar(&RunEvery, "every", 0, "run repeatedly at this interval (e.g. 1h, 30m)")
+  flag.StringVar(&RunCron, "cron", "", "run repeatedly on a cron schedule (e.g. \"0 * * * *\")")
+  flag.StringVar(&LogFormat, "log-format", LogFormat, "log output format: text or json")
+  flag.StringVar(&LogLevel, "log-level", LogLevel, "log level: debug, info, warn or error")
+  flag.StringVar(&ConfigPath, "config", ConfigPath, "path to Config.json (default ./Config.json, then $XDG_CONFIG_HOME/spambegone/Config.json on Linux)")
+  flag.StringVar(&LogDir, "log-dir", LogDir, "write a log file per run to this directory")
+  flag.IntVar(&LogKeep, "log-keep", LogKeep, "number of per-run log files to keep in --log-dir")
+  flag.BoolVar(&LogQuiet, "quiet", LogQuiet, "only show warnings and errors on the console")
+  flag.StringVar(&MetricsListen, "metrics-listen", MetricsListen, "serve Prometheus/OpenMetrics counters on this address (e.g. :9090) in scheduler mode")
+  flag.BoolVar(&ReportNonASCII, "report-non-ascii", ReportNonASCII, "log senders and subjects that are still not ASCII after normalization")
+  flag.BoolVar(&TagOnly, "tag-only", TagOnly, "never move mail: tag matched messages with a keyword instead (see the cleanup command)")
+  flag.BoolVar(&Backfill, "backfill", Backfill, "ignore maxAge windows for this run and apply the rules to mail of any age")
+  flag.Func("trace", "trace rule evaluation for messages matching a sender address, domain, UID or subject text (repeatable, comma-separated)", AddTraceTargets)
+  flag.Parse()
+  flag.Visit(func(f *flag.Flag) {
+    if f.Name == "log-dir" {
+      LogDirSet = true
+    }
+  })
+  if RunEvery > 0 && RunCron != "" {
+    fmt.Fprintln(os.Stderr, "--every and --cron cannot be used together")
+    os.Exit(2)
+  }
+}
+
+// Run a named subcommand such as "stats"
+func RunCommand(name string, args []string) error {
+  switch name {
+    case "stats":
+      return StatsCommand(args)
+    case "rules":
+      return RulesCommand(args)
+    case "authorize":
+      return AuthorizeCommand(args)
+    case "credentials":
+      return CredentialsCommand(args)
+    case "check":
+      return CheckCommand(args)
+    case "cleanup":
+      return CleanupCommand(args)
+    case "undo":
+      return UndoCommand(args)
+    case "restore":
+      return RestoreCommand(args)
+  }
+  return fmt.Errorf("unknown command %q (available: check, cleanup, undo, restore, stats, rules, authorize, credentials)", name)
+}
+
+// Load the config, take the account lock and run the filter once, logging to a per-run file
+func RunLocked() (err error) {
+  // Config.json names the log directory, so it is read before the run log starts
+  if err := ReadConfigFile(); err != nil {
+    slog.Error("run failed", "err", err)
+    return err
+  }
+  closeLog, err := StartRunLog()
   if err != nil {
-    log.Fatalf("failed to load whitelist: %v", err)
+    slog.Error("run failed", "err", err)
+    return err
   }
-  defer file.Close()
-  scanner := bufio.NewScanner(file)
-  for scanner.Scan() {
-    line := scanner.Text()
-    line = strings.TrimSpace(line)
-    line = strings.ToLower(line)
-    Whitelist = append(Whitelist, line)
+  defer closeLog()
+  start := time.Now()
+  defer func() {
+    ExportRunResult(err)
+    if err != nil {
+      slog.Error("run failed", "err", err, "duration", time.Since(start).Round(time.Millisecond))
+      return
+    }
+    slog.Info("run finished", "duration", time.Since(start).Round(time.Millisecond))
+  }()
+  if err := LoadConfig(); err != nil {
+    return err
   }
-  if err := scanner.Err(); err != nil {
-    log.Fatalf("error reading whitelist: %v", err)
+  lock, err := AcquireLock(email)
+  if err != nil {
+    return err
   }
+  defer lock.Release()
+  return RunOnce()
 }
 
-// Read the blacklist from Blacklist.txt
-func LoadBlacklist() {
-  file, err := os.Open("Blacklist.txt")
+// Run a single filter pass against the mailbox
+func RunOnce() error {
+  ResetRunState()
+  defer CloseConnection()
+  if err := LoadFolderRules(); err != nil {
+    return err
+  }
+  if err := ConnectLogin(); err != nil {
+    return err
+  }
+  if err := ListMailboxes(); err != nil {
+    return err
+  }
+  DetectSpecialFolders()
+  if err := VerifyFolderAccess(); err != nil {
+    return err
+  }
+  if err := ResumeMoveJournal(); err != nil {
+    return err
+  }
+  return RunFolders()
+}
+
+// Clear everything left over from a previous run so scheduled runs start fresh
+func ResetRunState() {
+  c                = nil
+  mailbox          = nil
+  MatchingEmails   = nil
+  TrashMetrics     = nil
+  MessagesScanned  = 0
+  RunTotals        = RunTotal{}
+  Whitelist        = nil
+  Blacklist        = nil
+  FolderRuleSets   = nil
+  RunStartTime     = time.Now()
+  RunID            = NewRunID(RunStartTime)
+}
+
+// Read a whitelist file
+func LoadWhitelist(path string) ([]string, error) {
+  return ReadListFile(path, "whitelist")
+}
+
+// Read a blacklist file, returning the phrases and the actions given on their lines
+func LoadBlacklist(path string) (LoadedBlacklist, error) {
+  lines, err := ReadListLines(path, "blacklist")
   if err != nil {
-    log.Fatalf("failed to load blacklist: %v", err)
+    return LoadedBlacklist{}, err
+  }
+  list := LoadedBlacklist{
+    Actions:   map[string]RuleAction{},
+    MaxAges:   map[string]time.Duration{},
+    Originals: map[string]string{},
+  }
+  for n, line := range lines {
+    rule, err := ParseBlacklistLine(line)
+    if err != nil {
+      return LoadedBlacklist{}, fmt.Errorf("blacklist %s line %d: %w", path, n+1, err)
+    }
+    // A rule switched off with action=none is left out entirely
+    if rule.Action.Kind == "none" {
+      continue
+    }
+    variants := []string{rule.Phrase}
+    // If the line contains two or more space-separated words, append another line without spaces
+    if strings.Contains(rule.Phrase, " ") {
+      variants = append(variants, strings.ReplaceAll(rule.Phrase, " ", ""))
+    }
+    for _, phrase := range variants {
+      list.Phrases = append(list.Phrases, phrase)
+      if rule.Action.Kind != "" {
+        list.Actions[phrase] = rule.Action
+      }
+      if rule.MaxAge != 0 {
+        list.MaxAges[phrase] = rule.MaxAge
+      }
+      if _, found := list.Originals[phrase]; !found {
+        list.Originals[phrase] = rule.Phrase
+      }
+    }
+  }
+  return list, nil
+}
+
+// Read a list file, returning each line trimmed and lowercased
+func ReadListFile(path, name string) ([]string, error) {
+  lines, err := ReadListLines(path, name)
+  for i := range lines {
+    lines[i] = strings.ToLower(lines[i])
+  }
+  return lines, err
+}
+
+// Read a list file, returning each line trimmed
+func ReadListLines(path, name string) ([]string, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, fmt.Errorf("failed to load %s %s: %w", name, path, err)
   }
   defer file.Close()
+  var lines []string
   scanner := bufio.NewScanner(file)
   for scanner.Scan() {
     line := scanner.Text()
     line = strings.TrimSpace(line)
-    line = strings.ToLower(line)
-    Blacklist = append(Blacklist, line)
-    // If the line contains two or more space-separated words, append another line without spaces
-    if strings.Contains(line, " ") {
-      Blacklist = append(Blacklist, strings.ReplaceAll(line, " ", ""))
-    }
+    lines = append(lines, line)
   }
   if err := scanner.Err(); err != nil {
-    log.Fatalf("error reading blacklist: %v", err)
+    return nil, fmt.Errorf("error reading %s: %w", name, err)
   }
+  return lines, nil
 }
 
-// Load configuration from config.json
-func LoadConfig() {
-  fmt.Println("*** LoadConfig ***")
-  configFile, err := os.Open("Config.json")
+// Apply the configuration read by ReadConfigFile and resolve the credentials
+func LoadConfig() error {
+  slog.Debug("LoadConfig", "configDir", ConfigDir)
+  var err error
+  server   = Config.Server
+  email    = Config.Email
+  password = ""
+  if err := Config.Connection.Validate(server); err != nil {
+    return err
+  }
+  if err := Config.Move.Validate(); err != nil {
+    return err
+  }
+  if err := Config.Fetch.Validate(); err != nil {
+    return err
+  }
+  if Config.ReportNonASCII {
+    ReportNonASCII = true
+  }
+  if err := ValidateFolders(); err != nil {
+    return err
+  }
+  if err := ParseActions(); err != nil {
+    return err
+  }
+  switch Config.Auth {
+    case "", "password":
+      if password, err = ResolvePassword(); err != nil {
+        return err
+      }
+    case "oauth2":
+      if err := Config.OAuth2.Validate(); err != nil {
+        return err
+      }
+    default:
+      return fmt.Errorf("unknown auth %q in Config.json (want password or oauth2)", Config.Auth)
+  }
+  return nil
+}
+
+// Decode Config.json into Config and resolve the file locations, without resolving any credentials
+func ReadConfigFile() error {
+  path := LocateConfig()
+  configFile, err := os.Open(path)
   if err != nil {
-    log.Fatalf("failed to open Config.json: %v", err)
+    return fmt.Errorf("failed to open config: %w", err)
   }
   defer configFile.Close()
+  Config = ConfigFile{}
   if err := json.NewDecoder(configFile).Decode(&Config); err != nil {
-    log.Fatalf("failed to parse Config.json: %v", err)
+    return fmt.Errorf("failed to parse %s: %w", path, err)
   }
-  server   = Config.Server
-  email    = Config.Email
-  password = Config.Password
+  ResolvePaths(path)
+  return nil
 }
 
 // Connect to the server and login
-func ConnectLogin() {
-  fmt.Println("*** ConnectLogin ***")
-  var err error
-  c, err = client.DialTLS(server, nil)
+func ConnectLogin() error {
+  slog.Debug("ConnectLogin")
+  conn, err := Login()
   if err != nil {
-    fmt.Printf("failed to connect to server: %v\n", err)
-    os.Exit(1)
+    return err
   }
-  if err := c.Login(email, password); err != nil {
-    c.Logout()
-    fmt.Printf("failed to login: %v\n", err)
-    os.Exit(1)
-  }
-  fmt.Println("Connected and logged in successfully")
+  c = conn
+  return nil
 }
 
-// List all available mailboxes
-func ListMailboxes() {
-  fmt.Println("*** ListMailboxes ***")
-  if !ShowMailboxes {
-    return
+// Open and authenticate a new connection. Logins take turns, so concurrent connections
+// share one OAuth2 token refresh.
+func Login() (*client.Client, error) {
+  loginMu.Lock()
+  defer loginMu.Unlock()
+  conn, err := DialIMAP(server, &Config.Connection)
+  if err != nil {
+    CountIMAPError("connect")
+    return nil, fmt.Errorf("failed to connect to server: %w", err)
+  }
+  if Config.Auth == "oauth2" {
+    saslClient, err := OAuth2SASLClient()
+    if err != nil {
+      conn.Logout()
+      return nil, err
+    }
+    if err := conn.Authenticate(saslClient); err != nil {
+      CountIMAPError("login")
+      conn.Logout()
+      return nil, fmt.Errorf("failed to authenticate with %s: %w", Config.OAuth2.Mechanism, err)
+    }
+  } else if err := conn.Login(email, password); err != nil {
+    CountIMAPError("login")
+    conn.Logout()
+    return nil, fmt.Errorf("failed to login: %w", err)
   }
+  slog.Info("Connected and logged in successfully", "server", server, "account", email, "mode", Config.Connection.Mode)
+  return conn, nil
+}
+
+// List all available mailboxes into Mailboxes
+func ListMailboxes() error {
+  slog.Debug("ListMailboxes")
+  Mailboxes = nil
   mailboxes := make(chan *imap.MailboxInfo, 10)
   done := make(chan error, 1)
   go func() {
     done <- c.List("", "*", mailboxes)
   }()
-  fmt.Println("Available mailboxes:")
   for m := range mailboxes {
-    fmt.Println("-", m.Name)
+    Mailboxes = append(Mailboxes, m)
+    if ShowMailboxes {
+      slog.Info("Available mailbox", "name", m.Name, "attributes", m.Attributes)
+    }
   }
   if err := <-done; err != nil {
-    fmt.Printf("failed to list mailboxes: %v\n", err)
-    os.Exit(1)
+    CountIMAPError("list")
+    return fmt.Errorf("failed to list mailboxes: %w", err)
   }
+  return nil
 }
 
 // Select the specified mailbox and checks for messages
-func SelectMailbox() {
-  fmt.Println("*** SelectMailbox ***")
-  mbox, err := c.Select(SelectFolder, false)
+func SelectMailbox() error {
+  slog.Debug("SelectMailbox")
+  var mbox *imap.MailboxStatus
+  err := WithReconnect("select", func() (err error) {
+    mbox, err = c.Select(SelectFolder, false)
+    return err
+  })
   if err != nil {
-    fmt.Printf("failed to select mailbox %s: %v\n", SelectFolder, err)
-    os.Exit(1)
+    CountIMAPError("select")
+    return fmt.Errorf("failed to select mailbox %s: %w", SelectFolder, err)
   }
   if mbox.Messages == 0 {
-    fmt.Println("No messages in the mailbox.")
-    os.Exit(0)
+    return ErrNoMessages
   }
-  fmt.Printf("Flags for %s: %v\n", SelectFolder, mbox.Flags)
+  slog.Info("Mailbox selected", "folder", SelectFolder, "messages", mbox.Messages, "flags", mbox.Flags)
   mailbox = mbox
+  return nil
 }
 
-// Fetch and store emails with optional filtering
-func FetchAndStoreEmails() {
-  fmt.Println("*** FetchAndStoreEmails ***")
-  seqset := new(imap.SeqSet)
-  seqset.AddRange(1, mailbox.Messages)
+// Fetch every message once and pass it through the pipeline stages, storing the matches
+func FetchAndStoreEmails() error {
+  slog.Debug("FetchAndStoreEmails")
+  err := RunPipeline(PrimarySession(), PipelineStages(), nil)
+  Tracing = false
+  return err
+}
 
-  messages := make(chan *imap.Message, mailbox.Messages)
-  done := make(chan error, 1)
-  go func() {
-    done <- c.Fetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate, imap.FetchEnvelope}, messages)
-  }()
-  for msg := range messages {
-    DebugUid = 0
-    gotMatch := false // Initialize GotMatch to false for each message
-    for _, filterPhrase := range Blacklist {
-      if MatchFilter(msg, filterPhrase) {
-        gotMatch = true // Set GotMatch to true if a match is found
-        break          // Exit the loop early since we found a match
-      }
+// Match one message against the whitelist and blacklist and store it if it matched
+func MatchMessage(msg *imap.Message) {
+  // SEARCH only narrows to whole days, so the exact edge of the window is checked here
+  if TooOld(msg, AgeCutoff(Config.Fetch.maxAge)) {
+    Trace("decision", "uid", msg.Uid, "action", "skip", "reason", "older than fetch.maxAge")
+    return
+  }
+  gotMatch := false // Initialize GotMatch to false for each message
+  matchedPhrase := ""
+  for _, filterPhrase := range Blacklist {
+    if MatchFilter(msg, filterPhrase) {
+      gotMatch = true // Set GotMatch to true if a match is found
+      matchedPhrase = filterPhrase
+      break          // Exit the loop early since we found a match
     }
-    if !gotMatch {
-      continue // Skip to the next message if no match was found
+  }
+  if !gotMatch {
+    Trace("decision", "uid", msg.Uid, "action", "keep")
+    if CheckedKeyword != "" {
+      KeptUIDs = append(KeptUIDs, msg.Uid)
     }
-    // Got a match, so we're going to send it to trash
-    from := "Unknown"
-    personalName := msg.Envelope.From[0].PersonalName
-    emailAddress := fmt.Sprintf("%s@%s", msg.Envelope.From[0].MailboxName, msg.Envelope.From[0].HostName)
-    if personalName != "" {
-      from = fmt.Sprintf("%s <%s>", personalName, emailAddress)
-    } else {
-      from = emailAddress
+    return // Skip to the next message if no match was found
+  }
+  action := ResolveAction(ActionForRule(MatchedRule), TrashCode)
+  // A rule whose action is "none" keeps the message, as if nothing had matched
+  if action.Kind == "none" {
+    Trace("decision", "uid", msg.Uid, "action", "keep", "reason", "action none", "rule", MatchedRule)
+    if CheckedKeyword != "" {
+      KeptUIDs = append(KeptUIDs, msg.Uid)
     }
-    // Add the email to the global in-memory data structure
-    MatchingEmails = append(MatchingEmails, Email{
-      UID:         msg.Uid,
-      From:        from,
-      Subject:     msg.Envelope.Subject,
-      InternalDate: msg.InternalDate.Format("2006-01-02 15:04:05"),
-      TrashCode:   TrashCode,
-    })
+    return
   }
-  // Check for fetch errors
-  if err := <-done; err != nil {
-    log.Fatal(err)
+  // A message tagged or flagged by an earlier run stays where it is and is not counted again
+  if AlreadyApplied(msg, action) {
+    Trace("decision", "uid", msg.Uid, "action", "keep", "reason", "already "+action.String())
+    if CheckedKeyword != "" {
+      KeptUIDs = append(KeptUIDs, msg.Uid)
+    }
+    return
+  }
+  if MatchedRule != "" {
+    IncrementTrashMetric(MatchedRule, TrashCode)
   }
+  Trace("decision", "uid", msg.Uid, "action", action.String(), "trashCode", TrashCode, "phrase", matchedPhrase, "rule", MatchedRule)
+  // Got a match, so we're going to apply the rule's action
+  from := "Unknown"
+  personalName := msg.Envelope.From[0].PersonalName
+  emailAddress := fmt.Sprintf("%s@%s", msg.Envelope.From[0].MailboxName, msg.Envelope.From[0].HostName)
+  if personalName != "" {
+    from = fmt.Sprintf("%s <%s>", personalName, emailAddress)
+  } else {
+    from = emailAddress
+  }
+  // Add the email to the global in-memory data structure
+  MatchingEmails = append(MatchingEmails, Email{
+    UID:         msg.Uid,
+    From:        from,
+    Subject:     msg.Envelope.Subject,
+    InternalDate: msg.InternalDate.Format("2006-01-02 15:04:05"),
+    TrashCode:   TrashCode,
+    Rule:        MatchedRule,
+    Phrase:      OriginalPhrase(MatchedRule),
+    Action:      action,
+    MessageID:   msg.Envelope.MessageId,
+  })
 }
 
 // Helper function to check if an email matches the filter phrases
@@ -257,18 +569,27 @@ func MatchFilter(msg *imap.Message, filterPhrase string) bool {
   // Build sender email/domain once
   emailAddress, fromDomain, ok := BuildFromEmailAddress(msg)
   if ok {
-    if IsWhitelisted(emailAddress, fromDomain) {
+    if entry := WhitelistEntry(emailAddress, fromDomain); entry != "" {
+      Trace("rule", "uid", msg.Uid, "phrase", filterPhrase, "check", "whitelist", "entry", entry, "matched", true)
       return false // never trash whitelisted senders
     }
 
     // NOTE: keeping your current behavior:
-    // if sender is not whitelisted, it is automatically matched/trash-coded as 1.
-    TrashCode = 1
-    IncrementTrashMetric("NotWhiteList", 1)
-    return true
+    // if sender is not whitelisted, it is automatically matched/trash-coded as 1,
+    // unless that rule is switched off with "notWhitelisted": "none".
+    if NotWhitelistedAction.Kind != "none" {
+      TraceCheck(msg, filterPhrase, "notWhitelisted", emailAddress, true, 1)
+      TrashCode = 1
+      MatchedRule = "NotWhiteList"
+      return true
+    }
   }
+  // A phrase with its own maxAge leaves older messages alone, but only its own comparisons
+  tooOld := TooOld(msg, AgeCutoff(BlacklistMaxAges[filterPhrase]))
   // If the filter phrase is empty, match all emails
-  if filterPhrase == "" {
+  if filterPhrase == "" && !tooOld {
+    TraceCheck(msg, filterPhrase, "emptyPhrase", "", true, TrashCode)
+    MatchedRule = filterPhrase
     return true
   }
   // Ensure the message envelope is not nil
@@ -284,31 +605,44 @@ func MatchFilter(msg *imap.Message, filterPhrase string) bool {
     return false
   }
   // Check for unacceptable characters in PersonalName
+  // (both checks are skipped when the rule is switched off with "unacceptable": "none")
   personalName := msg.Envelope.From[0].PersonalName
-  if ContainsUnacceptable(personalName) {
+  checkUnacceptable := UnacceptableAction.Kind != "none"
+  matched := checkUnacceptable && ContainsUnacceptable(personalName)
+  TraceCheck(msg, filterPhrase, "unacceptableName", personalName, matched, 1)
+  if matched {
     TrashCode = 1
-    IncrementTrashMetric("Unacceptable", 1)
+    MatchedRule = "Unacceptable"
     return true
   }
   // Check for unacceptable characters in Subject
-  if ContainsUnacceptable(msg.Envelope.Subject) {
+  matched = checkUnacceptable && ContainsUnacceptable(msg.Envelope.Subject)
+  TraceCheck(msg, filterPhrase, "unacceptableSubject", msg.Envelope.Subject, matched, 2)
+  if matched {
     TrashCode = 2
-    IncrementTrashMetric("Unacceptable", 2)
+    MatchedRule = "Unacceptable"
     return true
   }
+  if tooOld {
+    TraceCheck(msg, filterPhrase, "maxAge", MessageDate(msg).Format(time.RFC3339), false, 0)
+    return false
+  }
   // Check if the PersonalName contains the filter phrase (case-insensitive)
   personalName = strings.ToLower(ConvertStyledToASCII(personalName))
-  if strings.Contains(personalName, filterPhrase) {
+  matched = strings.Contains(personalName, filterPhrase)
+  TraceCheck(msg, filterPhrase, "personalName", personalName, matched, 3)
+  if matched {
     TrashCode = 3
-    IncrementTrashMetric(filterPhrase, 3)
+    MatchedRule = filterPhrase
     return true
   }
   // Check if the subject contains the filter phrase (case-insensitive)
   subject := strings.ToLower(ConvertStyledToASCII(msg.Envelope.Subject))
-  DebugSubject(personalName, subject, msg, "put trouble email address here")
-  if strings.Contains(subject, filterPhrase) {
+  matched = strings.Contains(subject, filterPhrase)
+  TraceCheck(msg, filterPhrase, "subject", subject, matched, 4)
+  if matched {
     TrashCode = 4
-    IncrementTrashMetric(filterPhrase, 4)
+    MatchedRule = filterPhrase
     return true
   }
   // Check if the From Email Address contains the filter phrase (case-insensitive)
@@ -319,9 +653,11 @@ func MatchFilter(msg *imap.Message, filterPhrase string) bool {
       strings.ToLower(msg.Envelope.From[0].HostName),
     )
   }
-  if strings.Contains(emailAddress, filterPhrase) {
+  matched = strings.Contains(emailAddress, filterPhrase)
+  TraceCheck(msg, filterPhrase, "emailAddress", emailAddress, matched, 5)
+  if matched {
     TrashCode = 5
-    IncrementTrashMetric(filterPhrase, 5)
+    MatchedRule = filterPhrase
     return true
   }
   // Fall through to return false if no match is found
@@ -358,6 +694,7 @@ func IsEmoji(r rune) bool {
 }
 
 // Replace styled Unicode characters (e.g., Mathematical Monospace, Bold) with their ASCII equivalents
+// (a change to what this returns needs a new NormalizationVersion)
 func ConvertStyledToASCII(input string) string {
   var builder strings.Builder
   for _, r := range input {
@@ -395,84 +732,189 @@ func SortEmails() {
 
 // List matching emails
 func ListMatchingEmails() {
-  fmt.Println("Matching Emails:")
+  slog.Info("Matching emails", "count", len(MatchingEmails))
   SortEmails()
   for _, email := range MatchingEmails {
-    fmt.Printf("TrashCode: %d, UID: %d, From: %s, Subject: %s, InternalDate: %s\n", email.TrashCode, email.UID, email.From, email.Subject, email.InternalDate)
+    slog.Info("Matching email", "trashCode", email.TrashCode, "action", email.Action.String(), "uid", email.UID, "from", email.From, "subject", email.Subject, "internalDate", email.InternalDate)
   }
 }
 
-// Move emails in the Email struct from the INBOX to the TrashFolder
-func MoveToTrash() {
+// Apply each matching email's action: move to Trash, Junk or another folder, or flag it in place
+func MoveToTrash() error {
   if !DoMoveToTrash {
-    fmt.Println("DoMoveToTrash is disabled. Skipping MoveToTrash.")
-    return
+    slog.Info("DoMoveToTrash is disabled. Skipping MoveToTrash.")
+    return nil
   }
-  fmt.Println("*** MoveToTrash ***")
+  slog.Debug("MoveToTrash")
   if len(MatchingEmails) == 0 {
-    fmt.Println("No emails to move to trash.")
-    return
+    slog.Info("No emails to move to trash.")
+    return nil
   }
-  // Reselect the mailbox to refresh its state
-  mbox, err := c.Select(SelectFolder, false)
+  // Reselect the mailbox to refresh its state, reconnecting if the connection dropped since the fetch
+  var mbox *imap.MailboxStatus
+  err := WithReconnect("select", func() (err error) {
+    mbox, err = c.Select(SelectFolder, false)
+    return err
+  })
   if err != nil {
-    log.Fatalf("failed to reselect mailbox %s: %v", SelectFolder, err)
+    CountIMAPError("select")
+    return fmt.Errorf("failed to reselect mailbox %s: %w", SelectFolder, err)
   }
-  log.Printf("Mailbox %s reselected. Total messages: %d", SelectFolder, mbox.Messages)
-  seqset := new(imap.SeqSet)
-  for _, email := range MatchingEmails {
-    log.Printf("Adding UID to sequence set: %d", email.UID)
-    seqset.AddNum(email.UID)
+  slog.Info("Mailbox reselected", "folder", SelectFolder, "messages", mbox.Messages)
+  // Messages copied elsewhere are deleted from the source at the end
+  deleteSet := new(imap.SeqSet)
+  var destinations []string
+  // A failed copy or keyword store stops the remaining groups, but what was already copied is still deleted
+  var copyErr error
+  groups := GroupByAction(MatchingEmails)
+  // Written before anything is copied, so an interrupted move is finished by the next run
+  journal, err := StartJournal(mbox.UidValidity, groups)
+  if err != nil {
+    return err
   }
-  if seqset.Empty() {
-    log.Println("Sequence set is empty. No valid UIDs to process.")
-    return
+  for _, group := range groups {
+    slog.Info("Applying action", "action", group.Action.String(), "count", group.Count, "folder", group.Action.Destination())
+    if err := ApplyKeywords(group); err != nil {
+      copyErr = err
+      break
+    }
+    if group.Action.Kind == "flag" || group.Action.Kind == "tag" {
+      continue
+    }
+    destination := group.Action.Destination()
+    destinations = append(destinations, destination)
+    copied, err := CopyChunks(group.UIDs, destination)
+    deleteSet.AddSet(copied)
+    if err != nil {
+      copyErr = err
+      break
+    }
   }
-  // Debugging: Log the sequence set before processing
-  log.Printf("Sequence set for processing: %s", seqset.String())
-  // Split the sequence set into smaller chunks to avoid rate limits
-  chunks := SplitSequenceSet(seqset, 10) // Adjust chunk size as needed
-  for i, chunk := range chunks {
-    log.Printf("Processing chunk %d: %s", i+1, chunk.String())
-    // Copy emails to the Trash folder
-    if err := c.UidCopy(chunk, TrashFolder); err != nil {
-      log.Printf("FATAL: chunk %d copy to %s failed: %s (%v)", i+1, TrashFolder, chunk.String(), err)
-      // Show status of Trash/Bulk
-      VerifyFolderCounts(TrashFolder, "Trash/Bulk Mail")
-      // Clean logout before exiting
-      CloseConnection()
-      os.Exit(1)
+  MovedUIDs = deleteSet
+  if len(destinations) > 0 {
+    VerifyFolderCounts(append(destinations, "Trash/Bulk Mail")...)
+  }
+  if deleteSet.Empty() {
+    if journal != nil {
+      RemoveJournal(email)
     }
-    log.Printf("Processed chunk %d: %s", i+1, chunk.String())
-    // Introduce a small delay to avoid rate limits
-    time.Sleep(2 * time.Second)
+    return copyErr
+  }
+  if copyErr != nil {
+    slog.Warn("Move incomplete; removing only the messages that were copied", "uids", deleteSet.String(), "err", copyErr)
+    journal.Keep(deleteSet)
+  }
+  if err := WriteMoveRecords(deleteSet); err != nil {
+    slog.Warn("failed to record moved messages; undo will not find them", "err", err)
+  }
+  // Dying before this is saved records the moves twice on resume; a duplicate beats a lost record
+  journal.Recorded = true
+  if err := journal.Advance("copied"); err != nil {
+    slog.Warn("failed to update move journal", "err", err)
   }
-  VerifyFolderCounts(TrashFolder, "Trash/Bulk Mail")
-  // Reselect INBOX so session state is clean
-  _, err = c.Select(SelectFolder, false)
+  // Reselect the source folder: the deletes below must not land in a destination folder. If it
+  // cannot be selected, the journal finishes the move on the next run.
+  err = WithReconnect("select", func() error {
+    _, err := c.Select(SelectFolder, false)
+    return err
+  })
   if err != nil {
-    log.Printf("failed to reselect %s after folder verification: %v", SelectFolder, err)
+    CountIMAPError("select")
+    return errors.Join(copyErr, fmt.Errorf("failed to reselect mailbox %s after copying: %w", SelectFolder, err))
   }
   // Mark original emails as deleted
   storeFlags := []interface{}{imap.DeletedFlag}
   item := imap.FormatFlagsOp(imap.AddFlags, true)
-  if err := c.UidStore(seqset, item, storeFlags, nil); err != nil {
-    log.Printf("failed to mark emails as deleted: %v", err)
-    return
+  if err := WithReconnect("store", func() error { return c.UidStore(deleteSet, item, storeFlags, nil) }); err != nil {
+    CountIMAPError("store")
+    slog.Error("failed to mark emails as deleted", "err", err)
+    return copyErr
   }
-// Expunge deleted emails
-if err := c.Expunge(nil); err != nil {
-  log.Printf("failed to expunge emails: %v", err)
-  return
+  // Expunge only the moved emails; messages the user marked \Deleted are left for their client
+  err = WithReconnect("expunge", func() error {
+    uidplus, _ := c.Support("UIDPLUS")
+    return ExpungeUIDs(deleteSet, uidplus)
+  })
+  if err != nil {
+    CountIMAPError("expunge")
+    slog.Error("failed to expunge emails", "err", err)
+    return copyErr
+  }
+  RemoveJournal(email)
+  // Confirm INBOX count after expunge
+  err = WithReconnect("select", func() (err error) {
+    mbox, err = c.Select(SelectFolder, false)
+    return err
+  })
+  if err != nil {
+    slog.Warn("failed to reselect mailbox after expunge", "folder", SelectFolder, "err", err)
+  } else {
+    slog.Info("Post-expunge mailbox count", "folder", SelectFolder, "messages", mbox.Messages)
+  }
+  if copyErr != nil {
+    return copyErr
+  }
+  slog.Info("Emails moved successfully", "count", len(MatchingEmails), "folders", destinations)
+  return nil
+}
+
+// ActionGroup is the set of matching emails that share one action
+type ActionGroup struct {
+  Action RuleAction
+  UIDs   *imap.SeqSet
+  Count  int
 }
-// Confirm INBOX count after expunge
-mbox, err = c.Select(SelectFolder, false)
-if err != nil {
-  log.Printf("failed to reselect %s after expunge: %v", SelectFolder, err)
-} else {
-  log.Printf("Post-expunge: %s now contains %d messages.", SelectFolder, mbox.Messages)
+
+// Group emails by action, in the order each action first appears
+func GroupByAction(emails []Email) []*ActionGroup {
+  var groups []*ActionGroup
+  index := map[RuleAction]*ActionGroup{}
+  for _, email := range emails {
+    group := index[email.Action]
+    if group == nil {
+      group = &ActionGroup{Action: email.Action, UIDs: new(imap.SeqSet)}
+      index[email.Action] = group
+      groups = append(groups, group)
+    }
+    slog.Debug("Adding UID to sequence set", "uid", email.UID, "action", email.Action.String())
+    group.UIDs.AddNum(email.UID)
+    group.Count++
+  }
+  return groups
 }
-log.Printf("%d emails moved to trash successfully.", len(MatchingEmails))
+
+// Set the keywords an action asks for on the source messages, so they travel with any copy
+func ApplyKeywords(group *ActionGroup) error {
+  var add, remove []interface{}
+  switch group.Action.Kind {
+    case "junk":
+      add = []interface{}{JunkKeyword}
+      remove = []interface{}{NotJunkKeyword}
+    case "flag":
+      add = []interface{}{imap.FlaggedFlag, JunkKeyword}
+      remove = []interface{}{NotJunkKeyword}
+    case "tag":
+      add = TagFlags(group.Action)
+    default:
+      return nil
+  }
+  if err := c.UidStore(group.UIDs, imap.FormatFlagsOp(imap.AddFlags, true), add, nil); err != nil {
+    CountIMAPError("store")
+    // Servers that do not accept keywords can still move the messages
+    if group.Action.Kind == "flag" || group.Action.Kind == "tag" {
+      return fmt.Errorf("failed to flag messages: %w", err)
+    }
+    slog.Warn("failed to set keywords; moving without them", "keywords", add, "err", err)
+    return nil
+  }
+  if len(remove) == 0 {
+    return nil
+  }
+  if err := c.UidStore(group.UIDs, imap.FormatFlagsOp(imap.RemoveFlags, true), remove, nil); err != nil {
+    CountIMAPError("store")
+    slog.Warn("failed to clear keywords", "keywords", remove, "err", err)
+  }
+  return nil
 }
 
 // Helper function to split a sequence set into smaller chunks
@@ -553,58 +995,53 @@ func SplitSequenceSet(in *imap.SeqSet, chunkSize uint32) []*imap.SeqSet {
   return out
 }
 
-// Debug function to verify folder accessibility
-func VerifyFolderAccess() {
-  fmt.Printf("Verifying access to folder: %s\n", TrashFolder)
-  mbox, err := c.Select(TrashFolder, false)
+// Debug function to verify the destination folders are accessible
+func VerifyFolderAccess() error {
+  folders, err := DestinationFolders()
   if err != nil {
-    log.Fatalf("failed to access folder %s: %v", TrashFolder, err)
+    return err
+  }
+  for _, folder := range folders {
+    slog.Debug("Verifying access to folder", "folder", folder)
+    mbox, err := c.Select(folder, false)
+    if err != nil {
+      CountIMAPError("select")
+      return fmt.Errorf("failed to access folder %s: %w", folder, err)
+    }
+    slog.Info("Access to folder verified", "folder", folder, "messages", mbox.Messages)
   }
-  fmt.Printf("Access to folder %s verified. Total messages: %d\n", TrashFolder, mbox.Messages)
+  return nil
 }
 
 // Explicitly close the IMAP connection
 func CloseConnection() {
-  fmt.Println("*** CloseConnection ***")
+  slog.Debug("CloseConnection")
   if c == nil {
     return
   }
   if err := c.Logout(); err != nil {
-    fmt.Printf("failed to logout: %v\n", err)
-    os.Exit(1)
+    slog.Warn("failed to logout", "err", err)
   }
+  c = nil
 }
 
-// Loop through the messages in the inbox, converts the PersonalName and Subject to ASCII, and validates if they are ASCII characters.
-func CheckConvertStyledToASCII() {
-  fmt.Println("*** CheckConvertStyledToASCII ***")
-  seqset := new(imap.SeqSet)
-  seqset.AddRange(1, mailbox.Messages)
-  messages := make(chan *imap.Message, mailbox.Messages)
-  done := make(chan error, 1)
-  go func() {
-    done <- c.Fetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate, imap.FetchEnvelope}, messages)
-  }()
-  for msg := range messages {
-    if msg.Envelope == nil || len(msg.Envelope.From) == 0 {
-      continue // Skip messages with no envelope or sender
-    }
-    personalName := ConvertStyledToASCII(msg.Envelope.From[0].PersonalName)
-    subject := ConvertStyledToASCII(msg.Envelope.Subject)
-    if !isASCII(personalName) || !isASCII(subject) {
-      from := "Unknown"
-      emailAddress := fmt.Sprintf("%s@%s", msg.Envelope.From[0].MailboxName, msg.Envelope.From[0].HostName)
-      if msg.Envelope.From[0].PersonalName != "" {
-        from = fmt.Sprintf("%s <%s>", msg.Envelope.From[0].PersonalName, emailAddress)
-      } else {
-        from = emailAddress
-      }
-      fmt.Printf("UID: %d, From: %s, Subject: %s, InternalDate: %s\n",
-        msg.Uid, from, msg.Envelope.Subject, msg.InternalDate.Format("2006-01-02 15:04:05"))
-    }
+// Convert a message's PersonalName and Subject to ASCII and log it if they still are not ASCII
+func CheckConvertStyledToASCII(msg *imap.Message) {
+  if msg.Envelope == nil || len(msg.Envelope.From) == 0 {
+    return // Skip messages with no envelope or sender
   }
-  if err := <-done; err != nil {
-    log.Fatal(err)
+  personalName := ConvertStyledToASCII(msg.Envelope.From[0].PersonalName)
+  subject := ConvertStyledToASCII(msg.Envelope.Subject)
+  if !isASCII(personalName) || !isASCII(subject) {
+    from := "Unknown"
+    emailAddress := fmt.Sprintf("%s@%s", msg.Envelope.From[0].MailboxName, msg.Envelope.From[0].HostName)
+    if msg.Envelope.From[0].PersonalName != "" {
+      from = fmt.Sprintf("%s <%s>", msg.Envelope.From[0].PersonalName, emailAddress)
+    } else {
+      from = emailAddress
+    }
+    slog.Info("Non-ASCII after normalization", "uid", msg.Uid, "from", from, "subject", msg.Envelope.Subject,
+      "internalDate", msg.InternalDate.Format("2006-01-02 15:04:05"))
   }
 }
 
@@ -618,36 +1055,45 @@ func isASCII(input string) bool {
   return true
 }
 
-// Log the subject before and after normalization for a specific email address
-func DebugSubject(PersonalName string, subject string, msg *imap.Message, targetEmail string) {
-  if targetEmail == DebugEmail {
-    return
+// Log the PersonalName and Subject before and after normalization at debug level,
+// or at info level for a message selected by --trace
+func LogNormalization(msg *imap.Message) {
+  level, label := slog.LevelDebug, "Normalization"
+  if Tracing {
+    level, label = LevelTrace, "trace: normalization"
   }
-  if DebugUid == msg.Uid {
+  if !slog.Default().Enabled(context.Background(), level) {
     return
   }
-  DebugUid = msg.Uid
-  if len(msg.Envelope.From) > 0 {
-    emailAddress := fmt.Sprintf("%s@%s", msg.Envelope.From[0].MailboxName, msg.Envelope.From[0].HostName)
-    if emailAddress == targetEmail {
-      log.Printf("PersonalName before normalization: %s", msg.Envelope.From[0].PersonalName)
-      log.Printf("PersonalName after normalization: %s", PersonalName)
-      log.Printf("Subject before normalization: %s", msg.Envelope.Subject)
-      log.Printf("Subject after normalization: %s", subject)
-    }
+  if msg.Envelope == nil || len(msg.Envelope.From) == 0 {
+    return
   }
+  personalName := msg.Envelope.From[0].PersonalName
+  slog.Log(context.Background(), level, label,
+    "uid", msg.Uid,
+    "from", fmt.Sprintf("%s@%s", msg.Envelope.From[0].MailboxName, msg.Envelope.From[0].HostName),
+    "personalNameBefore", personalName,
+    "personalNameAfter", strings.ToLower(ConvertStyledToASCII(personalName)),
+    "subjectBefore", msg.Envelope.Subject,
+    "subjectAfter", strings.ToLower(ConvertStyledToASCII(msg.Envelope.Subject)),
+  )
 }
 
 // Initialize TrashMetrics with entries from the Blacklist
 func InitTrashMetrics() {
-  fmt.Println("*** InitTrashMetrics ***")
+  slog.Debug("InitTrashMetrics")
   TrashMetrics = append(TrashMetrics, TrashMetric{
-    FilterPhrase: "Unprintable",
+    FilterPhrase: "NotWhiteList",
     TrashCode:    byte(1),
     Count:        0,
   })
   TrashMetrics = append(TrashMetrics, TrashMetric{
-    FilterPhrase: "Unprintable",
+    FilterPhrase: "Unacceptable",
+    TrashCode:    byte(1),
+    Count:        0,
+  })
+  TrashMetrics = append(TrashMetrics, TrashMetric{
+    FilterPhrase: "Unacceptable",
     TrashCode:    byte(2),
     Count:        0,
   })
@@ -662,36 +1108,21 @@ func InitTrashMetrics() {
   }
 }
 
-// Increment TrashMetrics
+// Increment TrashMetrics, adding an entry if this phrase and code have not been seen
 func IncrementTrashMetric(filterPhrase string, trashCode byte) {
   for i := range TrashMetrics {
     if TrashMetrics[i].FilterPhrase == filterPhrase {
       if TrashMetrics[i].TrashCode == trashCode {
         TrashMetrics[i].Count++
-        break
-      }
-    }
-  }
-}
-
-// Write non-zero TrashMetrics
-func WriteTrashMetrics() {
-  fmt.Println("*** WriteTrashMetrics ***")
-  file, err := os.OpenFile("TrashMetrics.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-  if err != nil {
-    log.Fatalf("failed to open TrashMetrics.txt: %v", err)
-  }
-  defer file.Close()
-  writer := bufio.NewWriter(file)
-  for _, metric := range TrashMetrics {
-    if metric.Count > 0 {
-      _, err := writer.WriteString(fmt.Sprintf("%s, %s, %d, %d\n", ProgramStartTime, metric.FilterPhrase, metric.TrashCode, metric.Count))
-      if err != nil {
-        log.Fatalf("failed to write to TrashMetrics.txt: %v", err)
+        return
       }
     }
   }
-  writer.Flush()
+  TrashMetrics = append(TrashMetrics, TrashMetric{
+    FilterPhrase: filterPhrase,
+    TrashCode:    trashCode,
+    Count:        1,
+  })
 }
 
 //
@@ -737,13 +1168,16 @@ func NormalizeCyrillic(r rune) rune {
 // VerifyFolderCounts selects the given folders and logs their message counts.
 // This is read-only and does not modify any messages.
 func VerifyFolderCounts(folders ...string) {
+  if c == nil {
+    return
+  }
   for _, folder := range folders {
     mbox, err := c.Select(folder, false)
     if err != nil {
-      log.Printf("VerifyFolderCounts: failed to select %s: %v", folder, err)
+      slog.Warn("VerifyFolderCounts: failed to select folder", "folder", folder, "err", err)
       continue
     }
-    log.Printf("VerifyFolderCounts: %s contains %d messages.", folder, mbox.Messages)
+    slog.Info("VerifyFolderCounts", "folder", folder, "messages", mbox.Messages)
   }
 }
 
@@ -770,6 +1204,11 @@ func BuildFromEmailAddress(msg *imap.Message) (emailAddress string, domain strin
 //      wellsfargo.com, notify.wellsfargo.com, mail-wellsfargo.com
 //    but NOT wellsfargo.somejunk.com
 func IsWhitelisted(emailAddress, fromDomain string) bool {
+  return WhitelistEntry(emailAddress, fromDomain) != ""
+}
+
+// WhitelistEntry returns the whitelist entry that matches the sender, or "" if none does
+func WhitelistEntry(emailAddress, fromDomain string) string {
   for _, w := range Whitelist {
     w = strings.TrimSpace(strings.ToLower(w))
     if w == "" {
@@ -779,7 +1218,7 @@ func IsWhitelisted(emailAddress, fromDomain string) bool {
     // 1) Full email match
     if strings.Contains(w, "@") {
       if emailAddress == w {
-        return true
+        return w
       }
       continue
     }
@@ -788,15 +1227,15 @@ func IsWhitelisted(emailAddress, fromDomain string) bool {
     if strings.HasPrefix(w, "*") {
         base := strings.TrimPrefix(w, "*")
         if base != "" && strings.HasSuffix(fromDomain, base) {
-            return true
+            return w
         }
         continue
     }
 
     // 3) Exact domain match: "gmail.com"
     if fromDomain == w {
-      return true
+      return w
     }
   }
-  return false
+  return ""
 }
\ No newline at end of file
@@ -0,0 +1,170 @@
+package main
+
+import (
+  "bufio"
+  "crypto/rand"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "slices"
+  "time"
+)
+
+var (
+  // JSON Lines file that receives one RunMetrics record per run, see ResolvePaths
+  MetricsFile = "Metrics.jsonl"
+  // Totals across the folders of the current run, logged as the run summary
+  RunTotals RunTotal
+)
+
+// RunTotal adds up the per-folder records of one run
+type RunTotal struct {
+  Folders int
+  Scanned int
+  Kept    int
+  Trashed int
+  Tagged  int
+}
+
+// RunMetrics is the record written to MetricsFile at the end of each run
+type RunMetrics struct {
+  RunID      string         `json:"runId"`
+  Time       time.Time      `json:"time"`
+  Account    string         `json:"account"`
+  Folder     string         `json:"folder"`
+  Scanned    int            `json:"scanned"`
+  Kept       int            `json:"kept"`
+  Trashed    int            `json:"trashed"`          // moved out of the folder
+  Tagged     int            `json:"tagged,omitempty"` // flagged or tagged and left in the folder
+  Skipped    int            `json:"skipped,omitempty"` // not fetched: already checked, ruled out by the prefilter or older than fetch.maxAge
+  Rules      []RuleCount    `json:"rules,omitempty"`
+  Actions    map[string]int `json:"actions,omitempty"` // matched messages by action, e.g. "junk": 3
+  DurationMs int64          `json:"durationMs"`
+  Error      string         `json:"error,omitempty"`
+}
+
+// RuleCount is the number of messages one rule trashed during a run
+type RuleCount struct {
+  Phrase    string `json:"phrase"`
+  TrashCode byte   `json:"trashCode"`
+  Count     int    `json:"count"`
+}
+
+// Create a sortable, unique run ID such as 20260102-150405-1a2b3c
+func NewRunID(start time.Time) string {
+  suffix := make([]byte, 3)
+  rand.Read(suffix)
+  return start.Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// Append the current folder's metrics to MetricsFile; runErr is recorded if the folder did not complete
+func WriteRunMetrics(runErr error) error {
+  slog.Debug("WriteRunMetrics")
+  record := RunMetrics{
+    RunID:      RunID,
+    Time:       RunStartTime,
+    Account:    email,
+    Folder:     SelectFolder,
+    Scanned:    MessagesScanned,
+    Kept:       MessagesScanned - len(MatchingEmails),
+    DurationMs: time.Since(FolderStartTime).Milliseconds(),
+  }
+  if (CheckedKeyword != "" || Config.Fetch.Prefilter || AgeWindowActive()) && mailbox != nil {
+    record.Skipped = max(int(mailbox.Messages)-MessagesScanned, 0)
+  }
+  for _, metric := range TrashMetrics {
+    if metric.Count > 0 {
+      record.Rules = append(record.Rules, RuleCount{
+        Phrase:    metric.FilterPhrase,
+        TrashCode: metric.TrashCode,
+        Count:     metric.Count,
+      })
+    }
+  }
+  for _, email := range MatchingEmails {
+    if email.Action.Destination() == "" {
+      record.Tagged++
+    } else {
+      record.Trashed++
+    }
+    if record.Actions == nil {
+      record.Actions = map[string]int{}
+    }
+    record.Actions[email.Action.String()]++
+  }
+  if runErr != nil {
+    record.Error = runErr.Error()
+  }
+  line, err := json.Marshal(record)
+  if err != nil {
+    return fmt.Errorf("failed to encode run metrics: %w", err)
+  }
+  if err := MakeParentDir(MetricsFile); err != nil {
+    return fmt.Errorf("failed to create directory for %s: %w", MetricsFile, err)
+  }
+  file, err := os.OpenFile(MetricsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+  if err != nil {
+    return fmt.Errorf("failed to open %s: %w", MetricsFile, err)
+  }
+  defer file.Close()
+  if _, err := file.Write(append(line, '\n')); err != nil {
+    return fmt.Errorf("failed to write to %s: %w", MetricsFile, err)
+  }
+  ExportRunMetrics(record, MovedRuleCounts())
+  RunTotals.Folders++
+  RunTotals.Scanned += record.Scanned
+  RunTotals.Kept += record.Kept
+  RunTotals.Trashed += record.Trashed
+  RunTotals.Tagged += record.Tagged
+  slog.Info("Run metrics recorded", "runId", RunID, "scanned", record.Scanned, "kept", record.Kept, "trashed", record.Trashed, "tagged", record.Tagged)
+  return nil
+}
+
+// Count the messages each rule moved out of the folder; flagged, tagged and uncopied matches are left out
+func MovedRuleCounts() []RuleCount {
+  var counts []RuleCount
+  for _, email := range MatchingEmails {
+    if email.Action.Destination() == "" || MovedUIDs == nil || !MovedUIDs.Contains(email.UID) {
+      continue
+    }
+    i := slices.IndexFunc(counts, func(c RuleCount) bool { return c.Phrase == email.Rule && c.TrashCode == email.TrashCode })
+    if i < 0 {
+      counts = append(counts, RuleCount{Phrase: email.Rule, TrashCode: email.TrashCode})
+      i = len(counts) - 1
+    }
+    counts[i].Count++
+  }
+  return counts
+}
+
+// Read every record in MetricsFile, skipping lines that do not parse
+func ReadRunMetrics() ([]RunMetrics, error) {
+  file, err := os.Open(MetricsFile)
+  if errors.Is(err, os.ErrNotExist) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, fmt.Errorf("failed to open %s: %w", MetricsFile, err)
+  }
+  defer file.Close()
+  var records []RunMetrics
+  scanner := bufio.NewScanner(file)
+  scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+  lineNo := 0
+  for scanner.Scan() {
+    lineNo++
+    var record RunMetrics
+    if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+      slog.Warn("skipping unreadable metrics line", "file", MetricsFile, "line", lineNo, "err", err)
+      continue
+    }
+    records = append(records, record)
+  }
+  if err := scanner.Err(); err != nil {
+    return nil, fmt.Errorf("error reading %s: %w", MetricsFile, err)
+  }
+  return records, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "regexp"
+  "testing"
+  "time"
+)
+
+func TestNewRunID(t *testing.T) {
+  start := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+  first, second := NewRunID(start), NewRunID(start)
+  if !regexp.MustCompile(`^20260102-150405-[0-9a-f]{6}$`).MatchString(first) {
+    t.Errorf("NewRunID = %q, want 20260102-150405-xxxxxx", first)
+  }
+  if first == second {
+    t.Errorf("two run IDs in the same second are both %q", first)
+  }
+}
+
+func TestReadRunMetrics(t *testing.T) {
+  defer func(file string) { MetricsFile = file }(MetricsFile)
+  MetricsFile = filepath.Join(t.TempDir(), "Metrics.jsonl")
+  if records, err := ReadRunMetrics(); err != nil || records != nil {
+    t.Fatalf("missing file: %v, %v; want no records and no error", records, err)
+  }
+  os.WriteFile(MetricsFile, []byte(`{"runId":"a","scanned":3,"rules":[{"phrase":"sale","trashCode":4,"count":1}]}
+not json
+{"runId":"b","scanned":5}
+`), 0644)
+  records, err := ReadRunMetrics()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(records) != 2 || records[0].RunID != "a" || records[0].Rules[0].Phrase != "sale" || records[1].Scanned != 5 {
+    t.Errorf("ReadRunMetrics = %+v, want runs a and b with the bad line skipped", records)
+  }
+}
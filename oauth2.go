@@ -0,0 +1,388 @@
+package main
+
+import (
+  "context"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "log/slog"
+  "net"
+  "net/http"
+  "net/url"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+
+  "github.com/emersion/go-sasl"
+)
+
+// OAuth2Config is the "oauth2" section of Config.json
+type OAuth2Config struct {
+  ClientID       string   `json:"clientId"`
+  ClientSecret   string   `json:"clientSecret"`
+  TokenEndpoint  string   `json:"tokenEndpoint"`
+  AuthEndpoint   string   `json:"authEndpoint"`   // used by the loopback flow
+  DeviceEndpoint string   `json:"deviceEndpoint"` // used by the device flow
+  Scopes         []string `json:"scopes"`
+  RefreshToken   string   `json:"refreshToken"`   // optional; "authorize" stores one in TokenCache
+  Mechanism      string   `json:"mechanism"`      // XOAUTH2 (default) or OAUTHBEARER
+  TokenCache     string   `json:"tokenCache"`     // defaults to OAuthToken.json in paths.stateDir
+}
+
+// OAuth2Token is what TokenCache holds between runs
+type OAuth2Token struct {
+  AccessToken  string    `json:"accessToken"`
+  RefreshToken string    `json:"refreshToken"`
+  Expiry       time.Time `json:"expiry"`
+}
+
+// tokenResponse is the JSON body returned by a token or device endpoint
+type tokenResponse struct {
+  AccessToken      string `json:"access_token"`
+  RefreshToken     string `json:"refresh_token"`
+  ExpiresIn        int    `json:"expires_in"`
+  Error            string `json:"error"`
+  ErrorDescription string `json:"error_description"`
+  // Device authorization response
+  DeviceCode              string `json:"device_code"`
+  UserCode                string `json:"user_code"`
+  VerificationURI         string `json:"verification_uri"`
+  VerificationURL         string `json:"verification_url"` // Google's spelling
+  VerificationURIComplete string `json:"verification_uri_complete"`
+  Interval                int    `json:"interval"`
+}
+
+// The XOAUTH2 mechanism name
+const XOAuth2 = "XOAUTH2"
+
+// xoauth2Client implements the SASL XOAUTH2 mechanism used by Gmail and Outlook
+type xoauth2Client struct {
+  Username string
+  Token    string
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+  return XOAuth2, []byte("user=" + a.Username + "\x01auth=Bearer " + a.Token + "\x01\x01"), nil
+}
+
+// On failure the server sends a JSON error as a challenge and expects an empty reply
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+  slog.Debug("XOAUTH2 error challenge", "challenge", string(challenge))
+  return []byte{}, nil
+}
+
+// Check the oauth2 section and fill in defaults
+func (o *OAuth2Config) Validate() error {
+  o.Mechanism = strings.ToUpper(o.Mechanism)
+  if o.Mechanism == "" {
+    o.Mechanism = XOAuth2
+  }
+  if o.Mechanism != XOAuth2 && o.Mechanism != sasl.OAuthBearer {
+    return fmt.Errorf("unknown oauth2 mechanism %q (want XOAUTH2 or OAUTHBEARER)", o.Mechanism)
+  }
+  if o.ClientID == "" {
+    return errors.New("oauth2.clientId is required in Config.json")
+  }
+  if o.TokenEndpoint == "" {
+    return errors.New("oauth2.tokenEndpoint is required in Config.json")
+  }
+  return nil
+}
+
+// Build a SASL client for the configured mechanism using a fresh access token
+func OAuth2SASLClient() (sasl.Client, error) {
+  token, err := OAuth2AccessToken()
+  if err != nil {
+    return nil, err
+  }
+  if Config.OAuth2.Mechanism == sasl.OAuthBearer {
+    host, portText, _ := net.SplitHostPort(server)
+    port, _ := strconv.Atoi(portText)
+    return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{Username: email, Token: token, Host: host, Port: port}), nil
+  }
+  return &xoauth2Client{Username: email, Token: token}, nil
+}
+
+// Return a cached access token, refreshing it when it is missing or about to expire
+func OAuth2AccessToken() (string, error) {
+  cfg := &Config.OAuth2
+  token, err := LoadOAuth2Token(cfg.TokenCache)
+  if err != nil {
+    return "", err
+  }
+  if token.AccessToken != "" && time.Until(token.Expiry) > time.Minute {
+    return token.AccessToken, nil
+  }
+  if token.RefreshToken == "" {
+    token.RefreshToken = cfg.RefreshToken
+  }
+  if token.RefreshToken == "" {
+    return "", errors.New("no OAuth2 refresh token: run \"SpamBeGone authorize\" or set oauth2.refreshToken in Config.json")
+  }
+  slog.Info("Refreshing OAuth2 access token", "endpoint", cfg.TokenEndpoint)
+  resp, err := PostTokenEndpoint(cfg.TokenEndpoint, url.Values{
+    "grant_type":    {"refresh_token"},
+    "refresh_token": {token.RefreshToken},
+  })
+  if err != nil {
+    return "", fmt.Errorf("failed to refresh OAuth2 access token: %w", err)
+  }
+  token.AccessToken = resp.AccessToken
+  token.Expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+  // Some providers rotate the refresh token on every use
+  if resp.RefreshToken != "" {
+    token.RefreshToken = resp.RefreshToken
+  }
+  if err := SaveOAuth2Token(cfg.TokenCache, token); err != nil {
+    return "", err
+  }
+  return token.AccessToken, nil
+}
+
+// Read the token cache; a missing file is an empty token
+func LoadOAuth2Token(path string) (OAuth2Token, error) {
+  var token OAuth2Token
+  data, err := os.ReadFile(path)
+  if errors.Is(err, os.ErrNotExist) {
+    return token, nil
+  }
+  if err != nil {
+    return token, fmt.Errorf("failed to read OAuth2 token cache %s: %w", path, err)
+  }
+  if err := json.Unmarshal(data, &token); err != nil {
+    return token, fmt.Errorf("failed to parse OAuth2 token cache %s: %w", path, err)
+  }
+  return token, nil
+}
+
+// Write the token cache readable by the owner only
+func SaveOAuth2Token(path string, token OAuth2Token) error {
+  data, err := json.MarshalIndent(token, "", "  ")
+  if err != nil {
+    return err
+  }
+  if err := MakeParentDir(path); err != nil {
+    return fmt.Errorf("failed to create directory for OAuth2 token cache %s: %w", path, err)
+  }
+  if err := os.WriteFile(path, data, 0600); err != nil {
+    return fmt.Errorf("failed to write OAuth2 token cache %s: %w", path, err)
+  }
+  return nil
+}
+
+// POST a form to an OAuth2 endpoint with the client credentials and decode the reply
+func PostTokenEndpoint(endpoint string, form url.Values) (*tokenResponse, error) {
+  cfg := Config.OAuth2
+  form.Set("client_id", cfg.ClientID)
+  if cfg.ClientSecret != "" {
+    form.Set("client_secret", cfg.ClientSecret)
+  }
+  httpClient := &http.Client{Timeout: 30 * time.Second}
+  resp, err := httpClient.PostForm(endpoint, form)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+  var body tokenResponse
+  if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+    return nil, fmt.Errorf("unreadable response from %s (HTTP %d): %w", endpoint, resp.StatusCode, err)
+  }
+  if body.Error != "" {
+    return &body, &OAuth2Error{Code: body.Error, Description: body.ErrorDescription}
+  }
+  if resp.StatusCode != http.StatusOK {
+    return nil, fmt.Errorf("%s returned HTTP %d", endpoint, resp.StatusCode)
+  }
+  return &body, nil
+}
+
+// OAuth2Error is an error response from an OAuth2 endpoint
+type OAuth2Error struct {
+  Code        string
+  Description string
+}
+
+func (e *OAuth2Error) Error() string {
+  if e.Description != "" {
+    return e.Code + ": " + e.Description
+  }
+  return e.Code
+}
+
+// The "authorize" command: complete a device or loopback flow once and cache the refresh token
+func AuthorizeCommand(args []string) error {
+  fs := flag.NewFlagSet("authorize", flag.ContinueOnError)
+  flow := fs.String("flow", "", "device or loopback (default: device if oauth2.deviceEndpoint is set)")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := ReadConfigFile(); err != nil {
+    return err
+  }
+  if err := LoadConfig(); err != nil {
+    return err
+  }
+  if Config.Auth != "oauth2" {
+    return errors.New("Config.json does not have \"auth\": \"oauth2\"")
+  }
+  cfg := Config.OAuth2
+  if *flow == "" {
+    *flow = "loopback"
+    if cfg.DeviceEndpoint != "" {
+      *flow = "device"
+    }
+  }
+  var resp *tokenResponse
+  var err error
+  switch *flow {
+    case "device":
+      resp, err = DeviceFlow(cfg)
+    case "loopback":
+      resp, err = LoopbackFlow(cfg)
+    default:
+      return fmt.Errorf("unknown flow %q (want device or loopback)", *flow)
+  }
+  if err != nil {
+    return err
+  }
+  if resp.RefreshToken == "" {
+    return errors.New("the provider did not return a refresh token (check that offline access is allowed for this client)")
+  }
+  token := OAuth2Token{
+    AccessToken:  resp.AccessToken,
+    RefreshToken: resp.RefreshToken,
+    Expiry:       time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second),
+  }
+  if err := SaveOAuth2Token(cfg.TokenCache, token); err != nil {
+    return err
+  }
+  fmt.Printf("Authorized %s; tokens saved to %s\n", email, cfg.TokenCache)
+  return nil
+}
+
+// OAuth 2.0 device authorization grant (RFC 8628)
+func DeviceFlow(cfg OAuth2Config) (*tokenResponse, error) {
+  if cfg.DeviceEndpoint == "" {
+    return nil, errors.New("oauth2.deviceEndpoint is required for the device flow")
+  }
+  device, err := PostTokenEndpoint(cfg.DeviceEndpoint, url.Values{"scope": {strings.Join(cfg.Scopes, " ")}})
+  if err != nil {
+    return nil, fmt.Errorf("device authorization request failed: %w", err)
+  }
+  verify := device.VerificationURI
+  if verify == "" {
+    verify = device.VerificationURL
+  }
+  fmt.Printf("To authorize SpamBeGone, visit %s and enter the code %s\n", verify, device.UserCode)
+  if device.VerificationURIComplete != "" {
+    fmt.Printf("Or open %s\n", device.VerificationURIComplete)
+  }
+  interval := time.Duration(device.Interval) * time.Second
+  if interval <= 0 {
+    interval = 5 * time.Second
+  }
+  deadline := time.Now().Add(15 * time.Minute)
+  if device.ExpiresIn > 0 {
+    deadline = time.Now().Add(time.Duration(device.ExpiresIn) * time.Second)
+  }
+  for time.Now().Before(deadline) {
+    time.Sleep(interval)
+    resp, err := PostTokenEndpoint(cfg.TokenEndpoint, url.Values{
+      "grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+      "device_code": {device.DeviceCode},
+    })
+    var oauthErr *OAuth2Error
+    switch {
+      case err == nil:
+        return resp, nil
+      case errors.As(err, &oauthErr) && oauthErr.Code == "authorization_pending":
+      case errors.As(err, &oauthErr) && oauthErr.Code == "slow_down":
+        interval += 5 * time.Second
+      default:
+        return nil, fmt.Errorf("device authorization failed: %w", err)
+    }
+  }
+  return nil, errors.New("device authorization timed out")
+}
+
+// OAuth 2.0 authorization code grant with PKCE and a loopback redirect (RFC 8252)
+func LoopbackFlow(cfg OAuth2Config) (*tokenResponse, error) {
+  if cfg.AuthEndpoint == "" {
+    return nil, errors.New("oauth2.authEndpoint is required for the loopback flow")
+  }
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    return nil, fmt.Errorf("failed to open loopback listener: %w", err)
+  }
+  defer listener.Close()
+  redirectURI := "http://" + listener.Addr().String() + "/"
+  verifier := RandomToken(32)
+  challenge := sha256.Sum256([]byte(verifier))
+  state := RandomToken(16)
+  query := url.Values{
+    "response_type":         {"code"},
+    "client_id":             {cfg.ClientID},
+    "redirect_uri":          {redirectURI},
+    "scope":                 {strings.Join(cfg.Scopes, " ")},
+    "state":                 {state},
+    "code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+    "code_challenge_method": {"S256"},
+    "access_type":           {"offline"},
+    "prompt":                {"consent"},
+  }
+  fmt.Printf("To authorize SpamBeGone, open this URL in a browser on this machine:\n%s?%s\n", cfg.AuthEndpoint, query.Encode())
+  codes := make(chan string, 1)
+  failures := make(chan error, 1)
+  server := &http.Server{ReadHeaderTimeout: 10 * time.Second, Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    q := req.URL.Query()
+    switch {
+      case q.Get("state") != state:
+        http.Error(w, "state mismatch", http.StatusBadRequest)
+        return
+      case q.Get("error") != "":
+        fmt.Fprintln(w, "Authorization failed; you can close this window.")
+        select {
+          case failures <- &OAuth2Error{Code: q.Get("error"), Description: q.Get("error_description")}:
+          default:
+        }
+        return
+    }
+    fmt.Fprintln(w, "SpamBeGone is authorized; you can close this window.")
+    select {
+      case codes <- q.Get("code"):
+      default:
+    }
+  })}
+  go server.Serve(listener)
+  defer server.Shutdown(context.Background())
+  var code string
+  select {
+    case code = <-codes:
+    case err := <-failures:
+      return nil, fmt.Errorf("authorization failed: %w", err)
+    case <-time.After(5 * time.Minute):
+      return nil, errors.New("timed out waiting for the browser redirect")
+  }
+  resp, err := PostTokenEndpoint(cfg.TokenEndpoint, url.Values{
+    "grant_type":    {"authorization_code"},
+    "code":          {code},
+    "redirect_uri":  {redirectURI},
+    "code_verifier": {verifier},
+  })
+  if err != nil {
+    return nil, fmt.Errorf("failed to exchange authorization code: %w", err)
+  }
+  return resp, nil
+}
+
+// A random URL-safe string built from n random bytes
+func RandomToken(n int) string {
+  buf := make([]byte, n)
+  rand.Read(buf)
+  return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func TestXOAuth2Start(t *testing.T) {
+  mech, ir, err := (&xoauth2Client{Username: "me@example.com", Token: "ya29.token"}).Start()
+  if err != nil || mech != "XOAUTH2" || string(ir) != "user=me@example.com\x01auth=Bearer ya29.token\x01\x01" {
+    t.Errorf("Start() = %q, %q, %v", mech, ir, err)
+  }
+}
+
+func TestOAuth2ConfigValidate(t *testing.T) {
+  cfg := OAuth2Config{ClientID: "id", TokenEndpoint: "https://example.com/token", Mechanism: "oauthbearer"}
+  if err := cfg.Validate(); err != nil || cfg.Mechanism != "OAUTHBEARER" {
+    t.Errorf("Validate() = %v with %+v", err, cfg)
+  }
+  cfg = OAuth2Config{ClientID: "id", TokenEndpoint: "https://example.com/token"}
+  if err := cfg.Validate(); err != nil || cfg.Mechanism != "XOAUTH2" {
+    t.Errorf("Validate() = %v, mechanism %q; want XOAUTH2 by default", err, cfg.Mechanism)
+  }
+  for _, bad := range []OAuth2Config{
+    {ClientID: "id", TokenEndpoint: "https://example.com/token", Mechanism: "PLAIN"},
+    {TokenEndpoint: "https://example.com/token"},
+    {ClientID: "id"},
+  } {
+    if err := bad.Validate(); err == nil {
+      t.Errorf("Validate(%+v) accepted an invalid section", bad)
+    }
+  }
+}
+
+func TestOAuth2AccessToken(t *testing.T) {
+  defer func(cfg OAuth2Config) { Config.OAuth2 = cfg }(Config.OAuth2)
+  var requests []string
+  endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    req.ParseForm()
+    requests = append(requests, req.PostForm.Get("grant_type")+" "+req.PostForm.Get("refresh_token")+" "+req.PostForm.Get("client_id"))
+    if req.PostForm.Get("refresh_token") == "revoked" {
+      w.WriteHeader(http.StatusBadRequest)
+      w.Write([]byte(`{"error":"invalid_grant","error_description":"Token has been revoked."}`))
+      return
+    }
+    w.Write([]byte(`{"access_token":"fresh","refresh_token":"rotated","expires_in":3600}`))
+  }))
+  defer endpoint.Close()
+  cache := filepath.Join(t.TempDir(), "OAuthToken.json")
+  Config.OAuth2 = OAuth2Config{ClientID: "id", TokenEndpoint: endpoint.URL, TokenCache: cache}
+
+  // A token that is still valid is used without asking the endpoint
+  SaveOAuth2Token(cache, OAuth2Token{AccessToken: "cached", RefreshToken: "old", Expiry: time.Now().Add(time.Hour)})
+  if token, err := OAuth2AccessToken(); err != nil || token != "cached" || len(requests) != 0 {
+    t.Fatalf("valid token: %q, %v after %d requests", token, err, len(requests))
+  }
+  // An expiring one is refreshed, and a rotated refresh token replaces the old one
+  SaveOAuth2Token(cache, OAuth2Token{AccessToken: "cached", RefreshToken: "old", Expiry: time.Now().Add(30 * time.Second)})
+  if token, err := OAuth2AccessToken(); err != nil || token != "fresh" {
+    t.Fatalf("expiring token: %q, %v", token, err)
+  }
+  if len(requests) != 1 || requests[0] != "refresh_token old id" {
+    t.Errorf("requests %q, want one refresh with the cached refresh token", requests)
+  }
+  if saved, _ := LoadOAuth2Token(cache); saved.AccessToken != "fresh" || saved.RefreshToken != "rotated" || time.Until(saved.Expiry) < 59*time.Minute {
+    t.Errorf("cache holds %+v after the refresh", saved)
+  }
+  // Endpoint errors come back as OAuth2Error
+  SaveOAuth2Token(cache, OAuth2Token{RefreshToken: "revoked"})
+  var oauthErr *OAuth2Error
+  if _, err := OAuth2AccessToken(); !errors.As(err, &oauthErr) || oauthErr.Code != "invalid_grant" {
+    t.Errorf("revoked token: %v, want an invalid_grant OAuth2Error", err)
+  }
+  // Without any refresh token there is nothing to ask for
+  SaveOAuth2Token(cache, OAuth2Token{})
+  if _, err := OAuth2AccessToken(); err == nil {
+    t.Error("no refresh token: want an error")
+  }
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+  "errors"
+  "io/fs"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "runtime"
+)
+
+var (
+  // Path of Config.json, from --config or found by LocateConfig
+  ConfigPath = ""
+  // Directory that relative paths in Config.json are resolved against
+  ConfigDir = "."
+  // Directory for lock files, the OAuth2 token cache, Metrics.jsonl and journals
+  StateDir = "."
+  // List files, resolved by ResolvePaths
+  WhitelistFile = "Whitelist.txt"
+  BlacklistFile = "Blacklist.txt"
+  // Set when --log-dir was given, so the config's logDir does not override it
+  LogDirSet = false
+  // Default state directory when the config was found in the XDG config directory
+  xdgStateDir = ""
+)
+
+// PathsConfig is the "paths" section of Config.json; relative paths are taken from the config file's directory
+type PathsConfig struct {
+  Whitelist string `json:"whitelist"` // default Whitelist.txt
+  Blacklist string `json:"blacklist"` // default Blacklist.txt
+  Metrics   string `json:"metrics"`   // default Metrics.jsonl in stateDir
+  Moves     string `json:"moves"`     // record of moved messages for undo; default Moves.jsonl in stateDir
+  StateDir  string `json:"stateDir"`  // lock, token cache and journal files; default the config directory
+  LogDir    string `json:"logDir"`    // per-run logs, used when --log-dir is not given
+}
+
+// Decide which Config.json to read: --config, then ./Config.json, then the XDG config directory on Linux
+func LocateConfig() string {
+  xdgStateDir = ""
+  if ConfigPath != "" {
+    return ConfigPath
+  }
+  if _, err := os.Stat("Config.json"); err == nil || runtime.GOOS != "linux" {
+    return "Config.json"
+  }
+  home, _ := os.UserHomeDir()
+  configHome := os.Getenv("XDG_CONFIG_HOME")
+  if configHome == "" && home != "" {
+    configHome = filepath.Join(home, ".config")
+  }
+  stateHome := os.Getenv("XDG_STATE_HOME")
+  if stateHome == "" && home != "" {
+    stateHome = filepath.Join(home, ".local", "state")
+  }
+  if configHome == "" {
+    return "Config.json"
+  }
+  path := filepath.Join(configHome, "spambegone", "Config.json")
+  if _, err := os.Stat(path); err != nil {
+    return "Config.json"
+  }
+  if stateHome != "" {
+    xdgStateDir = filepath.Join(stateHome, "spambegone")
+  }
+  return path
+}
+
+// Resolve a path from Config.json against the config directory; empty values become def
+func ConfigRelative(path, def string) string {
+  if path == "" {
+    return def
+  }
+  if filepath.IsAbs(path) {
+    return path
+  }
+  return filepath.Join(ConfigDir, path)
+}
+
+// Set every file location from the paths in Config
+func ResolvePaths(configPath string) {
+  ConfigDir = filepath.Dir(configPath)
+  if abs, err := filepath.Abs(ConfigDir); err == nil {
+    ConfigDir = abs
+  }
+  defaultStateDir := ConfigDir
+  if xdgStateDir != "" {
+    defaultStateDir = xdgStateDir
+  }
+  paths := Config.Paths
+  StateDir      = ConfigRelative(paths.StateDir, defaultStateDir)
+  WhitelistFile = ConfigRelative(paths.Whitelist, filepath.Join(ConfigDir, "Whitelist.txt"))
+  BlacklistFile = ConfigRelative(paths.Blacklist, filepath.Join(ConfigDir, "Blacklist.txt"))
+  MetricsFile   = ConfigRelative(paths.Metrics, filepath.Join(StateDir, "Metrics.jsonl"))
+  MovesFile     = ConfigRelative(paths.Moves, filepath.Join(StateDir, "Moves.jsonl"))
+  if !LogDirSet {
+    LogDir = ConfigRelative(paths.LogDir, "")
+  }
+  Config.OAuth2.TokenCache = ConfigRelative(Config.OAuth2.TokenCache, filepath.Join(StateDir, "OAuthToken.json"))
+  Config.PasswordFile      = ConfigRelative(Config.PasswordFile, "")
+  Config.CredentialsFile   = ConfigRelative(Config.CredentialsFile, "")
+  Config.Connection.CAFile     = ConfigRelative(Config.Connection.CAFile, "")
+  Config.Connection.ClientCert = ConfigRelative(Config.Connection.ClientCert, "")
+  Config.Connection.ClientKey  = ConfigRelative(Config.Connection.ClientKey, "")
+  if len(Config.Folders) == 0 {
+    Config.Folders = []FolderConfig{{Name: "INBOX"}}
+  }
+  for i := range Config.Folders {
+    Config.Folders[i].Whitelist = ConfigRelative(Config.Folders[i].Whitelist, WhitelistFile)
+    Config.Folders[i].Blacklist = ConfigRelative(Config.Folders[i].Blacklist, BlacklistFile)
+  }
+}
+
+// Read Config.json for commands that also work without one, falling back to the default paths
+func LoadPaths() error {
+  err := ReadConfigFile()
+  if errors.Is(err, fs.ErrNotExist) {
+    slog.Debug("continuing without Config.json", "err", err)
+    Config = ConfigFile{}
+    ResolvePaths(LocateConfig())
+    return nil
+  }
+  return err
+}
+
+// Create the directory that will hold path
+func MakeParentDir(path string) error {
+  return os.MkdirAll(filepath.Dir(path), 0700)
+}
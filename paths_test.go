@@ -0,0 +1,81 @@
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "runtime"
+  "testing"
+)
+
+// Put the path globals back as they were when the test ends
+func keepPaths(t *testing.T) {
+  config, configPath, configDir, stateDir := Config, ConfigPath, ConfigDir, StateDir
+  whitelist, blacklist, metrics, moves, logDir, logDirSet := WhitelistFile, BlacklistFile, MetricsFile, MovesFile, LogDir, LogDirSet
+  t.Cleanup(func() {
+    Config, ConfigPath, ConfigDir, StateDir = config, configPath, configDir, stateDir
+    WhitelistFile, BlacklistFile, MetricsFile, MovesFile, LogDir, LogDirSet = whitelist, blacklist, metrics, moves, logDir, logDirSet
+  })
+}
+
+func TestResolvePaths(t *testing.T) {
+  keepPaths(t)
+  dir := t.TempDir()
+  abs := filepath.Join(dir, "elsewhere", "Black.txt")
+  Config = ConfigFile{Paths: PathsConfig{StateDir: "state", Blacklist: abs, LogDir: "logs"}, PasswordFile: "secret"}
+  LogDirSet = false
+  ResolvePaths(filepath.Join(dir, "Config.json"))
+  tests := []struct {
+    name, got, want string
+  }{
+    {"StateDir", StateDir, filepath.Join(dir, "state")},
+    {"WhitelistFile", WhitelistFile, filepath.Join(dir, "Whitelist.txt")},
+    {"BlacklistFile", BlacklistFile, abs},
+    {"MetricsFile", MetricsFile, filepath.Join(dir, "state", "Metrics.jsonl")},
+    {"LogDir", LogDir, filepath.Join(dir, "logs")},
+    {"TokenCache", Config.OAuth2.TokenCache, filepath.Join(dir, "state", "OAuthToken.json")},
+    {"PasswordFile", Config.PasswordFile, filepath.Join(dir, "secret")},
+    {"CredentialsFile", Config.CredentialsFile, ""},
+  }
+  for _, test := range tests {
+    if test.got != test.want {
+      t.Errorf("%s = %q, want %q", test.name, test.got, test.want)
+    }
+  }
+  // --log-dir wins over the config's logDir
+  LogDir, LogDirSet = "/var/log/spambegone", true
+  ResolvePaths(filepath.Join(dir, "Config.json"))
+  if LogDir != "/var/log/spambegone" {
+    t.Errorf("LogDir = %q after --log-dir", LogDir)
+  }
+}
+
+func TestLocateConfig(t *testing.T) {
+  keepPaths(t)
+  cwd, _ := os.Getwd()
+  defer os.Chdir(cwd)
+  work, home := t.TempDir(), t.TempDir()
+  os.Chdir(work)
+  t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "config"))
+  t.Setenv("XDG_STATE_HOME", filepath.Join(home, "state"))
+  ConfigPath = "/etc/spambegone.json"
+  if got := LocateConfig(); got != ConfigPath {
+    t.Errorf("with --config: %q", got)
+  }
+  ConfigPath = ""
+  if got := LocateConfig(); got != "Config.json" {
+    t.Errorf("nothing found: %q, want Config.json", got)
+  }
+  if runtime.GOOS == "linux" {
+    xdg := filepath.Join(home, "config", "spambegone", "Config.json")
+    os.MkdirAll(filepath.Dir(xdg), 0700)
+    os.WriteFile(xdg, []byte("{}"), 0600)
+    if got := LocateConfig(); got != xdg || xdgStateDir != filepath.Join(home, "state", "spambegone") {
+      t.Errorf("XDG config: %q with state %q", got, xdgStateDir)
+    }
+  }
+  // ./Config.json comes before the XDG one
+  os.WriteFile("Config.json", []byte("{}"), 0600)
+  if got := LocateConfig(); got != "Config.json" || xdgStateDir != "" {
+    t.Errorf("local config: %q with state %q", got, xdgStateDir)
+  }
+}
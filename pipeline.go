@@ -0,0 +1,85 @@
+package main
+
+import (
+  "github.com/emersion/go-imap"
+)
+
+var (
+  // Set by --report-non-ascii or "reportNonASCII" in Config.json: log senders and subjects still not ASCII after normalization
+  ReportNonASCII = false
+)
+
+// Stage is one step of the per-message pipeline. A single fetch feeds every stage, and each
+// stage sees every message once, in the order the stages are listed.
+type Stage interface {
+  Name() string
+  Items() []imap.FetchItem // what the stage needs fetched
+  Process(msg *imap.Message)
+}
+
+// FuncStage is a Stage made from a function
+type FuncStage struct {
+  name    string
+  items   []imap.FetchItem
+  process func(*imap.Message)
+}
+
+// Name of the stage, for logging
+func (s FuncStage) Name() string { return s.name }
+
+// Fetch items the stage reads
+func (s FuncStage) Items() []imap.FetchItem { return s.items }
+
+// Handle one message
+func (s FuncStage) Process(msg *imap.Message) { s.process(msg) }
+
+// Envelope data every built-in stage reads
+var EnvelopeItems = []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate, imap.FetchEnvelope}
+
+// The stages a folder run uses: tracing, counting, the optional non-ASCII report and matching
+func PipelineStages() []Stage {
+  stages := []Stage{
+    FuncStage{"trace", EnvelopeItems, func(msg *imap.Message) {
+      Tracing = IsTraced(msg)
+      LogNormalization(msg)
+    }},
+    FuncStage{"count", []imap.FetchItem{imap.FetchUid}, func(*imap.Message) { MessagesScanned++ }},
+  }
+  if ReportNonASCII {
+    stages = append(stages, FuncStage{"non-ascii", EnvelopeItems, CheckConvertStyledToASCII})
+  }
+  matchItems := []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate, imap.FetchEnvelope, imap.FetchFlags}
+  return append(stages, FuncStage{"match", matchItems, MatchMessage})
+}
+
+// Fetch the session's folder once, with everything the stages need, and run each message
+// through them. With several folders evaluated at once, run holds this folder's state and the
+// stages take turns with the other folders' stages.
+func RunPipeline(s *Session, stages []Stage, run *FolderRun) error {
+  var items []imap.FetchItem
+  seen := map[imap.FetchItem]bool{}
+  for _, stage := range stages {
+    for _, item := range stage.Items() {
+      if !seen[item] {
+        seen[item] = true
+        items = append(items, item)
+      }
+    }
+  }
+  keyword, phrases, ages := CheckedKeyword, Blacklist, BlacklistMaxAges
+  if run != nil {
+    keyword, phrases, ages = run.CheckedKeyword, run.Rules.Blacklist, run.Rules.MaxAges
+  }
+  return FetchMailbox(s, FetchCriteria(s.Folder, keyword, phrases, ages), items, func(msg *imap.Message) {
+    if run != nil {
+      evaluateMu.Lock()
+      defer evaluateMu.Unlock()
+      run.Restore()
+      defer run.Save()
+    }
+    for _, stage := range stages {
+      stage.Process(msg)
+    }
+    Tracing = false
+  })
+}
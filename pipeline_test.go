@@ -0,0 +1,39 @@
+package main
+
+import (
+  "slices"
+  "testing"
+
+  "github.com/emersion/go-imap"
+)
+
+func stageNames(stages []Stage) []string {
+  var names []string
+  for _, stage := range stages {
+    names = append(names, stage.Name())
+  }
+  return names
+}
+
+func TestPipelineStages(t *testing.T) {
+  defer func(report bool) { ReportNonASCII = report }(ReportNonASCII)
+  ReportNonASCII = false
+  if got, want := stageNames(PipelineStages()), []string{"trace", "count", "match"}; !slices.Equal(got, want) {
+    t.Errorf("stages = %v, want %v", got, want)
+  }
+  ReportNonASCII = true
+  if got, want := stageNames(PipelineStages()), []string{"trace", "count", "non-ascii", "match"}; !slices.Equal(got, want) {
+    t.Errorf("stages with --report-non-ascii = %v, want %v", got, want)
+  }
+}
+
+func TestFuncStage(t *testing.T) {
+  var seen []uint32
+  stage := FuncStage{"collect", []imap.FetchItem{imap.FetchUid}, func(msg *imap.Message) { seen = append(seen, msg.Uid) }}
+  for uid := uint32(1); uid <= 3; uid++ {
+    stage.Process(&imap.Message{Uid: uid})
+  }
+  if stage.Name() != "collect" || !slices.Equal(stage.Items(), []imap.FetchItem{imap.FetchUid}) || !slices.Equal(seen, []uint32{1, 2, 3}) {
+    t.Errorf("stage %s with items %v saw %v", stage.Name(), stage.Items(), seen)
+  }
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+  "net/textproto"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/emersion/go-imap"
+)
+
+var (
+  // Blacklist phrases (or look-alike characters) per UID SEARCH command when prefiltering, to
+  // keep each command short; each adds a FROM and a SUBJECT key
+  PrefilterBatch = 20
+
+  // Characters ConvertStyledToASCII rewrites, with what they become in lower case
+  lookAlikes     map[rune]string
+  lookAlikesOnce sync.Once
+)
+
+// Reason the SEARCH prefilter cannot narrow a folder with these blacklist phrases, or "" when it
+// can. Only phrases can be asked of the server; the whitelist and character checks match mail
+// no SEARCH key describes.
+func PrefilterBlocker(phrases []string) string {
+  if NotWhitelistedAction.Kind != "none" {
+    return "actions.notWhitelisted matches every sender missing from the whitelist; set it to none"
+  }
+  if UnacceptableAction.Kind != "none" {
+    return "actions.unacceptable checks characters SEARCH cannot express; set it to none"
+  }
+  for _, phrase := range phrases {
+    if phrase == "" {
+      return "an empty blacklist line matches every message"
+    }
+  }
+  return ""
+}
+
+// Criteria for the messages a blacklist phrase could match, within base: an OR of FROM and
+// SUBJECT for every phrase, limited to the phrase's maxAge window, and for every look-alike
+// character that normalizes into one of the phrases, since the server compares raw text and
+// never sees 𝐁𝐥𝐚𝐜𝐤 𝐅𝐫𝐢𝐝𝐚𝐲 spelled out. The keys are split into queries of PrefilterBatch pairs.
+// The server only narrows the candidates; each one fetched is still matched locally after
+// normalization.
+func PrefilterCriteria(base *imap.SearchCriteria, phrases []string, ages map[string]time.Duration) []*imap.SearchCriteria {
+  var keys []*imap.SearchCriteria
+  for _, phrase := range phrases {
+    keys = append(keys, HeaderKeys(phrase, AgeCutoff(ages[phrase]))...)
+  }
+  keys = append(keys, LookAlikeKeys(phrases, ages)...)
+  var queries []*imap.SearchCriteria
+  for start := 0; start < len(keys); start += 2 * PrefilterBatch {
+    query := *base
+    query.Or = append(append([][2]*imap.SearchCriteria(nil), base.Or...), SplitOr(keys[start:min(start+2*PrefilterBatch, len(keys))]))
+    queries = append(queries, &query)
+  }
+  return queries
+}
+
+// FROM and SUBJECT keys for text, limited to messages since cutoff
+func HeaderKeys(text string, cutoff time.Time) []*imap.SearchCriteria {
+  var keys []*imap.SearchCriteria
+  for _, field := range []string{"From", "Subject"} {
+    key := &imap.SearchCriteria{Header: textproto.MIMEHeader{field: {text}}}
+    WithSince(key, cutoff)
+    keys = append(keys, key)
+  }
+  return keys
+}
+
+// Keys for every look-alike character that becomes part of one of the phrases after
+// normalization, each within the widest maxAge window of the phrases it can spell
+func LookAlikeKeys(phrases []string, ages map[string]time.Duration) []*imap.SearchCriteria {
+  lookAlikesOnce.Do(func() {
+    lookAlikes = map[rune]string{}
+    // Every rewritten character lies below the end of the Mathematical Alphanumeric Symbols
+    for r := rune(0x80); r <= 0x1D7FF; r++ {
+      if converted := ConvertStyledToASCII(string(r)); converted != string(r) {
+        lookAlikes[r] = strings.ToLower(converted)
+      }
+    }
+  })
+  cutoffs := map[rune]time.Time{}
+  for _, phrase := range phrases {
+    cutoff := AgeCutoff(ages[phrase])
+    for r, converted := range lookAlikes {
+      if !strings.ContainsAny(phrase, converted) {
+        continue
+      }
+      // A zero cutoff has no window and wins
+      if earlier, found := cutoffs[r]; !found || (!earlier.IsZero() && (cutoff.IsZero() || cutoff.Before(earlier))) {
+        cutoffs[r] = cutoff
+      }
+    }
+  }
+  runes := make([]rune, 0, len(cutoffs))
+  for r := range cutoffs {
+    runes = append(runes, r)
+  }
+  sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+  var keys []*imap.SearchCriteria
+  for _, r := range runes {
+    keys = append(keys, HeaderKeys(string(r), cutoffs[r])...)
+  }
+  return keys
+}
+
+// Join two or more keys with OR, nesting them as a balanced tree so the command stays shallow
+func SplitOr(keys []*imap.SearchCriteria) [2]*imap.SearchCriteria {
+  half := len(keys) / 2
+  return [2]*imap.SearchCriteria{JoinOr(keys[:half]), JoinOr(keys[half:])}
+}
+
+// One key matching any of keys
+func JoinOr(keys []*imap.SearchCriteria) *imap.SearchCriteria {
+  if len(keys) == 1 {
+    return keys[0]
+  }
+  return &imap.SearchCriteria{Or: [][2]*imap.SearchCriteria{SplitOr(keys)}}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+  "fmt"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/emersion/go-imap"
+)
+
+// Header keys under an OR tree in order, as "From abc", and the depth of the tree
+func orLeaves(key *imap.SearchCriteria) ([]string, int) {
+  if len(key.Or) == 0 {
+    for field, values := range key.Header {
+      return []string{field + " " + values[0]}, 0
+    }
+    return nil, 0
+  }
+  left, leftDepth := orLeaves(key.Or[0][0])
+  right, rightDepth := orLeaves(key.Or[0][1])
+  return append(left, right...), max(leftDepth, rightDepth) + 1
+}
+
+func TestSplitOr(t *testing.T) {
+  for _, n := range []int{2, 3, 5, 8, 40} {
+    var keys []*imap.SearchCriteria
+    var want []string
+    for i := 0; i < n; i++ {
+      keys = append(keys, HeaderKeys(fmt.Sprint(i), time.Time{})[1])
+      want = append(want, fmt.Sprintf("Subject %d", i))
+    }
+    got, depth := orLeaves(&imap.SearchCriteria{Or: [][2]*imap.SearchCriteria{SplitOr(keys)}})
+    if fmt.Sprint(got) != fmt.Sprint(want) {
+      t.Errorf("SplitOr of %d keys: leaves %v, want %v", n, got, want)
+    }
+    // A balanced tree of n leaves is ceil(log2 n) deep
+    if maxDepth := len(fmt.Sprintf("%b", n-1)); depth > maxDepth {
+      t.Errorf("SplitOr of %d keys is %d deep, want at most %d", n, depth, maxDepth)
+    }
+  }
+}
+
+func TestPrefilterCriteria(t *testing.T) {
+  defer func(batch int, start time.Time) { PrefilterBatch, RunStartTime = batch, start }(PrefilterBatch, RunStartTime)
+  PrefilterBatch = 1
+  RunStartTime = time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+  base := imap.NewSearchCriteria()
+  base.WithoutFlags = []string{"SpamBeGone-Checked-1a2b3c4d"}
+  queries := PrefilterCriteria(base, []string{"ab", "zz"}, map[string]time.Duration{"zz": 7 * 24 * time.Hour})
+  keys := map[string]*imap.SearchCriteria{}
+  for _, query := range queries {
+    if fmt.Sprint(query.WithoutFlags) != fmt.Sprint(base.WithoutFlags) {
+      t.Errorf("query lost the base criteria: %v", query.WithoutFlags)
+    }
+    if len(query.Or) != 1 {
+      t.Fatalf("query has %d ORs, want 1", len(query.Or))
+    }
+    // One FROM and one SUBJECT key per query with a batch of 1
+    for _, key := range query.Or[0] {
+      leaves, _ := orLeaves(key)
+      if len(leaves) != 1 {
+        t.Fatalf("query has keys %v, want one per side", leaves)
+      }
+      keys[leaves[0]] = key
+    }
+  }
+  if len(keys) != 2*len(queries) {
+    t.Errorf("%d queries carry %d distinct keys, want 2 each", len(queries), len(keys))
+  }
+  for _, want := range []struct {
+    key   string
+    since time.Time
+  }{
+    {"From ab", time.Time{}},
+    {"Subject zz", time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)},
+    // Cyrillic a and bold B spell part of ab; bold z only zz, so it keeps zz's window
+    {"Subject а", time.Time{}},
+    {"From 𝐁", time.Time{}},
+    {"Subject 𝐳", time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)},
+  } {
+    key, found := keys[want.key]
+    if !found {
+      t.Errorf("no key %q", want.key)
+    } else if !key.Since.Equal(want.since) {
+      t.Errorf("key %q since %s, want %s", want.key, key.Since, want.since)
+    }
+  }
+  for _, unwanted := range []string{"Subject 𝐱", "From ©"} {
+    if _, found := keys[unwanted]; found {
+      t.Errorf("key %q does not help either phrase", unwanted)
+    }
+  }
+}
+
+func TestPrefilterBlocker(t *testing.T) {
+  defer func(n, u RuleAction) { NotWhitelistedAction, UnacceptableAction = n, u }(NotWhitelistedAction, UnacceptableAction)
+  tests := []struct {
+    notWhitelisted, unacceptable string
+    phrases                      []string
+    blocker                      string
+  }{
+    {"none", "none", []string{"sale"}, ""},
+    {"trash", "none", []string{"sale"}, "notWhitelisted"},
+    {"none", "junk", []string{"sale"}, "unacceptable"},
+    {"none", "none", []string{"sale", ""}, "empty blacklist line"},
+  }
+  for _, test := range tests {
+    NotWhitelistedAction = RuleAction{Kind: test.notWhitelisted}
+    UnacceptableAction = RuleAction{Kind: test.unacceptable}
+    got := PrefilterBlocker(test.phrases)
+    if test.blocker == "" && got != "" || !strings.Contains(got, test.blocker) {
+      t.Errorf("PrefilterBlocker with %s/%s and %q = %q, want %q", test.notWhitelisted, test.unacceptable, test.phrases, got, test.blocker)
+    }
+  }
+}
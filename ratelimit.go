@@ -0,0 +1,226 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "log/slog"
+  "net"
+  "slices"
+  "strings"
+  "syscall"
+  "time"
+
+  "github.com/emersion/go-imap"
+  "github.com/emersion/go-imap/commands"
+)
+
+// MoveConfig is the "move" section of Config.json: how matched messages are copied out of a folder
+type MoveConfig struct {
+  ChunkSize  int    `json:"chunkSize"`  // UIDs per COPY command, default 10
+  Delay      string `json:"delay"`      // pause between chunks, e.g. "2s" (default)
+  Retries    int    `json:"retries"`    // attempts per chunk after a throttling response or dropped connection, default 5
+  Backoff    string `json:"backoff"`    // wait before the first retry, doubled on each further one, default "5s"
+  MaxBackoff string `json:"maxBackoff"` // longest wait between retries and longest delay between chunks, default "2m"
+  // Parsed from the strings above by Validate
+  delay      time.Duration
+  backoff    time.Duration
+  maxBackoff time.Duration
+}
+
+var (
+  // Response codes and texts servers use to ask a client to slow down
+  ThrottleMarkers = []string{"[THROTTLED]", "[LIMIT]", "[UNAVAILABLE]", "throttl", "too many", "rate limit"}
+  // Copies one chunk for CopyChunks; tests stand in for the server here
+  CopyChunk = UidCopyChunk
+)
+
+// Check the move section and fill in defaults
+func (mc *MoveConfig) Validate() error {
+  if mc.ChunkSize == 0 {
+    mc.ChunkSize = 10
+  }
+  if mc.ChunkSize < 0 {
+    return fmt.Errorf("move.chunkSize must be positive, not %d", mc.ChunkSize)
+  }
+  if mc.Retries == 0 {
+    mc.Retries = 5
+  }
+  if mc.Retries < 0 {
+    return fmt.Errorf("move.retries must be positive, not %d", mc.Retries)
+  }
+  for _, setting := range []struct {
+    name   string
+    spec   string
+    def    time.Duration
+    parsed *time.Duration
+  }{
+    {"delay", mc.Delay, 2 * time.Second, &mc.delay},
+    {"backoff", mc.Backoff, 5 * time.Second, &mc.backoff},
+    {"maxBackoff", mc.MaxBackoff, 2 * time.Minute, &mc.maxBackoff},
+  } {
+    *setting.parsed = setting.def
+    if setting.spec == "" {
+      continue
+    }
+    d, err := time.ParseDuration(setting.spec)
+    if err != nil || d < 0 {
+      return fmt.Errorf("invalid move.%s %q", setting.name, setting.spec)
+    }
+    *setting.parsed = d
+  }
+  if mc.maxBackoff < mc.backoff {
+    return fmt.Errorf("move.maxBackoff %s is shorter than move.backoff %s", mc.maxBackoff, mc.backoff)
+  }
+  return nil
+}
+
+// Report whether a failed command was throttled by the server
+func IsThrottled(err error) bool {
+  text := strings.ToLower(err.Error())
+  for _, marker := range ThrottleMarkers {
+    if strings.Contains(text, strings.ToLower(marker)) {
+      return true
+    }
+  }
+  return false
+}
+
+// Report whether a failed command lost the connection
+func IsConnectionLost(err error) bool {
+  var netErr net.Error
+  return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.EOF) ||
+    errors.Is(err, net.ErrClosed) || errors.As(err, &netErr) ||
+    strings.Contains(err.Error(), "connection closed")
+}
+
+// UID COPY that keeps the response code (e.g. [THROTTLED]) in the error, which client.UidCopy drops
+func UidCopyChunk(uids *imap.SeqSet, folder string) error {
+  status, err := c.Execute(&commands.Uid{Cmd: &commands.Copy{SeqSet: uids, Mailbox: folder}}, nil)
+  if err != nil {
+    return err
+  }
+  if status.Type == imap.StatusRespOk {
+    return nil
+  }
+  if status.Code != "" {
+    return fmt.Errorf("[%s] %s", status.Code, status.Info)
+  }
+  return status.Err()
+}
+
+// Copy messages to a folder in chunks, pausing between chunks. A throttled chunk is retried
+// with exponential backoff, and halves the chunk size and doubles the pause for the rest of
+// the copy. After a dropped connection or timeout only the messages not found in the folder
+// are copied again. Returns the UIDs copied so far, which the caller deletes even when err is set.
+func CopyChunks(uids *imap.SeqSet, folder string) (*imap.SeqSet, error) {
+  slog.Debug("Sequence set for processing", "uids", uids.String())
+  copied := new(imap.SeqSet)
+  chunkSize := uint32(Config.Move.ChunkSize)
+  delay := Config.Move.delay
+  chunks := SplitSequenceSet(uids, chunkSize)
+  for n := 1; len(chunks) > 0; n++ {
+    chunk := chunks[0]
+    slog.Info("Processing chunk", "chunk", n, "uids", chunk.String(), "folder", folder)
+    var err error
+    backoff := Config.Move.backoff
+    // Messages of the chunk found in the folder after the connection dropped mid-COPY
+    arrived := new(imap.SeqSet)
+    for attempt := 0; ; attempt++ {
+      copyStart := time.Now()
+      if err = CopyChunk(chunk, folder); err == nil {
+        ObserveMove(copyStart)
+        break
+      }
+      CountIMAPError("copy")
+      throttled, lost := IsThrottled(err), IsConnectionLost(err)
+      if attempt >= Config.Move.Retries || (!throttled && !lost) {
+        break
+      }
+      slog.Warn("Chunk copy failed; retrying", "chunk", n, "folder", folder, "attempt", attempt+1, "wait", backoff, "err", err)
+      time.Sleep(backoff)
+      backoff = min(backoff*2, Config.Move.maxBackoff)
+      if lost {
+        if err = Reconnect(); err != nil {
+          slog.Error("Reconnect failed", "err", err)
+          break
+        }
+        // The server may have carried out the COPY before the reply was lost
+        var missing, found []uint32
+        if missing, found, err = UncopiedUIDs(chunk, folder); err != nil {
+          break
+        }
+        arrived.AddNum(found...)
+        pending := new(imap.SeqSet)
+        pending.AddNum(missing...)
+        chunk, chunks[0] = pending, pending
+        if pending.Empty() {
+          slog.Info("Chunk was copied before the connection dropped", "chunk", n, "folder", folder)
+          break
+        }
+        continue
+      }
+      // Slow down for the rest of this copy
+      delay = min(max(delay*2, time.Second), Config.Move.maxBackoff)
+      if chunkSize > 1 {
+        chunkSize /= 2
+        rest := new(imap.SeqSet)
+        for _, pending := range chunks {
+          rest.AddSet(pending)
+        }
+        chunks = SplitSequenceSet(rest, chunkSize)
+        chunk = chunks[0]
+        slog.Info("Throttled; reducing chunk size", "chunkSize", chunkSize, "delay", delay, "uids", chunk.String())
+      }
+    }
+    copied.AddSet(arrived)
+    if err != nil {
+      slog.Error("Chunk copy failed", "chunk", n, "folder", folder, "uids", chunk.String(), "err", err)
+      return copied, fmt.Errorf("chunk %d copy to %s failed: %w", n, folder, err)
+    }
+    copied.AddSet(chunk)
+    chunks = chunks[1:]
+    slog.Info("Processed chunk", "chunk", n, "uids", chunk.String())
+    if len(chunks) > 0 {
+      time.Sleep(delay)
+    }
+  }
+  return copied, nil
+}
+
+// Split the chunk into the UIDs whose Message-ID is not in folder yet and those already there,
+// after the connection dropped during a COPY; the source folder is selected again afterwards
+func UncopiedUIDs(chunk *imap.SeqSet, folder string) (missing, found []uint32, err error) {
+  messages := make(chan *imap.Message, FetchBuffer)
+  done := make(chan error, 1)
+  go func() {
+    done <- c.UidFetch(chunk, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}, messages)
+  }()
+  move := JournalMove{Destination: folder}
+  var uids []uint32
+  for msg := range messages {
+    message := JournalMessage{UID: msg.Uid}
+    if msg.Envelope != nil {
+      message.MessageID = msg.Envelope.MessageId
+    }
+    move.Messages = append(move.Messages, message)
+    uids = append(uids, msg.Uid)
+  }
+  if err := <-done; err != nil {
+    CountIMAPError("fetch")
+    return nil, nil, fmt.Errorf("failed to check which messages were copied: %w", err)
+  }
+  if missing, err = MissingFromDestination(move, uids); err != nil {
+    return nil, nil, err
+  }
+  if _, err := c.Select(SelectFolder, false); err != nil {
+    CountIMAPError("select")
+    return nil, nil, fmt.Errorf("failed to reselect mailbox %s: %w", SelectFolder, err)
+  }
+  for _, uid := range uids {
+    if !slices.Contains(missing, uid) {
+      found = append(found, uid)
+    }
+  }
+  return missing, found, nil
+}
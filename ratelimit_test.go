@@ -0,0 +1,155 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "os"
+  "reflect"
+  "syscall"
+  "testing"
+  "time"
+
+  "github.com/emersion/go-imap"
+)
+
+// Strings of each set, e.g. [1:4 5:6,9]
+func setStrings(sets []*imap.SeqSet) []string {
+  var out []string
+  for _, set := range sets {
+    out = append(out, set.String())
+  }
+  return out
+}
+
+func TestSplitSequenceSet(t *testing.T) {
+  tests := []struct {
+    uids  string
+    chunk uint32
+    want  []string
+  }{
+    {"1:10", 4, []string{"1:4", "5:8", "9:10"}},
+    {"1:3,7,9:12", 3, []string{"1:3", "7,9:10", "11:12"}},
+    {"5", 10, []string{"5"}},
+    {"1:4", 1, []string{"1", "2", "3", "4"}},
+    {"506732:506734", 2, []string{"506732:506733", "506734"}},
+    {"1:4", 0, []string{"1:4"}},
+  }
+  for _, test := range tests {
+    uids, err := imap.ParseSeqSet(test.uids)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if got := setStrings(SplitSequenceSet(uids, test.chunk)); fmt.Sprint(got) != fmt.Sprint(test.want) {
+      t.Errorf("SplitSequenceSet(%s, %d) = %v, want %v", test.uids, test.chunk, got, test.want)
+    }
+  }
+}
+
+func TestCopyChunks(t *testing.T) {
+  defer func(copyChunk func(*imap.SeqSet, string) error, move MoveConfig) { CopyChunk, Config.Move = copyChunk, move }(CopyChunk, Config.Move)
+  tests := []struct {
+    name    string
+    replies map[int]error // by call, starting at 1; other calls succeed
+    calls   []string
+    copied  string
+    failed  bool
+  }{
+    {"no throttling", nil, []string{"1:4", "5:8", "9:10"}, "1:10", false},
+    // A throttled chunk is retried at half the size, and the rest of the copy stays at that size
+    {"throttled", map[int]error{2: errors.New("[THROTTLED] slow down")}, []string{"1:4", "5:8", "5:6", "7:8", "9:10"}, "1:10", false},
+    {"throttled twice", map[int]error{1: errors.New("[LIMIT] too many requests"), 2: errors.New("[LIMIT] too many requests")},
+      []string{"1:4", "1:2", "1", "2", "3", "4", "5", "6", "7", "8", "9", "10"}, "1:10", false},
+    // Other errors stop the copy, and what was copied before is reported
+    {"denied", map[int]error{2: errors.New("permission denied")}, []string{"1:4", "5:8"}, "1:4", true},
+  }
+  for _, test := range tests {
+    Config.Move = MoveConfig{ChunkSize: 4, Retries: 3}
+    var calls []string
+    CopyChunk = func(uids *imap.SeqSet, folder string) error {
+      calls = append(calls, uids.String())
+      return test.replies[len(calls)]
+    }
+    uids, _ := imap.ParseSeqSet("1:10")
+    copied, err := CopyChunks(uids, "Trash")
+    if (err != nil) != test.failed || copied.String() != test.copied || fmt.Sprint(calls) != fmt.Sprint(test.calls) {
+      t.Errorf("%s: copied %s with calls %v and error %v; want %s with calls %v, failed %t",
+        test.name, copied, calls, err, test.copied, test.calls, test.failed)
+    }
+  }
+}
+
+func TestMoveConfigValidate(t *testing.T) {
+  mc := MoveConfig{}
+  if err := mc.Validate(); err != nil {
+    t.Fatal(err)
+  }
+  if mc.ChunkSize != 10 || mc.Retries != 5 || mc.delay != 2*time.Second || mc.backoff != 5*time.Second || mc.maxBackoff != 2*time.Minute {
+    t.Errorf("defaults = %+v", mc)
+  }
+  for _, bad := range []MoveConfig{
+    {ChunkSize: -1},
+    {Retries: -2},
+    {Delay: "soon"},
+    {Backoff: "-1s"},
+    {Backoff: "1m", MaxBackoff: "30s"},
+  } {
+    if err := bad.Validate(); err == nil {
+      t.Errorf("Validate accepted %+v", bad)
+    }
+  }
+}
+
+func TestIsThrottled(t *testing.T) {
+  for _, text := range []string{"[THROTTLED] slow down", "[LIMIT] Too many commands", "Rate limit exceeded", "[UNAVAILABLE] try later"} {
+    if !IsThrottled(errors.New(text)) {
+      t.Errorf("IsThrottled(%q) = false", text)
+    }
+  }
+  for _, text := range []string{"[TRYCREATE] no such mailbox", "permission denied"} {
+    if IsThrottled(errors.New(text)) {
+      t.Errorf("IsThrottled(%q) = true", text)
+    }
+  }
+}
+
+func TestIsConnectionLost(t *testing.T) {
+  for _, err := range []error{io.EOF, fmt.Errorf("copy: %w", syscall.ECONNRESET), syscall.EPIPE, errors.New("imap: connection closed"), os.ErrDeadlineExceeded} {
+    if !IsConnectionLost(err) {
+      t.Errorf("IsConnectionLost(%v) = false", err)
+    }
+  }
+  if IsConnectionLost(errors.New("[THROTTLED] slow down")) {
+    t.Error("a throttling response counted as a lost connection")
+  }
+}
+
+func TestCopyChunksTimeout(t *testing.T) {
+  defer func(copyChunk func(*imap.SeqSet, string) error) { CopyChunk = copyChunk }(CopyChunk)
+  account := newFakeAccount(`Trash|\Trash`)
+  account.Add("INBOX", "Shop <news@shop.com>", "Big sale")
+  account.Add("INBOX", "Shop <news@shop.com>", "Sale ends today")
+  account.Add("INBOX", "Friend <friend@mail.com>", "Lunch?")
+  startFakeAccount(t, account, "friend@mail.com\n", "sale\n",
+    `, "connection": {"reconnectAttempts": 1, "reconnectBackoff": "1ms"}, "move": {"backoff": "1ms"}`)
+  // The server copies the chunk, but the reply times out
+  CopyChunk = func(uids *imap.SeqSet, folder string) error {
+    if err := UidCopyChunk(uids, folder); err != nil {
+      return err
+    }
+    CopyChunk = UidCopyChunk
+    return fmt.Errorf("copy: %w", os.ErrDeadlineExceeded)
+  }
+  if err := RunOnce(); err != nil {
+    t.Fatalf("RunOnce: %v", err)
+  }
+  if got := account.Commands("COPY"); len(got) != 1 {
+    t.Errorf("COPY commands %q, want the timed-out one only", got)
+  }
+  if got := account.Subjects("Trash"); !reflect.DeepEqual(got, []string{"Big sale", "Sale ends today"}) {
+    t.Errorf("Trash holds %q, want each sale once", got)
+  }
+  if got := account.Subjects("INBOX"); !reflect.DeepEqual(got, []string{"Lunch?"}) {
+    t.Errorf("INBOX holds %q", got)
+  }
+}
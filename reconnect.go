@@ -0,0 +1,124 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "log/slog"
+  "time"
+
+  "github.com/emersion/go-imap/client"
+)
+
+var (
+  // Longest wait between reconnect attempts
+  MaxReconnectBackoff = time.Minute
+  // The folder was rebuilt while we were away, so the UIDs we hold no longer name the same messages
+  ErrUIDValidityChanged = errors.New("UIDVALIDITY changed while reconnecting; the folder's UIDs are no longer valid")
+)
+
+// Session is one logged-in connection and the folder selected on it
+type Session struct {
+  Client      *client.Client
+  Folder      string
+  UIDValidity uint32 // of Folder when it was first selected; 0 skips the check after reconnecting
+  primary     bool   // Client is the package-level c, which follows it across reconnects
+}
+
+// The package-level connection and the folder being filtered, as a Session
+func PrimarySession() *Session {
+  s := &Session{Client: c, Folder: SelectFolder, primary: true}
+  if mailbox != nil && mailbox.Name == SelectFolder {
+    s.UIDValidity = mailbox.UidValidity
+  }
+  return s
+}
+
+// Log in again on the package-level connection after it dropped, see Session.Reconnect
+func Reconnect() error {
+  return PrimarySession().Reconnect()
+}
+
+// Log in again after a dropped connection (BYE, EOF, reset or timeout), with backoff, and
+// reselect the session's folder, checking its UIDVALIDITY is unchanged
+func (s *Session) Reconnect() error {
+  attempts := Config.Connection.ReconnectAttempts
+  if attempts < 0 {
+    return errors.New("connection lost and reconnecting is turned off")
+  }
+  backoff := Config.Connection.reconnectBackoff
+  var err error
+  for attempt := 1; attempt <= attempts; attempt++ {
+    Exporter.Add("spambegone_reconnects_total", 1, "account", email)
+    if s.Client != nil {
+      s.Client.Terminate()
+      s.Client = nil
+      // Until a login succeeds there is no main connection; callers check for nil
+      if s.primary {
+        c = nil
+      }
+    }
+    var conn *client.Client
+    if conn, err = Login(); err == nil {
+      s.Client = conn
+      if s.primary {
+        c = conn
+      }
+      if err = s.Reselect(); err == nil {
+        slog.Info("Reconnected", "folder", s.Folder, "attempt", attempt)
+        return nil
+      }
+      if errors.Is(err, ErrUIDValidityChanged) {
+        return err
+      }
+    }
+    if attempt == attempts {
+      break
+    }
+    slog.Warn("Reconnect failed; retrying", "attempt", attempt, "wait", backoff, "err", err)
+    time.Sleep(backoff)
+    backoff = min(backoff*2, MaxReconnectBackoff)
+  }
+  return fmt.Errorf("failed to reconnect after %d attempts: %w", attempts, err)
+}
+
+// Select the session's folder on a new connection; its UIDVALIDITY must not have changed
+func (s *Session) Reselect() error {
+  if s.Folder == "" {
+    return nil
+  }
+  mbox, err := s.Client.Select(s.Folder, false)
+  if err != nil {
+    CountIMAPError("select")
+    return fmt.Errorf("failed to reselect mailbox %s: %w", s.Folder, err)
+  }
+  if s.UIDValidity != 0 && mbox.UidValidity != s.UIDValidity {
+    return fmt.Errorf("%s: %w", s.Folder, ErrUIDValidityChanged)
+  }
+  return nil
+}
+
+// Run an IMAP command that is safe to repeat, reconnecting and retrying once if the connection
+// drops. A session whose connection was lost earlier and not recovered reconnects first.
+func (s *Session) Retry(op string, command func() error) error {
+  if s.Client == nil {
+    if err := s.Reconnect(); err != nil {
+      return err
+    }
+    return command()
+  }
+  err := command()
+  if err == nil || !IsConnectionLost(err) {
+    return err
+  }
+  CountIMAPError(op)
+  slog.Warn("Connection lost; reconnecting", "op", op, "folder", s.Folder, "err", err)
+  if err := s.Reconnect(); err != nil {
+    return err
+  }
+  return command()
+}
+
+// Session.Retry on the package-level connection
+func WithReconnect(op string, command func() error) error {
+  return PrimarySession().Retry(op, command)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+  "errors"
+  "io"
+  "net"
+  "strings"
+  "testing"
+
+  imapserver "github.com/emersion/go-imap/server"
+)
+
+func TestSessionRetry(t *testing.T) {
+  defer func(cc ConnectionConfig) { Config.Connection = cc }(Config.Connection)
+  imapServer := imapserver.New(noUsers{})
+  imapServer.AllowInsecureAuth = true
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  go imapServer.Serve(listener)
+  defer imapServer.Close()
+  Config.Connection = ConnectionConfig{Mode: "plain", ReconnectAttempts: -1}
+  if err := Config.Connection.Validate(listener.Addr().String()); err != nil {
+    t.Fatal(err)
+  }
+  conn, err := DialIMAP(listener.Addr().String(), &Config.Connection)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer conn.Logout()
+  s := &Session{Client: conn, Folder: "INBOX"}
+
+  calls := 0
+  denied := errors.New("permission denied")
+  err = s.Retry("store", func() error {
+    calls++
+    return denied
+  })
+  if err != denied || calls != 1 {
+    t.Errorf("an ordinary error: got %v after %d calls, want it returned after 1", err, calls)
+  }
+  calls = 0
+  err = s.Retry("store", func() error {
+    calls++
+    return io.EOF
+  })
+  if err == nil || !strings.Contains(err.Error(), "reconnecting is turned off") || calls != 1 {
+    t.Errorf("a lost connection with reconnecting off: got %v after %d calls", err, calls)
+  }
+  // A session whose connection was already lost reconnects before running the command
+  calls = 0
+  err = (&Session{Folder: "INBOX"}).Retry("store", func() error {
+    calls++
+    return nil
+  })
+  if err == nil || calls != 0 {
+    t.Errorf("without a connection: got %v after %d calls, want an error before any call", err, calls)
+  }
+}
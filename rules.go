@@ -0,0 +1,202 @@
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "sort"
+  "strings"
+  "text/tabwriter"
+  "time"
+)
+
+// RuleUsage is the match history of one Blacklist.txt phrase, including its space-stripped variant
+type RuleUsage struct {
+  Phrase      string
+  Stripped    string
+  Total       int
+  ByCode      [6]int
+  ViaStripped int
+  LastMatched time.Time
+}
+
+// The "rules" command and its subcommands
+func RulesCommand(args []string) error {
+  if len(args) == 0 {
+    return fmt.Errorf("missing rules subcommand (available: report)")
+  }
+  switch args[0] {
+    case "report":
+      return RulesReportCommand(args[1:])
+  }
+  return fmt.Errorf("unknown rules subcommand %q (available: report)", args[0])
+}
+
+// The "rules report" command: dead rules, rules that only match without spaces, and top rules
+func RulesReportCommand(args []string) error {
+  fs := flag.NewFlagSet("rules report", flag.ContinueOnError)
+  days := fs.Int("days", 30, "report rules that have not matched in this many days")
+  top := fs.Int("top", 20, "number of rules to list by volume")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := LoadPaths(); err != nil {
+    return err
+  }
+  var phrases []string
+  for _, path := range FolderListFiles(true) {
+    lines, err := ReadListLines(path, "blacklist")
+    if err != nil {
+      return err
+    }
+    for _, line := range lines {
+      if rule, err := ParseBlacklistLine(line); err == nil && rule.Action.Kind != "none" {
+        phrases = append(phrases, rule.Phrase)
+      }
+    }
+  }
+  records, err := ReadRunMetrics()
+  if err != nil {
+    return err
+  }
+  if len(records) == 0 {
+    fmt.Printf("No runs recorded in %s yet.\n", MetricsFile)
+    return nil
+  }
+  cutoff := time.Now().AddDate(0, 0, -*days)
+  usage := BuildRuleUsage(phrases, records, time.Time{})
+  recent := BuildRuleUsage(phrases, records, cutoff)
+  first, last := records[0].Time, records[0].Time
+  for _, record := range records {
+    if record.Time.Before(first) {
+      first = record.Time
+    }
+    if record.Time.After(last) {
+      last = record.Time
+    }
+  }
+  fmt.Printf("History: %d runs from %s to %s (%s)\n", len(records), first.Local().Format("2006-01-02"), last.Local().Format("2006-01-02"), MetricsFile)
+  if first.After(cutoff) {
+    fmt.Printf("Note: history covers less than %d days, so recently added rules may be listed as unused.\n", *days)
+  }
+  w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+  // Rules with no match inside the window
+  var dead []*RuleUsage
+  for _, phrase := range SortedRuleKeys(usage) {
+    if recent[phrase].Total == 0 {
+      dead = append(dead, usage[phrase])
+    }
+  }
+  fmt.Fprintf(w, "\nRules with no match in the last %d days (%d of %d):\n", *days, len(dead), len(usage))
+  if len(dead) > 0 {
+    fmt.Fprintf(w, "  Rule\tLast matched\t\n")
+  }
+  for _, rule := range dead {
+    lastMatched := "never"
+    if !rule.LastMatched.IsZero() {
+      lastMatched = rule.LastMatched.Local().Format("2006-01-02")
+    }
+    fmt.Fprintf(w, "  %s\t%s\t\n", rule.Phrase, lastMatched)
+  }
+  w.Flush()
+
+  // Rules whose spaced form has never matched, only the variant without spaces
+  var strippedOnly []*RuleUsage
+  for _, phrase := range SortedRuleKeys(usage) {
+    rule := usage[phrase]
+    if rule.Stripped != "" && rule.ViaStripped > 0 && rule.ViaStripped == rule.Total {
+      strippedOnly = append(strippedOnly, rule)
+    }
+  }
+  fmt.Fprintf(w, "\nRules that only ever match without spaces (%d):\n", len(strippedOnly))
+  if len(strippedOnly) > 0 {
+    fmt.Fprintf(w, "  Rule\tMatches as\tTrashed\t\n")
+  }
+  for _, rule := range strippedOnly {
+    fmt.Fprintf(w, "  %s\t%s\t%d\t\n", rule.Phrase, rule.Stripped, rule.Total)
+  }
+  w.Flush()
+
+  // Busiest rules inside the window
+  var busiest []*RuleUsage
+  for _, rule := range recent {
+    if rule.Total > 0 {
+      busiest = append(busiest, rule)
+    }
+  }
+  sort.Slice(busiest, func(i, j int) bool {
+    if busiest[i].Total != busiest[j].Total {
+      return busiest[i].Total > busiest[j].Total
+    }
+    return busiest[i].Phrase < busiest[j].Phrase
+  })
+  if len(busiest) > *top {
+    busiest = busiest[:*top]
+  }
+  fmt.Fprintf(w, "\nTop %d rules by volume in the last %d days:\n", len(busiest), *days)
+  if len(busiest) > 0 {
+    fmt.Fprintf(w, "  Rule\tTrashed\tName\tSubject\tAddress\tWithout spaces\tLast matched\t\n")
+  }
+  for _, rule := range busiest {
+    fmt.Fprintf(w, "  %s\t%d\t%d\t%d\t%d\t%d\t%s\t\n", rule.Phrase, rule.Total, rule.ByCode[3], rule.ByCode[4], rule.ByCode[5],
+      rule.ViaStripped, rule.LastMatched.Local().Format("2006-01-02"))
+  }
+  w.Flush()
+  return nil
+}
+
+// Fold per-run rule counts from runs at or after since back onto the phrases in Blacklist.txt
+func BuildRuleUsage(phrases []string, records []RunMetrics, since time.Time) map[string]*RuleUsage {
+  usage := map[string]*RuleUsage{}
+  variants := map[string]string{}
+  for _, phrase := range phrases {
+    if phrase == "" || usage[phrase] != nil {
+      continue
+    }
+    rule := &RuleUsage{Phrase: phrase}
+    if strings.Contains(phrase, " ") {
+      rule.Stripped = strings.ReplaceAll(phrase, " ", "")
+      if _, taken := variants[rule.Stripped]; !taken {
+        variants[rule.Stripped] = phrase
+      }
+    }
+    usage[phrase] = rule
+    variants[phrase] = phrase
+  }
+  for _, record := range records {
+    if record.Time.Before(since) {
+      continue
+    }
+    for _, count := range record.Rules {
+      // Codes 1 and 2 are the whitelist and unacceptable-character rules, not phrases
+      if count.TrashCode < 3 || count.TrashCode > 5 {
+        continue
+      }
+      phrase, found := variants[count.Phrase]
+      if !found {
+        continue
+      }
+      rule := usage[phrase]
+      rule.Total += count.Count
+      rule.ByCode[count.TrashCode] += count.Count
+      if count.Phrase != phrase {
+        rule.ViaStripped += count.Count
+      }
+      if record.Time.After(rule.LastMatched) {
+        rule.LastMatched = record.Time
+      }
+    }
+  }
+  return usage
+}
+
+// Phrases of a usage map in alphabetical order
+func SortedRuleKeys(usage map[string]*RuleUsage) []string {
+  keys := make([]string, 0, len(usage))
+  for phrase := range usage {
+    keys = append(keys, phrase)
+  }
+  sort.Strings(keys)
+  return keys
+}
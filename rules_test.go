@@ -0,0 +1,46 @@
+package main
+
+import (
+  "testing"
+  "time"
+)
+
+func TestBuildRuleUsage(t *testing.T) {
+  since := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+  records := []RunMetrics{
+    {Time: since.Add(-time.Hour), Rules: []RuleCount{{Phrase: "black friday", TrashCode: 4, Count: 9}}},
+    {Time: since.Add(time.Hour), Rules: []RuleCount{
+      {Phrase: "blackfriday", TrashCode: 4, Count: 2},
+      {Phrase: "black friday", TrashCode: 3, Count: 1},
+      {Phrase: "NotWhiteList", TrashCode: 1, Count: 5},
+      {Phrase: "removed rule", TrashCode: 4, Count: 1},
+    }},
+    {Time: since.Add(48 * time.Hour), Rules: []RuleCount{{Phrase: "black friday", TrashCode: 5, Count: 1}}},
+  }
+  usage := BuildRuleUsage([]string{"black friday", "free money", "black friday", ""}, records, since)
+  if len(usage) != 2 {
+    t.Fatalf("usage has %d rules, want 2: %v", len(usage), SortedRuleKeys(usage))
+  }
+  tests := []struct {
+    phrase      string
+    stripped    string
+    total       int
+    byCode      [6]int
+    viaStripped int
+    lastMatched time.Time
+  }{
+    {"black friday", "blackfriday", 4, [6]int{3: 1, 4: 2, 5: 1}, 2, since.Add(48 * time.Hour)},
+    {"free money", "freemoney", 0, [6]int{}, 0, time.Time{}},
+  }
+  for _, test := range tests {
+    rule := usage[test.phrase]
+    if rule == nil {
+      t.Errorf("no usage for %q", test.phrase)
+      continue
+    }
+    if rule.Stripped != test.stripped || rule.Total != test.total || rule.ByCode != test.byCode ||
+      rule.ViaStripped != test.viaStripped || !rule.LastMatched.Equal(test.lastMatched) {
+      t.Errorf("usage of %q = %+v, want %+v", test.phrase, *rule, test)
+    }
+  }
+}
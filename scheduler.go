@@ -0,0 +1,204 @@
+package main
+
+import (
+  "fmt"
+  "log/slog"
+  "os"
+  "os/signal"
+  "strconv"
+  "strings"
+  "syscall"
+  "time"
+)
+
+// CronSchedule is a parsed five-field cron expression (minute hour day-of-month month day-of-week)
+type CronSchedule struct {
+  Minute     [60]bool
+  Hour       [24]bool
+  DayOfMonth [32]bool
+  Month      [13]bool
+  DayOfWeek  [7]bool
+  AnyDom     bool
+  AnyDow     bool
+}
+
+// Most days each month can have; February counts its leap day
+var monthDays = [13]int{0, 31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
+
+// Run the filter repeatedly on the --every interval or --cron schedule until interrupted
+func RunScheduler() error {
+  var cron *CronSchedule
+  if RunCron != "" {
+    var err error
+    cron, err = ParseCron(RunCron)
+    if err != nil {
+      return err
+    }
+  }
+  stop := make(chan os.Signal, 1)
+  signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+  defer signal.Stop(stop)
+  next := time.Now()
+  for {
+    if cron != nil {
+      next = cron.Next(time.Now())
+    }
+    slog.Info("Next run scheduled", "at", next.Format("2006-01-02 15:04:05"))
+    timer := time.NewTimer(time.Until(next))
+    select {
+      case <-stop:
+        timer.Stop()
+        slog.Info("Scheduler stopped")
+        return nil
+      case <-timer.C:
+    }
+    // A failed run has already been logged; the scheduler carries on with the next one
+    RunLocked()
+    if cron == nil {
+      // A run that overruns its interval starts the next one straight away
+      next = next.Add(RunEvery)
+      if next.Before(time.Now()) {
+        next = time.Now()
+      }
+    }
+  }
+}
+
+// Parse a five-field cron expression such as "*/15 8-18 * * 1-5"
+func ParseCron(expr string) (*CronSchedule, error) {
+  fields := strings.Fields(expr)
+  if len(fields) != 5 {
+    return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+  }
+  cron := &CronSchedule{
+    AnyDom: fields[2] == "*",
+    AnyDow: fields[4] == "*",
+  }
+  if err := parseCronField(fields[0], 0, 59, cron.Minute[:]); err != nil {
+    return nil, fmt.Errorf("cron minute: %w", err)
+  }
+  if err := parseCronField(fields[1], 0, 23, cron.Hour[:]); err != nil {
+    return nil, fmt.Errorf("cron hour: %w", err)
+  }
+  if err := parseCronField(fields[2], 1, 31, cron.DayOfMonth[:]); err != nil {
+    return nil, fmt.Errorf("cron day of month: %w", err)
+  }
+  if err := parseCronField(fields[3], 1, 12, cron.Month[:]); err != nil {
+    return nil, fmt.Errorf("cron month: %w", err)
+  }
+  // Day of week accepts 0-7 where both 0 and 7 mean Sunday
+  var dow [8]bool
+  if err := parseCronField(fields[4], 0, 7, dow[:]); err != nil {
+    return nil, fmt.Errorf("cron day of week: %w", err)
+  }
+  copy(cron.DayOfWeek[:], dow[:7])
+  cron.DayOfWeek[0] = cron.DayOfWeek[0] || dow[7]
+  if !cron.Possible() {
+    return nil, fmt.Errorf("cron expression %q never matches a date", expr)
+  }
+  return cron, nil
+}
+
+// Report whether any date satisfies the month and day fields. Only a day of month with an
+// unrestricted day of week can rule them all out, e.g. "0 0 30 2 *".
+func (cron *CronSchedule) Possible() bool {
+  if cron.AnyDom || !cron.AnyDow {
+    return true
+  }
+  for month := 1; month <= 12; month++ {
+    if !cron.Month[month] {
+      continue
+    }
+    for day := 1; day <= monthDays[month]; day++ {
+      if cron.DayOfMonth[day] {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+// Parse one comma-separated cron field of values, ranges and steps into set
+func parseCronField(field string, min, max int, set []bool) error {
+  for _, part := range strings.Split(field, ",") {
+    step := 1
+    if i := strings.Index(part, "/"); i >= 0 {
+      n, err := strconv.Atoi(part[i+1:])
+      if err != nil || n <= 0 {
+        return fmt.Errorf("invalid step in %q", part)
+      }
+      step = n
+      part = part[:i]
+    }
+    lo, hi := min, max
+    switch {
+      case part == "*":
+      case strings.Contains(part, "-"):
+        bounds := strings.SplitN(part, "-", 2)
+        a, err1 := strconv.Atoi(bounds[0])
+        b, err2 := strconv.Atoi(bounds[1])
+        if err1 != nil || err2 != nil {
+          return fmt.Errorf("invalid range %q", part)
+        }
+        lo, hi = a, b
+      default:
+        n, err := strconv.Atoi(part)
+        if err != nil {
+          return fmt.Errorf("invalid value %q", part)
+        }
+        lo, hi = n, n
+        if step > 1 {
+          hi = max
+        }
+    }
+    if lo < min || hi > max || lo > hi {
+      return fmt.Errorf("%q is outside %d-%d", part, min, max)
+    }
+    for v := lo; v <= hi; v += step {
+      set[v] = true
+    }
+  }
+  return nil
+}
+
+// Next returns the first minute strictly after t that matches the schedule
+func (cron *CronSchedule) Next(t time.Time) time.Time {
+  t = t.Truncate(time.Minute).Add(time.Minute)
+  // Four years covers every valid combination, including Feb 29
+  limit := t.AddDate(4, 0, 0)
+  for t.Before(limit) {
+    if !cron.Month[t.Month()] {
+      t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+      continue
+    }
+    if !cron.matchDay(t) {
+      t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+      continue
+    }
+    if !cron.Hour[t.Hour()] {
+      t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+      continue
+    }
+    if !cron.Minute[t.Minute()] {
+      t = t.Add(time.Minute)
+      continue
+    }
+    return t
+  }
+  return limit
+}
+
+// Classic cron rule: when both day fields are restricted, either one may match
+func (cron *CronSchedule) matchDay(t time.Time) bool {
+  dom := cron.DayOfMonth[t.Day()]
+  dow := cron.DayOfWeek[t.Weekday()]
+  switch {
+    case cron.AnyDom && cron.AnyDow:
+      return true
+    case cron.AnyDom:
+      return dow
+    case cron.AnyDow:
+      return dom
+  }
+  return dom || dow
+}
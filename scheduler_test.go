@@ -0,0 +1,60 @@
+package main
+
+import (
+  "testing"
+  "time"
+)
+
+func TestParseCron(t *testing.T) {
+  tests := []struct {
+    expr  string
+    valid bool
+  }{
+    {"*/15 8-18 * * 1-5", true},
+    {"0 0 29 2 *", true},
+    {"0 0 31 1,4 *", true},
+    {"0 0 30 2 1", true}, // either day field may match, so every Monday in February
+    {"0 0 * * 7", true},
+    {"0 0 30 2 *", false},
+    {"0 0 31 4,6,9,11 *", false},
+    {"60 * * * *", false},
+    {"* 24 * * *", false},
+    {"* * 0 * *", false},
+    {"* * * 13 *", false},
+    {"* * * * 8", false},
+    {"5-1 * * * *", false},
+    {"*/0 * * * *", false},
+    {"* * * *", false},
+  }
+  for _, test := range tests {
+    _, err := ParseCron(test.expr)
+    if (err == nil) != test.valid {
+      t.Errorf("ParseCron(%q): got error %v, want valid %t", test.expr, err, test.valid)
+    }
+  }
+}
+
+func TestCronNext(t *testing.T) {
+  // A Saturday
+  from := time.Date(2026, 1, 3, 17, 59, 30, 0, time.UTC)
+  tests := []struct {
+    expr string
+    want time.Time
+  }{
+    {"* * * * *", time.Date(2026, 1, 3, 18, 0, 0, 0, time.UTC)},
+    {"*/15 8-18 * * 1-5", time.Date(2026, 1, 5, 8, 0, 0, 0, time.UTC)},
+    {"30 17 * * 6", time.Date(2026, 1, 10, 17, 30, 0, 0, time.UTC)},
+    {"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+    {"0 12 1 * 0", time.Date(2026, 1, 4, 12, 0, 0, 0, time.UTC)}, // Sunday comes before the 1st
+    {"0 12 15 3 *", time.Date(2026, 3, 15, 12, 0, 0, 0, time.UTC)},
+  }
+  for _, test := range tests {
+    cron, err := ParseCron(test.expr)
+    if err != nil {
+      t.Fatalf("ParseCron(%q): %v", test.expr, err)
+    }
+    if got := cron.Next(from); !got.Equal(test.want) {
+      t.Errorf("Next(%q) = %s, want %s", test.expr, got, test.want)
+    }
+  }
+}
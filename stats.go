@@ -0,0 +1,165 @@
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "sort"
+  "text/tabwriter"
+  "time"
+)
+
+// StatsRow is one line of aggregated run metrics
+type StatsRow struct {
+  Key     string
+  Runs    int
+  Scanned int
+  Kept    int
+  Trashed int
+}
+
+// RuleStatsRow is one line of aggregated per-rule counts
+type RuleStatsRow struct {
+  Phrase      string
+  TrashCode   byte
+  Count       int
+  Runs        int
+  LastMatched time.Time
+}
+
+// The "stats" command: aggregate MetricsFile by day, week or rule
+func StatsCommand(args []string) error {
+  fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+  by := fs.String("by", "day", "group by day, week or rule")
+  days := fs.Int("days", 30, "only include runs from the last N days (0 for all)")
+  account := fs.String("account", "", "only include runs for this account")
+  folder := fs.String("folder", "", "only include runs for this folder")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := LoadPaths(); err != nil {
+    return err
+  }
+  records, err := ReadRunMetrics()
+  if err != nil {
+    return err
+  }
+  var since time.Time
+  if *days > 0 {
+    since = time.Now().AddDate(0, 0, -*days)
+  }
+  var selected []RunMetrics
+  for _, record := range records {
+    if record.Time.Before(since) {
+      continue
+    }
+    if *account != "" && record.Account != *account {
+      continue
+    }
+    if *folder != "" && record.Folder != *folder {
+      continue
+    }
+    selected = append(selected, record)
+  }
+  if len(selected) == 0 {
+    fmt.Printf("No runs recorded in %s for the selected period.\n", MetricsFile)
+    return nil
+  }
+  w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  defer w.Flush()
+  switch *by {
+    case "day":
+      WriteStatsRows(w, "Day", AggregateRuns(selected, func(t time.Time) string { return t.Format("2006-01-02") }))
+    case "week":
+      WriteStatsRows(w, "Week", AggregateRuns(selected, func(t time.Time) string {
+        year, week := t.ISOWeek()
+        return fmt.Sprintf("%d-W%02d", year, week)
+      }))
+    case "rule":
+      WriteRuleStatsRows(w, AggregateRules(selected))
+    default:
+      return fmt.Errorf("unknown --by value %q (want day, week or rule)", *by)
+  }
+  return nil
+}
+
+// Sum run metrics into rows keyed by the period returned from keyOf
+func AggregateRuns(records []RunMetrics, keyOf func(time.Time) string) []StatsRow {
+  index := map[string]int{}
+  counted := map[string]bool{}
+  var rows []StatsRow
+  for _, record := range records {
+    key := keyOf(record.Time.Local())
+    i, found := index[key]
+    if !found {
+      i = len(rows)
+      index[key] = i
+      rows = append(rows, StatsRow{Key: key})
+    }
+    // A run that filters several folders writes one record per folder
+    if record.RunID == "" || !counted[key+" "+record.RunID] {
+      counted[key+" "+record.RunID] = true
+      rows[i].Runs++
+    }
+    rows[i].Scanned += record.Scanned
+    rows[i].Kept += record.Kept
+    rows[i].Trashed += record.Trashed
+  }
+  sort.Slice(rows, func(i, j int) bool { return rows[i].Key < rows[j].Key })
+  return rows
+}
+
+// Sum per-rule counts across runs, busiest rule first
+func AggregateRules(records []RunMetrics) []RuleStatsRow {
+  type ruleKey struct {
+    phrase string
+    code   byte
+  }
+  index := map[ruleKey]int{}
+  var rows []RuleStatsRow
+  for _, record := range records {
+    for _, rule := range record.Rules {
+      key := ruleKey{rule.Phrase, rule.TrashCode}
+      i, found := index[key]
+      if !found {
+        i = len(rows)
+        index[key] = i
+        rows = append(rows, RuleStatsRow{Phrase: rule.Phrase, TrashCode: rule.TrashCode})
+      }
+      rows[i].Count += rule.Count
+      rows[i].Runs++
+      if record.Time.After(rows[i].LastMatched) {
+        rows[i].LastMatched = record.Time
+      }
+    }
+  }
+  sort.Slice(rows, func(i, j int) bool {
+    if rows[i].Count != rows[j].Count {
+      return rows[i].Count > rows[j].Count
+    }
+    return rows[i].Phrase < rows[j].Phrase
+  })
+  return rows
+}
+
+// Print period rows followed by a total line
+func WriteStatsRows(w *tabwriter.Writer, label string, rows []StatsRow) {
+  fmt.Fprintf(w, "%s\tRuns\tScanned\tKept\tTrashed\t\n", label)
+  total := StatsRow{Key: "Total"}
+  for _, row := range rows {
+    fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t\n", row.Key, row.Runs, row.Scanned, row.Kept, row.Trashed)
+    total.Runs += row.Runs
+    total.Scanned += row.Scanned
+    total.Kept += row.Kept
+    total.Trashed += row.Trashed
+  }
+  fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t\n", total.Key, total.Runs, total.Scanned, total.Kept, total.Trashed)
+}
+
+// Print per-rule rows
+func WriteRuleStatsRows(w *tabwriter.Writer, rows []RuleStatsRow) {
+  fmt.Fprintf(w, "Rule\tCode\tTrashed\tRuns\tLast matched\t\n")
+  for _, row := range rows {
+    fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t\n", row.Phrase, row.TrashCode, row.Count, row.Runs, row.LastMatched.Local().Format("2006-01-02 15:04"))
+  }
+}
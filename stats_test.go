@@ -0,0 +1,42 @@
+package main
+
+import (
+  "fmt"
+  "testing"
+  "time"
+)
+
+func TestAggregateRuns(t *testing.T) {
+  day := func(d, hour int) time.Time { return time.Date(2026, 1, d, hour, 0, 0, 0, time.Local) }
+  records := []RunMetrics{
+    {Time: day(2, 9), Scanned: 10, Kept: 8, Trashed: 2},
+    {Time: day(1, 9), Scanned: 5, Kept: 5},
+    {Time: day(2, 18), Scanned: 4, Kept: 1, Trashed: 3},
+  }
+  rows := AggregateRuns(records, func(t time.Time) string { return t.Format("2006-01-02") })
+  want := "[{2026-01-01 1 5 5 0} {2026-01-02 2 14 9 5}]"
+  if fmt.Sprint(rows) != want {
+    t.Errorf("AggregateRuns = %v, want %s", rows, want)
+  }
+}
+
+func TestAggregateRules(t *testing.T) {
+  first := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+  records := []RunMetrics{
+    {Time: first, Rules: []RuleCount{{"sale", 4, 1}, {"NotWhiteList", 1, 3}}},
+    {Time: first.Add(time.Hour), Rules: []RuleCount{{"sale", 4, 2}, {"sale", 3, 1}, {"invoice", 4, 3}}},
+  }
+  rows := AggregateRules(records)
+  var got []string
+  for _, row := range rows {
+    got = append(got, fmt.Sprintf("%s/%d %d in %d", row.Phrase, row.TrashCode, row.Count, row.Runs))
+  }
+  // Busiest first, ties by phrase
+  want := "[NotWhiteList/1 3 in 1 invoice/4 3 in 1 sale/4 3 in 2 sale/3 1 in 1]"
+  if fmt.Sprint(got) != want {
+    t.Errorf("AggregateRules = %v, want %s", got, want)
+  }
+  if !rows[2].LastMatched.Equal(first.Add(time.Hour)) {
+    t.Errorf("sale/4 last matched %s, want the later run", rows[2].LastMatched)
+  }
+}
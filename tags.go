@@ -0,0 +1,198 @@
+package main
+
+import (
+  "errors"
+  "flag"
+  "fmt"
+  "log/slog"
+  "sort"
+  "strings"
+
+  "github.com/emersion/go-imap"
+)
+
+var (
+  // Set by --tag-only or "tagOnly" in Config.json: every moving action becomes "tag"
+  TagOnly = false
+  // Keyword prefix for "tag" actions without a keyword of their own, e.g. SpamBeGone-Code4
+  TagPrefix = "SpamBeGone-Code"
+)
+
+// Parse tag[:<keyword>][+flagged][+seen]
+func ParseTagAction(spec string) (RuleAction, error) {
+  parts := strings.Split(spec, "+")
+  action := RuleAction{Kind: "tag"}
+  kind, keyword, hasKeyword := strings.Cut(parts[0], ":")
+  if strings.ToLower(strings.TrimSpace(kind)) != "tag" {
+    return RuleAction{}, fmt.Errorf("unknown action %q", spec)
+  }
+  if hasKeyword {
+    action.Keyword = strings.TrimSpace(keyword)
+    if err := ValidateKeyword(action.Keyword); err != nil {
+      return RuleAction{}, err
+    }
+  }
+  for _, modifier := range parts[1:] {
+    switch strings.ToLower(strings.TrimSpace(modifier)) {
+      case "flagged":
+        action.Flagged = true
+      case "seen":
+        action.Seen = true
+      default:
+        return RuleAction{}, fmt.Errorf("unknown tag option %q (want flagged or seen)", modifier)
+    }
+  }
+  return action, nil
+}
+
+// Flags a "tag" action sets on a message
+func TagFlags(action RuleAction) []interface{} {
+  flags := []interface{}{action.Keyword}
+  if action.Flagged {
+    flags = append(flags, imap.FlaggedFlag)
+  }
+  if action.Seen {
+    flags = append(flags, imap.SeenFlag)
+  }
+  return flags
+}
+
+// Report whether a message already carries what an in-place action sets, so applying it again
+// would change nothing
+func AlreadyApplied(msg *imap.Message, action RuleAction) bool {
+  switch action.Kind {
+    case "tag":
+      return HasFlag(msg.Flags, action.Keyword)
+    case "flag":
+      return HasFlag(msg.Flags, imap.FlaggedFlag) && HasFlag(msg.Flags, JunkKeyword)
+  }
+  return false
+}
+
+// Check that a keyword is a valid IMAP flag atom that is not a system flag
+func ValidateKeyword(keyword string) error {
+  if keyword == "" {
+    return errors.New("empty keyword")
+  }
+  if strings.HasPrefix(keyword, "\\") {
+    return fmt.Errorf("keyword %q cannot be a system flag", keyword)
+  }
+  for _, r := range keyword {
+    if r <= ' ' || r >= 0x7f || strings.ContainsRune(`(){%*"\]`, r) {
+      return fmt.Errorf("keyword %q contains %q, which IMAP keywords cannot contain", keyword, r)
+    }
+  }
+  return nil
+}
+
+// Keywords the configured actions add, besides the TagPrefix ones
+func ConfiguredTagKeywords() []string {
+  seen := map[string]bool{}
+  var keywords []string
+  add := func(action RuleAction) {
+    if action.Kind == "tag" && action.Keyword != "" && !seen[action.Keyword] {
+      seen[action.Keyword] = true
+      keywords = append(keywords, action.Keyword)
+    }
+  }
+  add(DefaultAction)
+  add(NotWhitelistedAction)
+  add(UnacceptableAction)
+  for _, rules := range FolderRuleSets {
+    for _, action := range rules.Actions {
+      add(action)
+    }
+  }
+  sort.Strings(keywords)
+  return keywords
+}
+
+// The "cleanup" command: remove the keywords SpamBeGone's tag actions and skipChecked added from every configured folder
+func CleanupCommand(args []string) error {
+  fs := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+  var keywords []string
+  fs.Func("keyword", "remove only this keyword (repeatable; default: "+TagPrefix+"*, "+CheckedPrefix+"* and every tag keyword in the config)", func(value string) error {
+    keywords = append(keywords, value)
+    return nil
+  })
+  dryRun := fs.Bool("dry-run", false, "only report how many messages carry each keyword")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := ReadConfigFile(); err != nil {
+    return err
+  }
+  if err := LoadConfig(); err != nil {
+    return err
+  }
+  ResetRunState()
+  defer CloseConnection()
+  if err := LoadFolderRules(); err != nil {
+    return err
+  }
+  // Without --keyword, everything SpamBeGone may have tagged is removed
+  withPrefix := len(keywords) == 0
+  if withPrefix {
+    keywords = ConfiguredTagKeywords()
+  }
+  if err := ConnectLogin(); err != nil {
+    return err
+  }
+  var errs []error
+  for _, rules := range FolderRuleSets {
+    if err := CleanupFolder(rules.Folder.Name, keywords, withPrefix, *dryRun); err != nil {
+      slog.Error("cleanup failed", "folder", rules.Folder.Name, "err", err)
+      errs = append(errs, fmt.Errorf("folder %s: %w", rules.Folder.Name, err))
+    }
+  }
+  return errors.Join(errs...)
+}
+
+// Remove keywords from every message in a folder; withPrefix also removes any keyword starting
+// with TagPrefix or CheckedPrefix
+func CleanupFolder(folder string, keywords []string, withPrefix, dryRun bool) error {
+  mbox, err := c.Select(folder, dryRun)
+  if err != nil {
+    CountIMAPError("select")
+    return fmt.Errorf("failed to select mailbox %s: %w", folder, err)
+  }
+  targets := append([]string(nil), keywords...)
+  if withPrefix {
+    // FLAGS from SELECT lists the keywords in use in the folder
+    for _, flag := range mbox.Flags {
+      lower := strings.ToLower(flag)
+      if strings.HasPrefix(lower, strings.ToLower(TagPrefix)) || strings.HasPrefix(lower, strings.ToLower(CheckedPrefix)) {
+        targets = append(targets, flag)
+      }
+    }
+  }
+  done := map[string]bool{}
+  for _, keyword := range targets {
+    if done[strings.ToLower(keyword)] {
+      continue
+    }
+    done[strings.ToLower(keyword)] = true
+    criteria := imap.NewSearchCriteria()
+    criteria.WithFlags = []string{keyword}
+    uids, err := c.UidSearch(criteria)
+    if err != nil {
+      CountIMAPError("search")
+      return fmt.Errorf("failed to search for %s: %w", keyword, err)
+    }
+    if len(uids) == 0 {
+      continue
+    }
+    if dryRun {
+      slog.Info("Would remove keyword", "folder", folder, "keyword", keyword, "messages", len(uids))
+      continue
+    }
+    seqset := new(imap.SeqSet)
+    seqset.AddNum(uids...)
+    if err := c.UidStore(seqset, imap.FormatFlagsOp(imap.RemoveFlags, true), []interface{}{keyword}, nil); err != nil {
+      CountIMAPError("store")
+      return fmt.Errorf("failed to remove %s: %w", keyword, err)
+    }
+    slog.Info("Removed keyword", "folder", folder, "keyword", keyword, "messages", len(uids))
+  }
+  return nil
+}
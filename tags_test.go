@@ -0,0 +1,86 @@
+package main
+
+import (
+  "slices"
+  "testing"
+
+  "github.com/emersion/go-imap"
+)
+
+func TestParseTagAction(t *testing.T) {
+  tests := []struct {
+    spec string
+    want RuleAction
+    ok   bool
+  }{
+    {"tag", RuleAction{Kind: "tag"}, true},
+    {"TAG:Newsletter+seen", RuleAction{Kind: "tag", Keyword: "Newsletter", Seen: true}, true},
+    {"tag+flagged+seen", RuleAction{Kind: "tag", Flagged: true, Seen: true}, true},
+    {"tag:$Promo + Flagged", RuleAction{Kind: "tag", Keyword: "$Promo", Flagged: true}, true},
+    {"tag:", RuleAction{}, false},
+    {"tag:\\Seen", RuleAction{}, false},
+    {"tag:two words", RuleAction{}, false},
+    {"tag+starred", RuleAction{}, false},
+    {"tagged", RuleAction{}, false},
+  }
+  for _, test := range tests {
+    got, err := ParseRuleAction(test.spec)
+    if (err == nil) != test.ok {
+      t.Errorf("ParseRuleAction(%q): got error %v, want ok %t", test.spec, err, test.ok)
+      continue
+    }
+    if !test.ok {
+      continue
+    }
+    if got != test.want {
+      t.Errorf("ParseRuleAction(%q) = %+v, want %+v", test.spec, got, test.want)
+    }
+    if again, err := ParseRuleAction(got.String()); err != nil || again != got {
+      t.Errorf("ParseRuleAction(%q) does not round-trip: %+v, %v", got.String(), again, err)
+    }
+  }
+}
+
+func TestValidateKeyword(t *testing.T) {
+  for _, keyword := range []string{"$Junk", "SpamBeGone-Code4", "Newsletter"} {
+    if err := ValidateKeyword(keyword); err != nil {
+      t.Errorf("ValidateKeyword(%q) = %v", keyword, err)
+    }
+  }
+  for _, keyword := range []string{"", "\\Flagged", "a b", "(x)", "50%", "café", "quote\""} {
+    if ValidateKeyword(keyword) == nil {
+      t.Errorf("ValidateKeyword(%q) accepted an invalid keyword", keyword)
+    }
+  }
+}
+
+func TestResolveAction(t *testing.T) {
+  defer func(only bool, prefix string) { TagOnly, TagPrefix = only, prefix }(TagOnly, TagPrefix)
+  TagOnly, TagPrefix = false, "SpamBeGone-Code"
+  if got := ResolveAction(RuleAction{Kind: "tag"}, 4); got.Keyword != "SpamBeGone-Code4" {
+    t.Errorf("tag without keyword resolved to %+v", got)
+  }
+  if got := ResolveAction(RuleAction{Kind: "junk"}, 3); got.Kind != "junk" {
+    t.Errorf("junk resolved to %+v without --tag-only", got)
+  }
+  TagOnly = true
+  tests := map[RuleAction]RuleAction{
+    {Kind: "trash"}:                      {Kind: "tag", Keyword: "SpamBeGone-Code3"},
+    {Kind: "move", Folder: "Bills"}:      {Kind: "tag", Keyword: "SpamBeGone-Code3"},
+    {Kind: "flag"}:                       {Kind: "flag"},
+    {Kind: "none"}:                       {Kind: "none"},
+    {Kind: "tag", Keyword: "Newsletter"}: {Kind: "tag", Keyword: "Newsletter"},
+  }
+  for action, want := range tests {
+    if got := ResolveAction(action, 3); got != want {
+      t.Errorf("ResolveAction(%s) with --tag-only = %+v, want %+v", action, got, want)
+    }
+  }
+}
+
+func TestTagFlags(t *testing.T) {
+  got := TagFlags(RuleAction{Kind: "tag", Keyword: "Newsletter", Flagged: true, Seen: true})
+  if want := []interface{}{"Newsletter", imap.FlaggedFlag, imap.SeenFlag}; !slices.Equal(got, want) {
+    t.Errorf("TagFlags = %v, want %v", got, want)
+  }
+}
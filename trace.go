@@ -0,0 +1,110 @@
+package main
+
+import (
+  "context"
+  "fmt"
+  "log/slog"
+  "strconv"
+  "strings"
+
+  "github.com/emersion/go-imap"
+)
+
+// TraceTarget selects messages whose rule evaluation is logged in full
+type TraceTarget struct {
+  Kind  string // "from", "domain", "uid" or "subject"
+  Value string
+}
+
+// Parse a --trace value into targets. Values may be prefixed with from:, domain:, uid: or
+// subject:; otherwise an address contains '@', a UID is all digits, a domain has a dot and
+// no spaces, and anything else is subject text.
+func AddTraceTargets(value string) error {
+  for _, item := range strings.Split(value, ",") {
+    item = strings.ToLower(strings.TrimSpace(item))
+    if item == "" {
+      continue
+    }
+    target := TraceTarget{}
+    if kind, rest, found := strings.Cut(item, ":"); found && (kind == "from" || kind == "domain" || kind == "uid" || kind == "subject") {
+      target = TraceTarget{Kind: kind, Value: strings.TrimSpace(rest)}
+    } else {
+      switch {
+        case strings.Contains(item, "@"):
+          target = TraceTarget{Kind: "from", Value: item}
+        case strings.Trim(item, "0123456789") == "":
+          target = TraceTarget{Kind: "uid", Value: item}
+        case strings.Contains(item, ".") && !strings.Contains(item, " "):
+          target = TraceTarget{Kind: "domain", Value: item}
+        default:
+          target = TraceTarget{Kind: "subject", Value: item}
+      }
+    }
+    if target.Kind == "domain" {
+      target.Value = strings.TrimLeft(target.Value, "*.")
+    }
+    if target.Kind == "uid" {
+      if _, err := strconv.ParseUint(target.Value, 10, 32); err != nil {
+        return fmt.Errorf("invalid trace UID %q", target.Value)
+      }
+    }
+    if target.Value == "" {
+      return fmt.Errorf("empty trace value in %q", item)
+    }
+    TraceTargets = append(TraceTargets, target)
+  }
+  return nil
+}
+
+// Report whether msg matches any --trace target
+func IsTraced(msg *imap.Message) bool {
+  if len(TraceTargets) == 0 || msg == nil {
+    return false
+  }
+  emailAddress, fromDomain, _ := BuildFromEmailAddress(msg)
+  subject := ""
+  if msg.Envelope != nil {
+    subject = strings.ToLower(msg.Envelope.Subject)
+  }
+  for _, target := range TraceTargets {
+    switch target.Kind {
+      case "from":
+        if emailAddress == target.Value {
+          return true
+        }
+      case "domain":
+        if fromDomain == target.Value || strings.HasSuffix(fromDomain, "."+target.Value) {
+          return true
+        }
+      case "uid":
+        if strconv.FormatUint(uint64(msg.Uid), 10) == target.Value {
+          return true
+        }
+      case "subject":
+        if strings.Contains(subject, target.Value) || strings.Contains(strings.ToLower(ConvertStyledToASCII(subject)), target.Value) {
+          return true
+        }
+    }
+  }
+  return false
+}
+
+// Log a trace line for the message currently being evaluated
+func Trace(msg string, args ...any) {
+  if !Tracing {
+    return
+  }
+  slog.Log(context.Background(), LevelTrace, "trace: "+msg, args...)
+}
+
+// Log the outcome of one rule check for the message currently being evaluated
+func TraceCheck(msg *imap.Message, filterPhrase, check, value string, matched bool, trashCode byte) {
+  if !Tracing {
+    return
+  }
+  args := []any{"uid", msg.Uid, "phrase", filterPhrase, "check", check, "value", value, "matched", matched}
+  if matched {
+    args = append(args, "trashCode", trashCode)
+  }
+  slog.Log(context.Background(), LevelTrace, "trace: rule", args...)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "log/slog"
+  "strings"
+  "testing"
+
+  "github.com/emersion/go-imap"
+)
+
+func TestAddTraceTargets(t *testing.T) {
+  defer func(targets []TraceTarget) { TraceTargets = targets }(TraceTargets)
+  tests := []struct {
+    value string
+    want  string
+    ok    bool
+  }{
+    {"Me@Example.com", "[{from me@example.com}]", true},
+    {"12345", "[{uid 12345}]", true},
+    {"*.example.com", "[{domain example.com}]", true},
+    {"black friday", "[{subject black friday}]", true},
+    {"subject:2.5% off, domain:shop.com", "[{subject 2.5% off} {domain shop.com}]", true},
+    {"uid:99999999999", "", false},
+    {"from:", "", false},
+  }
+  for _, test := range tests {
+    TraceTargets = nil
+    err := AddTraceTargets(test.value)
+    if (err == nil) != test.ok || (test.ok && fmt.Sprint(TraceTargets) != test.want) {
+      t.Errorf("AddTraceTargets(%q): %v, %v; want %s, ok %t", test.value, TraceTargets, err, test.want, test.ok)
+    }
+  }
+}
+
+func TestIsTraced(t *testing.T) {
+  defer func(targets []TraceTarget) { TraceTargets = targets }(TraceTargets)
+  msg := &imap.Message{Uid: 42, Envelope: &imap.Envelope{
+    Subject: "𝐁𝐥𝐚𝐜𝐤 𝐅𝐫𝐢𝐝𝐚𝐲 deals",
+    From:    []*imap.Address{{MailboxName: "news", HostName: "mail.shop.com"}},
+  }}
+  tests := []struct {
+    value string
+    want  bool
+  }{
+    {"news@mail.shop.com", true},
+    {"other@mail.shop.com", false},
+    {"shop.com", true},
+    {"hop.com", false},
+    {"42", true},
+    {"43", false},
+    {"black friday", true},
+    {"cyber monday", false},
+  }
+  for _, test := range tests {
+    TraceTargets = nil
+    if err := AddTraceTargets(test.value); err != nil {
+      t.Fatal(err)
+    }
+    if got := IsTraced(msg); got != test.want {
+      t.Errorf("IsTraced with --trace %q = %t, want %t", test.value, got, test.want)
+    }
+  }
+}
+
+func TestTraceQuiet(t *testing.T) {
+  defer func(logger *slog.Logger, tracing bool) { slog.SetDefault(logger); Tracing = tracing }(slog.Default(), Tracing)
+  // The console handler --quiet gives: warnings and errors only
+  var console bytes.Buffer
+  slog.SetDefault(slog.New(&FanoutHandler{Handlers: []slog.Handler{NewLogHandler(&console, slog.LevelWarn)}}))
+  slog.Info("progress")
+  Trace("decision", "uid", 7)
+  Tracing = true
+  Trace("decision", "uid", 8, "action", "keep")
+  out := console.String()
+  if strings.Contains(out, "progress") || strings.Contains(out, "uid=7") {
+    t.Errorf("console got %q, want no info or untraced lines", out)
+  }
+  if !strings.Contains(out, `level=TRACE msg="trace: decision" uid=8 action=keep`) {
+    t.Errorf("console got %q, want the trace line", out)
+  }
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+  "bufio"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "log/slog"
+  "os"
+  "sort"
+  "strings"
+  "time"
+
+  "github.com/emersion/go-imap"
+  "github.com/emersion/go-imap/commands"
+)
+
+var (
+  // JSON Lines file that receives one MoveRecord per moved message, see ResolvePaths
+  MovesFile = "Moves.jsonl"
+)
+
+// MoveRecord is written to MovesFile for every message a run moved out of a folder
+type MoveRecord struct {
+  RunID       string    `json:"runId"`
+  Time        time.Time `json:"time"`
+  Account     string    `json:"account"`
+  Folder      string    `json:"folder"`      // where the message was
+  Destination string    `json:"destination"` // where it went
+  MessageID   string    `json:"messageId"`
+  Rule        string    `json:"rule"`             // the phrase or variant that matched
+  Phrase      string    `json:"phrase,omitempty"` // the Blacklist.txt phrase it came from
+  TrashCode   byte      `json:"trashCode"`
+  Action      string    `json:"action"`
+  From        string    `json:"from"`
+  Subject     string    `json:"subject"`
+}
+
+// Append a record for each matching email in moved to MovesFile
+func WriteMoveRecords(moved *imap.SeqSet) error {
+  var records []MoveRecord
+  for _, matched := range MatchingEmails {
+    if !moved.Contains(matched.UID) {
+      continue
+    }
+    records = append(records, MoveRecord{
+      RunID:       RunID,
+      Time:        time.Now(),
+      Account:     email,
+      Folder:      SelectFolder,
+      Destination: matched.Action.Destination(),
+      MessageID:   matched.MessageID,
+      Rule:        matched.Rule,
+      Phrase:      matched.Phrase,
+      TrashCode:   matched.TrashCode,
+      Action:      matched.Action.String(),
+      From:        matched.From,
+      Subject:     matched.Subject,
+    })
+  }
+  return AppendMoveRecords(records)
+}
+
+// Append records to MovesFile
+func AppendMoveRecords(records []MoveRecord) error {
+  if len(records) == 0 {
+    return nil
+  }
+  var lines []byte
+  for _, record := range records {
+    line, err := json.Marshal(record)
+    if err != nil {
+      return fmt.Errorf("failed to encode move record: %w", err)
+    }
+    lines = append(append(lines, line...), '\n')
+  }
+  if err := MakeParentDir(MovesFile); err != nil {
+    return fmt.Errorf("failed to create directory for %s: %w", MovesFile, err)
+  }
+  file, err := os.OpenFile(MovesFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+  if err != nil {
+    return fmt.Errorf("failed to open %s: %w", MovesFile, err)
+  }
+  defer file.Close()
+  if _, err := file.Write(lines); err != nil {
+    return fmt.Errorf("failed to write to %s: %w", MovesFile, err)
+  }
+  return nil
+}
+
+// Read every record in MovesFile, skipping lines that do not parse
+func ReadMoveRecords() ([]MoveRecord, error) {
+  file, err := os.Open(MovesFile)
+  if errors.Is(err, os.ErrNotExist) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, fmt.Errorf("failed to open %s: %w", MovesFile, err)
+  }
+  defer file.Close()
+  var records []MoveRecord
+  scanner := bufio.NewScanner(file)
+  scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+  lineNo := 0
+  for scanner.Scan() {
+    lineNo++
+    var record MoveRecord
+    if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+      slog.Warn("skipping unreadable move record", "file", MovesFile, "line", lineNo, "err", err)
+      continue
+    }
+    records = append(records, record)
+  }
+  if err := scanner.Err(); err != nil {
+    return nil, fmt.Errorf("error reading %s: %w", MovesFile, err)
+  }
+  return records, nil
+}
+
+// The "undo" command: move everything one run moved back to where it came from
+func UndoCommand(args []string) error {
+  fs := flag.NewFlagSet("undo", flag.ContinueOnError)
+  runID := fs.String("run", "", "ID of the run to undo, as logged and recorded in Metrics.jsonl")
+  dryRun := fs.Bool("dry-run", false, "only list the messages that would be restored")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if *runID == "" {
+    return errors.New("undo needs --run <id>")
+  }
+  return RestoreMatching(func(record MoveRecord) bool { return record.RunID == *runID }, *dryRun)
+}
+
+// The "restore" command: move back what one rule moved, optionally limited by date and folder
+func RestoreCommand(args []string) error {
+  fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+  rule := fs.String("rule", "", "blacklist phrase, NotWhiteList or Unacceptable")
+  since := fs.String("since", "", "only messages moved on or after this date (YYYY-MM-DD)")
+  until := fs.String("until", "", "only messages moved before this date (YYYY-MM-DD)")
+  folder := fs.String("folder", "", "only messages moved out of this folder")
+  dryRun := fs.Bool("dry-run", false, "only list the messages that would be restored")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if *rule == "" {
+    return errors.New("restore needs --rule <phrase>")
+  }
+  var from, to time.Time
+  var err error
+  if *since != "" {
+    if from, err = time.ParseInLocation("2006-01-02", *since, time.Local); err != nil {
+      return fmt.Errorf("invalid --since %q (want YYYY-MM-DD)", *since)
+    }
+  }
+  if *until != "" {
+    if to, err = time.ParseInLocation("2006-01-02", *until, time.Local); err != nil {
+      return fmt.Errorf("invalid --until %q (want YYYY-MM-DD)", *until)
+    }
+  }
+  return RestoreMatching(func(record MoveRecord) bool {
+    return RecordMatchesRule(record, *rule) &&
+      !record.Time.Before(from) && (to.IsZero() || record.Time.Before(to)) &&
+      (*folder == "" || record.Folder == *folder)
+  }, *dryRun)
+}
+
+// Report whether a record was moved by a rule, given as written in Blacklist.txt or as the
+// variant without spaces that matched. Records written before phrases were recorded only
+// have the variant.
+func RecordMatchesRule(record MoveRecord, rule string) bool {
+  rule = strings.TrimSpace(rule)
+  if strings.EqualFold(record.Rule, rule) || (record.Phrase != "" && strings.EqualFold(record.Phrase, rule)) {
+    return true
+  }
+  return record.Phrase == "" && strings.EqualFold(record.Rule, strings.ReplaceAll(rule, " ", ""))
+}
+
+// Find the recorded moves for this account that keep selects and move those messages back
+func RestoreMatching(keep func(MoveRecord) bool, dryRun bool) error {
+  if err := ReadConfigFile(); err != nil {
+    return err
+  }
+  if err := LoadConfig(); err != nil {
+    return err
+  }
+  records, err := ReadMoveRecords()
+  if err != nil {
+    return err
+  }
+  var selected []MoveRecord
+  for _, record := range records {
+    if record.Account == email && keep(record) {
+      selected = append(selected, record)
+    }
+  }
+  if len(selected) == 0 {
+    fmt.Printf("No matching moves recorded in %s.\n", MovesFile)
+    return nil
+  }
+  lock, err := AcquireLock(email)
+  if err != nil {
+    return err
+  }
+  defer lock.Release()
+  ResetRunState()
+  defer CloseConnection()
+  if err := ConnectLogin(); err != nil {
+    return err
+  }
+  // One pass per destination folder, restoring to each source folder in turn
+  byDestination := map[string][]MoveRecord{}
+  var destinations []string
+  for _, record := range selected {
+    if byDestination[record.Destination] == nil {
+      destinations = append(destinations, record.Destination)
+    }
+    byDestination[record.Destination] = append(byDestination[record.Destination], record)
+  }
+  sort.Strings(destinations)
+  restored, missing := 0, 0
+  var errs []error
+  for _, destination := range destinations {
+    n, notFound, err := RestoreFromFolder(destination, byDestination[destination], dryRun)
+    restored += n
+    missing += notFound
+    if err != nil {
+      slog.Error("restore failed", "folder", destination, "err", err)
+      errs = append(errs, fmt.Errorf("folder %s: %w", destination, err))
+    }
+  }
+  verb := "Restored"
+  if dryRun {
+    verb = "Would restore"
+  }
+  fmt.Printf("%s %d message(s); %d not found in their destination (already restored or deleted).\n", verb, restored, missing)
+  if restored > 0 && !dryRun {
+    fmt.Println("Fix or remove the rule (or whitelist the sender) before the next run, or the messages will be matched again.")
+  }
+  return errors.Join(errs...)
+}
+
+// Find records by Message-ID in destination and move them back to their source folders
+func RestoreFromFolder(destination string, records []MoveRecord, dryRun bool) (restored, missing int, err error) {
+  if _, err := c.Select(destination, dryRun); err != nil {
+    CountIMAPError("select")
+    return 0, 0, fmt.Errorf("failed to select %s: %w", destination, err)
+  }
+  SelectFolder = destination
+  bySource := map[string]*imap.SeqSet{}
+  junk := new(imap.SeqSet)
+  var sources []string
+  for _, record := range records {
+    uid, err := FindByMessageID(record.MessageID)
+    if err != nil {
+      return restored, missing, err
+    }
+    if uid == 0 {
+      slog.Warn("Message not found", "folder", destination, "messageId", record.MessageID, "from", record.From, "subject", record.Subject)
+      missing++
+      continue
+    }
+    slog.Info("Restoring message", "from", record.From, "subject", record.Subject, "rule", record.Rule, "to", record.Folder, "dryRun", dryRun)
+    if bySource[record.Folder] == nil {
+      bySource[record.Folder] = new(imap.SeqSet)
+      sources = append(sources, record.Folder)
+    }
+    bySource[record.Folder].AddNum(uid)
+    if strings.HasPrefix(record.Action, "junk") {
+      junk.AddNum(uid)
+    }
+    restored++
+  }
+  if dryRun || restored == 0 {
+    return restored, missing, nil
+  }
+  // Tell server-side spam filters these were not junk after all
+  if !junk.Empty() {
+    if err := c.UidStore(junk, imap.FormatFlagsOp(imap.RemoveFlags, true), []interface{}{JunkKeyword}, nil); err != nil {
+      slog.Warn("failed to clear keywords", "keywords", JunkKeyword, "err", err)
+    } else if err := c.UidStore(junk, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{NotJunkKeyword}, nil); err != nil {
+      slog.Warn("failed to set keywords", "keywords", NotJunkKeyword, "err", err)
+    }
+  }
+  // Expunging the whole folder would also purge messages deleted there by hand, so only the
+  // restored UIDs are removed: with UID EXPUNGE, else by MOVE
+  uidplus, _ := c.Support("UIDPLUS")
+  if move, _ := c.Support("MOVE"); move && !uidplus {
+    for _, source := range sources {
+      if err := WithReconnect("move", func() error { return c.UidMove(bySource[source], source) }); err != nil {
+        CountIMAPError("move")
+        return restored, missing, fmt.Errorf("failed to move messages back to %s: %w", source, err)
+      }
+    }
+    return restored, missing, nil
+  }
+  deleteSet := new(imap.SeqSet)
+  var copyErr error
+  for _, source := range sources {
+    copied, err := CopyChunks(bySource[source], source)
+    deleteSet.AddSet(copied)
+    if err != nil {
+      copyErr = err
+      break
+    }
+  }
+  if deleteSet.Empty() {
+    return 0, missing, copyErr
+  }
+  if err := WithReconnect("store", func() error {
+    return c.UidStore(deleteSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil)
+  }); err != nil {
+    CountIMAPError("store")
+    return restored, missing, errors.Join(copyErr, fmt.Errorf("restored messages were copied but not removed from %s: %w", destination, err))
+  }
+  if err := WithReconnect("expunge", func() error { return ExpungeUIDs(deleteSet, uidplus) }); err != nil {
+    CountIMAPError("expunge")
+    return restored, missing, errors.Join(copyErr, fmt.Errorf("restored messages were copied but not expunged from %s: %w", destination, err))
+  }
+  return restored, missing, copyErr
+}
+
+// ExpungeCommand is EXPUNGE with a UID set, sent as UID EXPUNGE (RFC 4315)
+type ExpungeCommand struct {
+  SeqSet *imap.SeqSet
+}
+
+// Build the command for commands.Uid to prefix with UID
+func (cmd *ExpungeCommand) Command() *imap.Command {
+  return &imap.Command{Name: "EXPUNGE", Arguments: []interface{}{cmd.SeqSet}}
+}
+
+// Expunge only these \Deleted messages from the selected folder. Without UIDPLUS a plain EXPUNGE
+// is only sent when no other message in the folder is marked \Deleted; otherwise they are left
+// marked, and skipped by later runs, for the user's client to purge.
+func ExpungeUIDs(uids *imap.SeqSet, uidplus bool) error {
+  if uidplus {
+    status, err := c.Execute(&commands.Uid{Cmd: &ExpungeCommand{SeqSet: uids}}, nil)
+    if err != nil {
+      return err
+    }
+    return status.Err()
+  }
+  criteria := imap.NewSearchCriteria()
+  criteria.WithFlags = []string{imap.DeletedFlag}
+  deleted, err := c.UidSearch(criteria)
+  if err != nil {
+    return err
+  }
+  for _, uid := range deleted {
+    if !uids.Contains(uid) {
+      slog.Warn("Server lacks UIDPLUS and other messages are marked deleted; leaving these marked \\Deleted instead of expunging",
+        "folder", SelectFolder, "uids", uids.String())
+      return nil
+    }
+  }
+  return c.Expunge(nil)
+}
+
+// UID of the message with this Message-ID in the selected folder, or 0 if it is not there
+func FindByMessageID(messageID string) (uint32, error) {
+  if messageID == "" {
+    return 0, nil
+  }
+  criteria := imap.NewSearchCriteria()
+  criteria.Header.Add("Message-Id", messageID)
+  criteria.WithoutFlags = []string{imap.DeletedFlag}
+  uids, err := c.UidSearch(criteria)
+  if err != nil {
+    CountIMAPError("search")
+    return 0, fmt.Errorf("failed to search for %s: %w", messageID, err)
+  }
+  if len(uids) == 0 {
+    return 0, nil
+  }
+  return uids[0], nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+
+  "github.com/emersion/go-imap"
+)
+
+func TestMoveRecords(t *testing.T) {
+  keepPaths(t)
+  defer func(matched []Email, folder, trash, account, runID string) {
+    MatchingEmails, SelectFolder, TrashFolder, email, RunID = matched, folder, trash, account, runID
+  }(MatchingEmails, SelectFolder, TrashFolder, email, RunID)
+  MovesFile = filepath.Join(t.TempDir(), "state", "Moves.jsonl")
+  if records, err := ReadMoveRecords(); records != nil || err != nil {
+    t.Fatalf("ReadMoveRecords without a file = %v, %v", records, err)
+  }
+  SelectFolder, TrashFolder, email, RunID = "INBOX", "Trash", "me@example.com", "run-1"
+  MatchingEmails = []Email{
+    {UID: 4, From: "Shop <news@shop.com>", Subject: "Sale", TrashCode: 4, Rule: "sale", Action: RuleAction{Kind: "trash"}, MessageID: "<4@shop.com>"},
+    {UID: 5, From: "bills@bank.com", Subject: "Invoice", TrashCode: 4, Rule: "invoice", Action: RuleAction{Kind: "move", Folder: "Bills"}, MessageID: "<5@bank.com>"},
+    {UID: 6, From: "x@y.com", Subject: "Not moved", TrashCode: 1, Rule: "NotWhiteList", Action: RuleAction{Kind: "trash"}},
+  }
+  moved, _ := imap.ParseSeqSet("4:5")
+  if err := WriteMoveRecords(moved); err != nil {
+    t.Fatal(err)
+  }
+  RunID = "run-2"
+  MatchingEmails = MatchingEmails[2:]
+  moved, _ = imap.ParseSeqSet("6")
+  if err := WriteMoveRecords(moved); err != nil {
+    t.Fatal(err)
+  }
+  data, _ := os.ReadFile(MovesFile)
+  os.WriteFile(MovesFile, append(data, "not json\n"...), 0600)
+  records, err := ReadMoveRecords()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(records) != 3 {
+    t.Fatalf("read %d records, want 3: %+v", len(records), records)
+  }
+  want := []struct {
+    runID, destination, messageID, rule, action string
+  }{
+    {"run-1", "Trash", "<4@shop.com>", "sale", "trash"},
+    {"run-1", "Bills", "<5@bank.com>", "invoice", "move:Bills"},
+    {"run-2", "Trash", "", "NotWhiteList", "trash"},
+  }
+  for i, w := range want {
+    r := records[i]
+    if r.RunID != w.runID || r.Destination != w.destination || r.MessageID != w.messageID || r.Rule != w.rule ||
+      r.Action != w.action || r.Account != "me@example.com" || r.Folder != "INBOX" {
+      t.Errorf("record %d = %+v, want %+v", i, r, w)
+    }
+  }
+}
+
+func TestRestoreCommandArguments(t *testing.T) {
+  tests := []struct {
+    command func([]string) error
+    args    []string
+    err     string
+  }{
+    {UndoCommand, nil, "--run"},
+    {RestoreCommand, nil, "--rule"},
+    {RestoreCommand, []string{"--rule", "sale", "--since", "yesterday"}, "invalid --since"},
+    {RestoreCommand, []string{"--rule", "sale", "--until", "2026-13-01"}, "invalid --until"},
+  }
+  for _, test := range tests {
+    if err := test.command(test.args); err == nil || !strings.Contains(err.Error(), test.err) {
+      t.Errorf("%v: got %v, want an error about %s", test.args, err, test.err)
+    }
+  }
+}
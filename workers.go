@@ -0,0 +1,171 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "log/slog"
+  "sync"
+  "time"
+
+  "github.com/emersion/go-imap"
+)
+
+var (
+  // Held while a message runs through the pipeline stages, which share the per-folder globals.
+  // Only matching takes turns; the searches and fetches the workers spend their time on overlap.
+  evaluateMu sync.Mutex
+  // Held while logging in, see Login
+  loginMu sync.Mutex
+)
+
+// FolderRun is the state RunFolder keeps in package-level variables for the folder being
+// filtered, kept aside so several folders can be evaluated at once
+type FolderRun struct {
+  Rules           FolderRules
+  Mailbox         *imap.MailboxStatus
+  MatchingEmails  []Email
+  MovedUIDs       *imap.SeqSet
+  TrashMetrics    []TrashMetric
+  MessagesScanned int
+  CheckedKeyword  string
+  KeptUIDs        []uint32
+  StartTime       time.Time
+  Err             error // from selecting or fetching the folder
+}
+
+// Start a folder's run from the state ResetFolderState gives it
+func NewFolderRun(rules FolderRules) *FolderRun {
+  ResetFolderState(rules)
+  run := &FolderRun{Rules: rules}
+  run.Save()
+  return run
+}
+
+// Copy the package-level folder state into the run
+func (run *FolderRun) Save() {
+  run.Mailbox         = mailbox
+  run.MatchingEmails  = MatchingEmails
+  run.MovedUIDs       = MovedUIDs
+  run.TrashMetrics    = TrashMetrics
+  run.MessagesScanned = MessagesScanned
+  run.CheckedKeyword  = CheckedKeyword
+  run.KeptUIDs        = KeptUIDs
+  run.StartTime       = FolderStartTime
+}
+
+// Make the run's folder the one the package-level state describes
+func (run *FolderRun) Restore() {
+  SelectFolder       = run.Rules.Folder.Name
+  TrashFolder        = run.Rules.Folder.DestinationFolder()
+  Whitelist          = run.Rules.Whitelist
+  Blacklist          = run.Rules.Blacklist
+  BlacklistActions   = run.Rules.Actions
+  BlacklistMaxAges   = run.Rules.MaxAges
+  BlacklistOriginals = run.Rules.Originals
+  mailbox            = run.Mailbox
+  MatchingEmails     = run.MatchingEmails
+  MovedUIDs          = run.MovedUIDs
+  TrashMetrics       = run.TrashMetrics
+  MessagesScanned    = run.MessagesScanned
+  CheckedKeyword     = run.CheckedKeyword
+  KeptUIDs           = run.KeptUIDs
+  FolderStartTime    = run.StartTime
+}
+
+// Fetch and evaluate the folders on up to workers connections at once, then apply the
+// actions one folder at a time on the main connection: moves share the provider's rate
+// limits, so running them in parallel would only get them throttled
+func RunFoldersParallel(workers int) []error {
+  runs := make([]*FolderRun, len(FolderRuleSets))
+  for i, rules := range FolderRuleSets {
+    runs[i] = NewFolderRun(rules)
+  }
+  // The main connection is handed to the first worker as a session of its own, so no worker
+  // touches c, even when reconnecting; c takes back whatever client that session ends with
+  sessions := []*Session{{Client: c}}
+  c = nil
+  for len(sessions) < workers {
+    conn, err := Login()
+    if err != nil {
+      slog.Warn("Could not open another connection; continuing with fewer", "connections", len(sessions), "err", err)
+      break
+    }
+    sessions = append(sessions, &Session{Client: conn})
+  }
+  slog.Info("Evaluating folders in parallel", "folders", len(runs), "connections", len(sessions))
+  queue := make(chan *FolderRun)
+  var wg sync.WaitGroup
+  for _, s := range sessions {
+    wg.Add(1)
+    go func(s *Session) {
+      defer wg.Done()
+      for run := range queue {
+        run.Err = s.EvaluateFolder(run)
+      }
+    }(s)
+  }
+  for _, run := range runs {
+    queue <- run
+  }
+  close(queue)
+  wg.Wait()
+  c = sessions[0].Client
+  for _, s := range sessions[1:] {
+    if s.Client != nil {
+      s.Client.Logout()
+    }
+  }
+  var errs []error
+  for _, run := range runs {
+    if err := run.Finish(); err != nil {
+      slog.Error("folder failed", "folder", run.Rules.Folder.Name, "err", err)
+      errs = append(errs, fmt.Errorf("folder %s: %w", run.Rules.Folder.Name, err))
+    }
+  }
+  return errs
+}
+
+// Select a folder on this session and run every message through the pipeline stages
+func (s *Session) EvaluateFolder(run *FolderRun) error {
+  name := run.Rules.Folder.Name
+  slog.Info("Filtering folder", "folder", name, "destination", run.Rules.Folder.DestinationFolder(),
+    "whitelist", run.Rules.Folder.Whitelist, "blacklist", run.Rules.Folder.Blacklist)
+  s.Folder, s.UIDValidity = name, 0
+  var mbox *imap.MailboxStatus
+  err := s.Retry("select", func() (err error) {
+    mbox, err = s.Client.Select(name, false)
+    return err
+  })
+  if err != nil {
+    CountIMAPError("select")
+    return fmt.Errorf("failed to select mailbox %s: %w", name, err)
+  }
+  s.UIDValidity = mbox.UidValidity
+  evaluateMu.Lock()
+  run.Mailbox = mbox
+  evaluateMu.Unlock()
+  if mbox.Messages == 0 {
+    return ErrNoMessages
+  }
+  slog.Info("Mailbox selected", "folder", name, "messages", mbox.Messages, "flags", mbox.Flags)
+  return RunPipeline(s, PipelineStages(), run)
+}
+
+// Apply the actions of an evaluated folder and record its metrics
+func (run *FolderRun) Finish() error {
+  run.Restore()
+  if s := PrimarySession(); s.Client == nil {
+    // The main connection was lost during evaluation and not recovered
+    if err := s.Reconnect(); err != nil {
+      return err
+    }
+  }
+  if errors.Is(run.Err, ErrNoMessages) {
+    slog.Info("No messages in the mailbox", "folder", SelectFolder)
+    return WriteRunMetrics(nil)
+  }
+  if run.Err != nil {
+    return run.Err
+  }
+  return FinishFolder()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+  "reflect"
+  "testing"
+
+  "github.com/emersion/go-imap"
+)
+
+func TestFolderRunSaveRestore(t *testing.T) {
+  defer func(folder, trash string, matched []Email, metrics []TrashMetric, scanned int, mbox *imap.MailboxStatus) {
+    SelectFolder, TrashFolder, MatchingEmails, TrashMetrics, MessagesScanned, mailbox = folder, trash, matched, metrics, scanned, mbox
+  }(SelectFolder, TrashFolder, MatchingEmails, TrashMetrics, MessagesScanned, mailbox)
+  inbox := NewFolderRun(FolderRules{Folder: FolderConfig{Name: "INBOX", Destination: "Bin"}, Blacklist: []string{"sale"}})
+  news := NewFolderRun(FolderRules{Folder: FolderConfig{Name: "Newsletters", Destination: "Archive"}, Blacklist: []string{"offer"}})
+  if SelectFolder != "Newsletters" || MessagesScanned != 0 || MatchingEmails != nil {
+    t.Fatalf("NewFolderRun left %s with %d scanned and %v matched", SelectFolder, MessagesScanned, MatchingEmails)
+  }
+
+  inbox.Restore()
+  MessagesScanned = 3
+  MatchingEmails = append(MatchingEmails, Email{UID: 2, Rule: "sale"})
+  mailbox = &imap.MailboxStatus{Name: "INBOX", Messages: 3}
+  inbox.Save()
+
+  news.Restore()
+  if SelectFolder != "Newsletters" || TrashFolder != "Archive" || Blacklist[0] != "offer" || MessagesScanned != 0 || len(MatchingEmails) != 0 || mailbox != nil {
+    t.Errorf("Newsletters restored as %s -> %s, blacklist %v, %d scanned, %d matched, mailbox %v",
+      SelectFolder, TrashFolder, Blacklist, MessagesScanned, len(MatchingEmails), mailbox)
+  }
+  MessagesScanned = 1
+  news.Save()
+
+  inbox.Restore()
+  if SelectFolder != "INBOX" || TrashFolder != "Bin" || MessagesScanned != 3 || len(MatchingEmails) != 1 || mailbox.Messages != 3 {
+    t.Errorf("INBOX restored as %s -> %s, %d scanned, %d matched, mailbox %v", SelectFolder, TrashFolder, MessagesScanned, len(MatchingEmails), mailbox)
+  }
+  if news.MessagesScanned != 1 || inbox.MessagesScanned != 3 {
+    t.Errorf("runs scanned %d and %d, want 1 and 3", news.MessagesScanned, inbox.MessagesScanned)
+  }
+}
+
+func TestRunFoldersParallel(t *testing.T) {
+  account := newFakeAccount(`Trash|\Trash`, "Promotions", "Updates")
+  for _, folder := range []string{"INBOX", "Promotions", "Updates"} {
+    account.Add(folder, "Shop <news@shop.com>", "Big sale in "+folder)
+    account.Add(folder, "Friend <friend@mail.com>", "Lunch?")
+  }
+  startFakeAccount(t, account, "friend@mail.com\n", "sale\n",
+    `, "folders": [{"name": "INBOX"}, {"name": "Promotions"}, {"name": "Updates"}],
+    "connection": {"maxConnections": 3, "reconnectAttempts": 2, "reconnectBackoff": "1ms"}`)
+  // Every worker loses its connection and reconnects, including the one lent the main connection
+  for _, folder := range []string{"INBOX", "Promotions", "Updates"} {
+    account.DropNextFetch(folder)
+  }
+  if err := RunOnce(); err != nil {
+    t.Fatalf("RunOnce: %v", err)
+  }
+  for _, folder := range []string{"INBOX", "Promotions", "Updates"} {
+    if got := account.Subjects(folder); !reflect.DeepEqual(got, []string{"Lunch?"}) {
+      t.Errorf("%s holds %q, want the sale moved", folder, got)
+    }
+  }
+  if got := account.Subjects("Trash"); len(got) != 3 {
+    t.Errorf("Trash holds %q, want the three sales", got)
+  }
+  // The main connection is one of the three workers' connections, then each reconnects once
+  if got := account.Connections(); got != 6 {
+    t.Errorf("server saw %d connections, want 6", got)
+  }
+}